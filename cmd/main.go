@@ -6,8 +6,12 @@ package main
 import (
 	"embed"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
 
+	"github.com/miu200521358/vmd_sizing_t4/cmd/resource"
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
 	"github.com/miu200521358/vmd_sizing_t4/pkg/ui"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
@@ -17,6 +21,7 @@ import (
 	"github.com/miu200521358/mlib_go/pkg/config/mconfig"
 	"github.com/miu200521358/mlib_go/pkg/config/merr"
 	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
 	"github.com/miu200521358/mlib_go/pkg/config/mproc"
 	"github.com/miu200521358/mlib_go/pkg/domain/state"
 	"github.com/miu200521358/mlib_go/pkg/interface/app"
@@ -39,14 +44,22 @@ func init() {
 //go:embed app/*
 var appFiles embed.FS
 
-//go:embed i18n/*
-var appI18nFiles embed.FS
-
 func main() {
 	viewerCount := 2
 	appConfig := mconfig.LoadAppConfig(appFiles)
 	appConfig.Env = env
-	mi18n.Initialize(appI18nFiles)
+	mi18n.Initialize(resource.I18nFiles)
+
+	// 実行ファイルと同じ場所に共通のボーン名エイリアスがあれば読み込む
+	if exePath, err := os.Executable(); err == nil {
+		aliasPath := filepath.Join(filepath.Dir(exePath), "bone_aliases.json")
+		if _, err := os.Stat(aliasPath); err == nil {
+			if err := domain.LoadBoneAliasTable(aliasPath); err != nil {
+				mlog.W(mi18n.T("ボーン名エイリアス読込失敗", map[string]any{"Path": aliasPath, "Error": err.Error()}))
+			}
+		}
+	}
+
 	shared := state.NewSharedState(viewerCount)
 
 	widths, heights, positionXs, positionYs := app.GetCenterSizeAndWidth(appConfig, viewerCount)
@@ -0,0 +1,9 @@
+// Package resource GUI・CLI で共通して埋め込むリソース
+package resource
+
+import "embed"
+
+// I18nFiles アプリの翻訳ファイル(mi18n.Initialize に渡す)
+//
+//go:embed i18n/*
+var I18nFiles embed.FS
@@ -0,0 +1,526 @@
+// sizing-cli GUIを起動せずにサイジングを実行するコマンド
+//
+//	sizing-cli -motion dance.vmd -original original.pmx -sizing target.pmx -leg -upper -shoulder
+//	sizing-cli -motion dance.vmd -original original.pmx -sizing target.pmx -leg -report report.json
+//	sizing-cli -motion dance.vmd -original original.pmx -sizing target.pmx -leg -frames 1200-1500 -base-output dance_L.vmd
+//	sizing-cli -batch jobs.json -summary summary.json -timeout 10m
+//	sizing-cli -suggest-bonemap -original original.pmx -sizing target.pmx
+//	sizing-cli -export-measurement original.json -original original.pmx
+//	sizing-cli -check-foot-sliding sliding.json -motion dance.vmd -original original.pmx -sizing target.pmx -sized dance_L.vmd
+//
+// Ctrl+C で中断した場合は、処理中のサイジングを停止して終了する
+//
+// walk / GLFW に依存しないため、Windows 以外の環境でも実行できる
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miu200521358/vmd_sizing_t4/cmd/resource"
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+	"github.com/miu200521358/vmd_sizing_t4/pkg/usecase"
+
+	"github.com/miu200521358/mlib_go/pkg/config/merr"
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/config/mproc"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+type options struct {
+	originalMotionPath string
+	originalModelPath  string
+	sizingModelPath    string
+	outputMotionPath   string
+	reportPath         string
+
+	cameraMotionPath       string
+	outputCameraMotionPath string
+
+	batchPath   string
+	summaryPath string
+	timeout     time.Duration
+
+	boneAliasPath    string
+	isSuggestBoneMap bool
+
+	measurementPath string
+
+	isFootSliding   bool
+	footSlidingPath string
+	sizedMotionPath string
+
+	scaleValue float64
+	scaleAxis  string
+
+	gazeTarget string
+
+	frameRanges          string
+	frameRangeBlend      int
+	baseOutputMotionPath string
+
+	isSizingLeg          bool
+	isSizingLower        bool
+	isSizingUpper        bool
+	isSizingShoulder     bool
+	isSizingArmStance    bool
+	isSizingFingerStance bool
+	isSizingArmTwist     bool
+	isSizingWrist        bool
+	isSizingFootLock     bool
+	isSizingFloor        bool
+	isSizingGaze         bool
+	isSizingArmCollision bool
+	isSizingSelfContact  bool
+	isSizingHandContact  bool
+	isSizingReduction    bool
+}
+
+func parseOptions() *options {
+	opts := &options{}
+
+	flag.StringVar(&opts.originalMotionPath, "motion", "", "サイジング対象モーション(vmd/vpd)")
+	flag.StringVar(&opts.originalModelPath, "original", "", "モーション作成元モデル(pmx/json) jsonの場合は素体モデルをフィッティングする")
+	flag.StringVar(&opts.sizingModelPath, "sizing", "", "サイジング先モデル(pmx)")
+	flag.StringVar(&opts.outputMotionPath, "output", "", "出力モーション(vmd) 省略時は元モーションと同じ場所に出力")
+	flag.StringVar(&opts.cameraMotionPath, "camera", "", "サイジング結果に合わせて補正するカメラモーション(vmd)")
+	flag.StringVar(&opts.outputCameraMotionPath, "output-camera", "", "出力カメラモーション(vmd) 省略時はカメラモーションと同じ場所に出力")
+
+	flag.StringVar(&opts.reportPath, "report", "", "補正毎の結果の出力先(json) 失敗・中断時も出力する")
+
+	flag.StringVar(&opts.batchPath, "batch", "", "バッチ実行用ジョブファイル(json) 指定時は他のパス指定は不要")
+	flag.StringVar(&opts.summaryPath, "summary", "", "バッチ実行結果の出力先(json)")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "1サイジング毎の制限時間(例: 10m) 0の場合は無制限")
+
+	flag.StringVar(&opts.boneAliasPath, "bone-aliases", "", "全モデル共通のボーン名エイリアス(json)")
+	flag.BoolVar(&opts.isSuggestBoneMap, "suggest-bonemap", false,
+		"-original / -sizing のボーン名マッピング候補を <モデル>.bonemap.json に出力して終了")
+	flag.StringVar(&opts.measurementPath, "export-measurement", "",
+		"-original のボーン配置と手足の長さを json に出力して終了 出力したjsonは -original に指定できる")
+
+	flag.BoolVar(&opts.isFootSliding, "foot-sliding", false, "足補正・足固定・床補正後に足滑りを計測して -report に含める")
+	flag.StringVar(&opts.footSlidingPath, "check-foot-sliding", "",
+		"-sized のモーションの足滑りを計測して json に出力して終了(サイジングはしない)")
+	flag.StringVar(&opts.sizedMotionPath, "sized", "", "足滑りを計測するサイジング済みモーション(vmd)")
+
+	flag.Float64Var(&opts.scaleValue, "scale", 0, "移動補正スケールの固定値 0の場合は足の長さ比率から自動計算")
+	flag.StringVar(&opts.scaleAxis, "scale-axis", "", "軸毎の移動補正スケール(例: 1.1,1.0,1.1) 0の軸は自動計算")
+
+	flag.StringVar(&opts.gazeTarget, "gaze-target", "", "視線補正の注視点(例: 0,15,-30) 元モーションで注視点を見ているフレームは注視点を見続ける")
+
+	flag.StringVar(&opts.frameRanges, "frames", "", "サイジングするフレーム範囲(例: 100-300,500-800) 省略時は全フレーム -camera とは併用不可")
+	flag.IntVar(&opts.frameRangeBlend, "frame-blend", 0, "フレーム範囲の境界で既存の出力モーションと合成するフレーム数 0の場合は5フレーム")
+	flag.StringVar(&opts.baseOutputMotionPath, "base-output", "",
+		"フレーム範囲を合成する出力済みモーション(vmd) 省略時は元モーションに合成する")
+
+	flag.BoolVar(&opts.isSizingLeg, "leg", false, "足補正")
+	flag.BoolVar(&opts.isSizingLower, "lower", false, "下半身補正")
+	flag.BoolVar(&opts.isSizingUpper, "upper", false, "上半身補正")
+	flag.BoolVar(&opts.isSizingShoulder, "shoulder", false, "肩補正")
+	flag.BoolVar(&opts.isSizingArmStance, "arm-stance", false, "腕スタンス補正")
+	flag.BoolVar(&opts.isSizingFingerStance, "finger-stance", false, "指スタンス補正")
+	flag.BoolVar(&opts.isSizingArmTwist, "arm-twist", false, "捩り分散")
+	flag.BoolVar(&opts.isSizingWrist, "wrist", false, "手首位置合わせ")
+	flag.BoolVar(&opts.isSizingFootLock, "foot-lock", false, "足接地固定")
+	flag.BoolVar(&opts.isSizingFloor, "floor", false, "床補正")
+	flag.BoolVar(&opts.isSizingGaze, "gaze", false, "視線補正")
+	flag.BoolVar(&opts.isSizingArmCollision, "arm-collision", false, "腕貫通回避")
+	flag.BoolVar(&opts.isSizingSelfContact, "self-contact", false, "自己接触維持")
+	flag.BoolVar(&opts.isSizingHandContact, "hand-contact", false, "手接触維持")
+	flag.BoolVar(&opts.isSizingReduction, "reduction", false, "不要キー間引き")
+
+	flag.Parse()
+
+	return opts
+}
+
+func (opts *options) validate() error {
+	if opts.batchPath != "" {
+		return nil
+	}
+	if opts.isSuggestBoneMap {
+		if opts.originalModelPath == "" && opts.sizingModelPath == "" {
+			return fmt.Errorf("-original or -sizing is required")
+		}
+		return nil
+	}
+	if opts.measurementPath != "" {
+		if opts.originalModelPath == "" {
+			return fmt.Errorf("-original is required")
+		}
+		return nil
+	}
+	if opts.originalMotionPath == "" {
+		return fmt.Errorf("-motion is required")
+	}
+	if opts.originalModelPath == "" {
+		return fmt.Errorf("-original is required")
+	}
+	if opts.sizingModelPath == "" {
+		return fmt.Errorf("-sizing is required")
+	}
+	if opts.footSlidingPath != "" && opts.sizedMotionPath == "" {
+		return fmt.Errorf("-check-foot-sliding requires -sized")
+	}
+	if opts.scaleAxis != "" {
+		if _, err := parseVec3("scale-axis", opts.scaleAxis); err != nil {
+			return err
+		}
+	}
+	if opts.gazeTarget != "" {
+		if !opts.isSizingGaze {
+			return fmt.Errorf("-gaze-target requires -gaze")
+		}
+		if _, err := parseVec3("gaze-target", opts.gazeTarget); err != nil {
+			return err
+		}
+	}
+	if opts.outputCameraMotionPath != "" && opts.cameraMotionPath == "" {
+		return fmt.Errorf("-output-camera requires -camera")
+	}
+	if opts.frameRanges != "" {
+		if _, err := domain.ParseSizingFrameRanges(opts.frameRanges); err != nil {
+			return err
+		}
+		// 範囲外のカメラを合成する元が無いため、カメラは全フレームでサイジングする
+		if opts.cameraMotionPath != "" {
+			return fmt.Errorf("-camera cannot be used with -frames")
+		}
+	} else if opts.baseOutputMotionPath != "" {
+		return fmt.Errorf("-base-output requires -frames")
+	}
+	return nil
+}
+
+func main() {
+	mproc.SetMaxProcess(false)
+	mi18n.Initialize(resource.I18nFiles)
+
+	opts := parseOptions()
+	if err := opts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if opts.boneAliasPath != "" {
+		if err := domain.LoadBoneAliasTable(opts.boneAliasPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load bone aliases: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.isSuggestBoneMap {
+		if err := suggestBoneMapping(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "bone mapping suggestion failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.measurementPath != "" {
+		if err := exportMeasurement(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "measurement export failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if opts.footSlidingPath != "" {
+		if err := checkFootSliding(ctx, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "foot sliding check failed: %v\n", err)
+			stop()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.batchPath != "" {
+		if err := runBatch(ctx, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "batch failed: %v\n", err)
+			stop()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(ctx, opts); err != nil {
+		if merr.IsTerminateError(err) {
+			fmt.Fprintln(os.Stderr, "sizing terminated")
+		} else {
+			fmt.Fprintf(os.Stderr, "sizing failed: %v\n", err)
+		}
+		stop()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, opts *options) error {
+	sizingSet := domain.NewSizingSet(0)
+
+	if err := sizingSet.LoadOriginalModel(opts.originalModelPath); err != nil {
+		return err
+	}
+	if err := sizingSet.LoadSizingModel(opts.sizingModelPath); err != nil {
+		return err
+	}
+	if err := sizingSet.LoadMotion(opts.originalMotionPath); err != nil {
+		return err
+	}
+
+	sizingSet.IsSizingLeg = opts.isSizingLeg
+	sizingSet.IsSizingLower = opts.isSizingLower
+	sizingSet.IsSizingUpper = opts.isSizingUpper
+	sizingSet.IsSizingShoulder = opts.isSizingShoulder
+	sizingSet.IsSizingArmStance = opts.isSizingArmStance
+	sizingSet.IsSizingFingerStance = opts.isSizingFingerStance
+	sizingSet.IsSizingArmTwist = opts.isSizingArmTwist
+	sizingSet.IsSizingWrist = opts.isSizingWrist
+	sizingSet.IsSizingFootLock = opts.isSizingFootLock
+	sizingSet.IsSizingFloor = opts.isSizingFloor
+	sizingSet.IsSizingGaze = opts.isSizingGaze
+	sizingSet.IsSizingArmCollision = opts.isSizingArmCollision
+	sizingSet.IsSizingSelfContact = opts.isSizingSelfContact
+	sizingSet.IsSizingHandContact = opts.isSizingHandContact
+	sizingSet.IsSizingReduction = opts.isSizingReduction
+
+	if opts.scaleAxis != "" {
+		sizingSet.ScaleMode = domain.SizingScaleModeAxis
+		sizingSet.ScaleAxis, _ = parseVec3("scale-axis", opts.scaleAxis)
+	} else if opts.scaleValue > 0 {
+		sizingSet.ScaleMode = domain.SizingScaleModeFixed
+		sizingSet.ScaleValue = opts.scaleValue
+	}
+
+	if opts.gazeTarget != "" {
+		// validate 済み
+		sizingSet.GazeTarget, _ = parseVec3("gaze-target", opts.gazeTarget)
+	}
+
+	if opts.frameRanges != "" {
+		sizingSet.FrameRanges, _ = domain.ParseSizingFrameRanges(opts.frameRanges)
+		sizingSet.FrameRangeBlend = opts.frameRangeBlend
+
+		if opts.baseOutputMotionPath != "" {
+			if err := sizingSet.LoadBaseOutputMotion(opts.baseOutputMotionPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	outputPath := opts.outputMotionPath
+	if outputPath == "" {
+		outputPath = sizingSet.CreateOutputMotionPath()
+	}
+	sizingSet.OutputMotionPath = outputPath
+
+	pipeline := usecase.NewSizingPipeline([]*domain.SizingSet{sizingSet})
+	pipeline.IsAnalyzeFootSliding = opts.isFootSliding
+	// ボーン不足の補正は飛ばして、-report に記録する
+	pipeline.IsSkipMissingBones = true
+
+	if opts.cameraMotionPath != "" {
+		sizingCamera := domain.NewSizingCamera()
+		if err := sizingCamera.LoadCameraMotion(opts.cameraMotionPath); err != nil {
+			return err
+		}
+		sizingCamera.OutputCameraMotionPath = opts.outputCameraMotionPath
+		if sizingCamera.OutputCameraMotionPath == "" {
+			sizingCamera.OutputCameraMotionPath = sizingCamera.CreateOutputCameraMotionPath(sizingSet)
+		}
+		pipeline.Camera = sizingCamera
+	}
+
+	totalProcessCount := pipeline.ProcessCount()
+	var completedProcessCount int32 = 0
+
+	pipeline.OnProgress = func() {
+		atomic.AddInt32(&completedProcessCount, 1)
+	}
+
+	start := time.Now()
+	mlog.I(mi18n.T("CLIサイジング開始", map[string]any{
+		"MotionPath": opts.originalMotionPath, "OutputPath": outputPath}))
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	_, err := pipeline.Exec(ctx)
+	if opts.reportPath != "" {
+		if reports := pipeline.Reports(); len(reports) > 0 {
+			if saveErr := reports[0].Save(opts.reportPath); saveErr != nil {
+				mlog.W(mi18n.T("CLIレポート保存失敗", map[string]any{"Error": saveErr.Error()}))
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
+
+	outputMotion, err := sizingSet.RestoreSizingBoneNames(sizingSet.OutputMotion)
+	if err != nil {
+		return err
+	}
+
+	rep := repository.NewVmdRepository(true)
+	if err := rep.Save(outputPath, outputMotion, false); err != nil {
+		return err
+	}
+
+	if pipeline.Camera != nil && pipeline.Camera.OutputCameraMotion != nil {
+		if err := rep.Save(pipeline.Camera.OutputCameraMotionPath, pipeline.Camera.OutputCameraMotion, false); err != nil {
+			return err
+		}
+		mlog.I(mi18n.T("CLIカメラ出力", map[string]any{"Path": pipeline.Camera.OutputCameraMotionPath}))
+	}
+
+	mlog.I(mi18n.T("CLIサイジング終了", map[string]any{
+		"Path": outputPath, "CompletedCount": atomic.LoadInt32(&completedProcessCount),
+		"AllCount": totalProcessCount, "ProcessTime": time.Since(start).Round(time.Second).String()}))
+
+	return nil
+}
+
+func runBatch(ctx context.Context, opts *options) error {
+	batch, err := domain.LoadSizingBatch(opts.batchPath)
+	if err != nil {
+		return err
+	}
+
+	batchUsecase := usecase.NewSizingBatchUsecase()
+	batchUsecase.Timeout = opts.timeout
+	summary := batchUsecase.Exec(ctx, batch)
+
+	if opts.summaryPath != "" {
+		if err := summary.Save(opts.summaryPath); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return merr.NewTerminateError("manual terminate")
+	}
+
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d items failed", summary.Failed, len(summary.Results))
+	}
+
+	return nil
+}
+
+// parseVec3 "x,y,z" 形式のオプション値を読み取る
+func parseVec3(name, value string) (*mmath.MVec3, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("-%s must be x,y,z: %s", name, value)
+	}
+
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("-%s must be x,y,z: %s", name, value)
+		}
+		values[i] = v
+	}
+
+	return &mmath.MVec3{X: values[0], Y: values[1], Z: values[2]}, nil
+}
+
+// suggestBoneMapping モデル毎のボーン名マッピング候補を出力する
+// 既にマッピングファイルがある場合は上書きしない
+func suggestBoneMapping(opts *options) error {
+	for _, modelPath := range []string{opts.originalModelPath, opts.sizingModelPath} {
+		if modelPath == "" {
+			continue
+		}
+
+		profilePath := domain.BoneMappingProfilePath(modelPath)
+		if _, err := os.Stat(profilePath); err == nil {
+			mlog.W(mi18n.T("CLIボーン名マッピング出力済み", map[string]any{"Path": profilePath}))
+			continue
+		}
+
+		data, err := repository.NewPmxRepository(false).Load(modelPath)
+		if err != nil {
+			return err
+		}
+
+		profile := domain.SuggestBoneMapping(data.(*pmx.PmxModel))
+		if err := profile.Save(profilePath); err != nil {
+			return err
+		}
+
+		mlog.I(mi18n.T("CLIボーン名マッピング候補出力", map[string]any{
+			"Path": profilePath, "Count": len(profile.Mappings)}))
+	}
+
+	return nil
+}
+
+// exportMeasurement 元モデルのボーン配置と手足の長さをjsonで出力する
+func exportMeasurement(opts *options) error {
+	sizingSet := domain.NewSizingSet(0)
+	if err := sizingSet.LoadOriginalModel(opts.originalModelPath); err != nil {
+		return err
+	}
+
+	if err := sizingSet.SaveOriginalMeasurement(opts.measurementPath); err != nil {
+		return err
+	}
+
+	mlog.I(mi18n.T("CLI計測結果出力", map[string]any{"Path": opts.measurementPath}))
+
+	return nil
+}
+
+// checkFootSliding サイジング済みモーションの足滑りを計測してjsonで出力する
+func checkFootSliding(ctx context.Context, opts *options) error {
+	sizingSet := domain.NewSizingSet(0)
+
+	if err := sizingSet.LoadOriginalModel(opts.originalModelPath); err != nil {
+		return err
+	}
+	if err := sizingSet.LoadSizingModel(opts.sizingModelPath); err != nil {
+		return err
+	}
+	if err := sizingSet.LoadMotion(opts.originalMotionPath); err != nil {
+		return err
+	}
+	if err := sizingSet.LoadBaseOutputMotion(opts.sizedMotionPath); err != nil {
+		return err
+	}
+
+	report, err := usecase.AnalyzeFootSliding(ctx, sizingSet)
+	if err != nil {
+		return err
+	}
+
+	if err := report.Save(opts.footSlidingPath); err != nil {
+		return err
+	}
+
+	mlog.I(mi18n.T("CLI足滑り計測結果出力", map[string]any{
+		"Path": opts.footSlidingPath, "SlidingCount": report.SlidingSpanCount,
+		"SpanCount": len(report.Spans), "MaxDrift": fmt.Sprintf("%.3f", report.MaxDrift)}))
+
+	return nil
+}
@@ -0,0 +1,44 @@
+// base_model JSONの元モデルをフィッティングする素体モデル
+package base_model
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//go:embed model.pmx tex/*
+var files embed.FS
+
+var (
+	extractOnce   sync.Once
+	extractedPath string
+	extractErr    error
+)
+
+// ModelPath 素体モデルをテクスチャごと一時ディレクトリに展開して、モデルのパスを返す
+// 展開はプロセス内で1回のみ行う
+func ModelPath() (string, error) {
+	extractOnce.Do(func() {
+		dir := filepath.Join(os.TempDir(), "vmd_sizing_base_model")
+		extractErr = fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			outputPath := filepath.Join(dir, filepath.FromSlash(path))
+			if d.IsDir() {
+				return os.MkdirAll(outputPath, 0755)
+			}
+			data, err := files.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(outputPath, data, 0644)
+		})
+		extractedPath = filepath.Join(dir, "model.pmx")
+	})
+
+	return extractedPath, extractErr
+}
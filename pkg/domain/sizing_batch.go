@@ -0,0 +1,203 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+)
+
+// SizingBatchJob バッチサイジングのジョブ定義
+// 元モーション × サイジング先モデルの全組み合わせをサイジングする
+type SizingBatchJob struct {
+	OriginalMotionPaths []string `json:"original_motion_paths"` // 元モーションパスリスト
+	OriginalModelPath   string   `json:"original_model_path"`   // 元モデルパス
+	SizingModelPaths    []string `json:"sizing_model_paths"`    // サイジング先モデルパスリスト
+	OutputDir           string   `json:"output_dir"`            // 出力先ディレクトリ(省略時は元モーションと同じ場所)
+
+	IsSizingLeg          bool `json:"is_sizing_leg"`           // 足補正
+	IsSizingLower        bool `json:"is_sizing_lower"`         // 下半身補正
+	IsSizingUpper        bool `json:"is_sizing_upper"`         // 上半身補正
+	IsSizingShoulder     bool `json:"is_sizing_shoulder"`      // 肩補正
+	IsSizingArmStance    bool `json:"is_sizing_arm_stance"`    // 腕補正
+	IsSizingFingerStance bool `json:"is_sizing_finger_stance"` // 指補正
+	IsSizingArmTwist     bool `json:"is_sizing_arm_twist"`     // 腕捩補正
+	IsSizingWrist        bool `json:"is_sizing_wrist"`         // 手首補正
+	IsSizingFootLock     bool `json:"is_sizing_foot_lock"`     // 足接地固定
+	IsSizingFloor        bool `json:"is_sizing_floor"`         // 床補正
+	IsSizingGaze         bool `json:"is_sizing_gaze"`          // 視線補正
+	IsSizingArmCollision bool `json:"is_sizing_arm_collision"` // 腕貫通回避
+	IsSizingSelfContact  bool `json:"is_sizing_self_contact"`  // 自己接触維持
+	IsSizingHandContact  bool `json:"is_sizing_hand_contact"`  // 手接触維持
+	IsSizingReduction    bool `json:"is_sizing_reduction"`     // 不要キー削除補正
+
+	ScaleMode  SizingScaleMode `json:"scale_mode,omitempty"`  // 移動補正スケールの決め方
+	ScaleValue float64         `json:"scale_value,omitempty"` // 固定値の移動補正スケール
+	ScaleAxis  *mmath.MVec3    `json:"scale_axis,omitempty"`  // 軸毎の移動補正スケール
+
+	GazeTarget *mmath.MVec3 `json:"gaze_target,omitempty"` // 視線補正の注視点
+}
+
+// SizingBatch バッチサイジングのジョブファイル
+type SizingBatch struct {
+	Jobs []*SizingBatchJob `json:"jobs"` // ジョブリスト
+}
+
+// SizingBatchItem バッチで処理する1組み合わせ
+type SizingBatchItem struct {
+	OriginalMotionPath string // 元モーションパス
+	OriginalModelPath  string // 元モデルパス
+	SizingModelPath    string // サイジング先モデルパス
+	job                *SizingBatchJob
+}
+
+// LoadSizingBatch ジョブファイルを読み込む
+// セット保存で出力したjson(旧形式のサイジングセットの配列含む)もそのまま読み込める
+// 相対パスはジョブファイルの場所を基準に解決する
+func LoadSizingBatch(path string) (*SizingBatch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &SizingBatch{}
+	if err := json.Unmarshal(data, batch); err == nil && len(batch.Jobs) > 0 {
+		migrateSizingBatchLower(data, batch)
+	} else {
+		// セット設定ファイルとして読み直す
+		file, err := parseSizingSetFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sizing batch file: %s: %w", path, err)
+		}
+
+		batch.Jobs = make([]*SizingBatchJob, 0, len(file.SizingSets))
+		for _, sizingSet := range file.SizingSets {
+			batch.Jobs = append(batch.Jobs, &SizingBatchJob{
+				OriginalMotionPaths:  []string{sizingSet.OriginalMotionPath},
+				OriginalModelPath:    sizingSet.OriginalModelPath,
+				SizingModelPaths:     []string{sizingSet.SizingModelPath},
+				IsSizingLeg:          sizingSet.IsSizingLeg,
+				IsSizingLower:        sizingSet.IsSizingLower,
+				IsSizingUpper:        sizingSet.IsSizingUpper,
+				IsSizingShoulder:     sizingSet.IsSizingShoulder,
+				IsSizingArmStance:    sizingSet.IsSizingArmStance,
+				IsSizingFingerStance: sizingSet.IsSizingFingerStance,
+				IsSizingArmTwist:     sizingSet.IsSizingArmTwist,
+				IsSizingWrist:        sizingSet.IsSizingWrist,
+				IsSizingFootLock:     sizingSet.IsSizingFootLock,
+				IsSizingFloor:        sizingSet.IsSizingFloor,
+				IsSizingGaze:         sizingSet.IsSizingGaze,
+				IsSizingArmCollision: sizingSet.IsSizingArmCollision,
+				IsSizingSelfContact:  sizingSet.IsSizingSelfContact,
+				IsSizingHandContact:  sizingSet.IsSizingHandContact,
+				IsSizingReduction:    sizingSet.IsSizingReduction,
+				ScaleMode:            sizingSet.ScaleMode,
+				ScaleValue:           sizingSet.ScaleValue,
+				ScaleAxis:            sizingSet.ScaleAxis,
+				GazeTarget:           sizingSet.GazeTarget,
+			})
+		}
+	}
+
+	baseDir := filepath.Dir(path)
+	for _, job := range batch.Jobs {
+		for i, motionPath := range job.OriginalMotionPaths {
+			job.OriginalMotionPaths[i] = resolvePath(baseDir, motionPath)
+		}
+		job.OriginalModelPath = resolvePath(baseDir, job.OriginalModelPath)
+		for i, modelPath := range job.SizingModelPaths {
+			job.SizingModelPaths[i] = resolvePath(baseDir, modelPath)
+		}
+		job.OutputDir = resolvePath(baseDir, job.OutputDir)
+	}
+
+	return batch, nil
+}
+
+// migrateSizingBatchLower 下半身補正の指定が無いジョブは、足補正に含まれていた下半身補正を引き継ぐ
+func migrateSizingBatchLower(data []byte, batch *SizingBatch) {
+	rawBatch := struct {
+		Jobs []map[string]json.RawMessage `json:"jobs"`
+	}{}
+	if err := json.Unmarshal(data, &rawBatch); err != nil || len(rawBatch.Jobs) != len(batch.Jobs) {
+		return
+	}
+
+	for i, rawJob := range rawBatch.Jobs {
+		if _, ok := rawJob["is_sizing_lower"]; !ok && batch.Jobs[i].IsSizingLeg {
+			batch.Jobs[i].IsSizingLower = true
+		}
+	}
+}
+
+// Items ジョブを展開して、処理する組み合わせの一覧を返す
+func (sb *SizingBatch) Items() []*SizingBatchItem {
+	items := make([]*SizingBatchItem, 0)
+	for _, job := range sb.Jobs {
+		for _, motionPath := range job.OriginalMotionPaths {
+			for _, modelPath := range job.SizingModelPaths {
+				items = append(items, &SizingBatchItem{
+					OriginalMotionPath: motionPath,
+					OriginalModelPath:  job.OriginalModelPath,
+					SizingModelPath:    modelPath,
+					job:                job,
+				})
+			}
+		}
+	}
+	return items
+}
+
+// NewSizingSet 組み合わせのモデル・モーションを読み込んだサイジングセットを生成する
+func (item *SizingBatchItem) NewSizingSet() (*SizingSet, error) {
+	sizingSet := NewSizingSet(0)
+
+	if err := sizingSet.LoadOriginalModel(item.OriginalModelPath); err != nil {
+		return nil, err
+	}
+	if err := sizingSet.LoadSizingModel(item.SizingModelPath); err != nil {
+		return nil, err
+	}
+	if err := sizingSet.LoadMotion(item.OriginalMotionPath); err != nil {
+		return nil, err
+	}
+
+	sizingSet.IsSizingLeg = item.job.IsSizingLeg
+	sizingSet.IsSizingLower = item.job.IsSizingLower
+	sizingSet.IsSizingUpper = item.job.IsSizingUpper
+	sizingSet.IsSizingShoulder = item.job.IsSizingShoulder
+	sizingSet.IsSizingArmStance = item.job.IsSizingArmStance
+	sizingSet.IsSizingFingerStance = item.job.IsSizingFingerStance
+	sizingSet.IsSizingArmTwist = item.job.IsSizingArmTwist
+	sizingSet.IsSizingWrist = item.job.IsSizingWrist
+	sizingSet.IsSizingFootLock = item.job.IsSizingFootLock
+	sizingSet.IsSizingFloor = item.job.IsSizingFloor
+	sizingSet.IsSizingGaze = item.job.IsSizingGaze
+	sizingSet.IsSizingArmCollision = item.job.IsSizingArmCollision
+	sizingSet.IsSizingSelfContact = item.job.IsSizingSelfContact
+	sizingSet.IsSizingHandContact = item.job.IsSizingHandContact
+	sizingSet.IsSizingReduction = item.job.IsSizingReduction
+
+	// バッチは1組み合わせずつ実行するので、複数人の揃え方は指定しない
+	sizingSet.ScaleMode = item.job.ScaleMode
+	sizingSet.ScaleValue = item.job.ScaleValue
+	sizingSet.ScaleAxis = item.job.ScaleAxis
+	sizingSet.GazeTarget = item.job.GazeTarget
+
+	sizingSet.OutputMotionPath = sizingSet.CreateOutputMotionPath()
+	if item.job.OutputDir != "" {
+		sizingSet.OutputMotionPath = filepath.Join(item.job.OutputDir, filepath.Base(sizingSet.OutputMotionPath))
+	}
+
+	return sizingSet, nil
+}
+
+// resolvePath 相対パスを基準ディレクトリからの絶対パスに変換する
+func resolvePath(baseDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
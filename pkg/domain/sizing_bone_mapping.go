@@ -0,0 +1,499 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+)
+
+// BoneMappingProfile モデル毎のボーン名マッピング
+// <モデルファイル名>.bonemap.json としてモデルと同じ場所に置く
+type BoneMappingProfile struct {
+	Mappings map[string]string `json:"mappings"` // モデルのボーン名 -> 標準ボーン名
+}
+
+func NewBoneMappingProfile() *BoneMappingProfile {
+	return &BoneMappingProfile{
+		Mappings: make(map[string]string),
+	}
+}
+
+// BoneMappingProfilePath モデルに対応するボーン名マッピングファイルのパス
+func BoneMappingProfilePath(modelPath string) string {
+	return strings.TrimSuffix(modelPath, filepath.Ext(modelPath)) + ".bonemap.json"
+}
+
+// LoadBoneMappingProfile モデルに対応するボーン名マッピングを読み込む
+// ファイルがない場合は nil を返す
+func LoadBoneMappingProfile(modelPath string) (*BoneMappingProfile, error) {
+	data, err := os.ReadFile(BoneMappingProfilePath(modelPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	profile := NewBoneMappingProfile()
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// Save ボーン名マッピングをjsonで出力する
+func (profile *BoneMappingProfile) Save(path string) error {
+	output, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+// --------------------------------------------------------------------
+// 全モデル共通のボーン名エイリアス
+
+// boneAlias 標準ボーンに対応する、左右を除いたボーン名の候補
+type boneAlias struct {
+	boneName  pmx.StandardBoneName
+	isTrunk   bool     // 体幹ボーンか(false の場合は左右ボーン)
+	baseNames []string // 正規化済みのボーン名候補
+}
+
+// bone_aliases 英語・中国語圏のリグでよく使われるボーン名
+// Mixamo の LeftLeg はひざなので、曖昧な leg は含めない
+var bone_aliases = []boneAlias{
+	{pmx.CENTER, true, []string{"center"}},
+	{pmx.GROOVE, true, []string{"groove"}},
+	{pmx.LOWER, true, []string{"lowerbody", "hips", "pelvis", "下身", "骨盆", "臀部"}},
+	{pmx.UPPER, true, []string{"upperbody", "spine", "上身", "脊椎"}},
+	{pmx.UPPER2, true, []string{"upperbody2", "spine1", "chest", "上身2", "胸部"}},
+	{pmx.NECK, true, []string{"neck", "脖子", "颈", "颈部"}},
+	{pmx.HEAD, true, []string{"head", "头", "头部"}},
+	{pmx.SHOULDER, false, []string{"shoulder", "clavicle", "肩膀", "锁骨"}},
+	{pmx.ARM, false, []string{"arm", "upperarm", "上臂", "手臂"}},
+	{pmx.ELBOW, false, []string{"elbow", "forearm", "lowerarm", "前臂", "手肘"}},
+	{pmx.WRIST, false, []string{"hand", "wrist", "手腕"}},
+	{pmx.LEG, false, []string{"upleg", "upperleg", "thigh", "大腿"}},
+	{pmx.KNEE, false, []string{"knee", "lowerleg", "calf", "shin", "小腿", "膝盖"}},
+	{pmx.ANKLE, false, []string{"ankle", "foot", "脚踝", "脚"}},
+}
+
+var (
+	user_bone_aliases      = make(map[string]string) // 正規化済みのボーン名 -> 標準ボーン名
+	user_bone_aliases_lock sync.RWMutex
+)
+
+// LoadBoneAliasTable 全モデル共通のボーン名エイリアスを追加で読み込む
+// 標準ボーン名 -> モデルのボーン名リスト のjson
+//
+//	{"上半身": ["spine_01"], "左腕": ["upperarm_l"]}
+func LoadBoneAliasTable(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	table := make(map[string][]string)
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+
+	user_bone_aliases_lock.Lock()
+	defer user_bone_aliases_lock.Unlock()
+
+	for standardName, aliases := range table {
+		for _, alias := range aliases {
+			user_bone_aliases[normalizeBoneName(alias)] = standardName
+		}
+	}
+
+	return nil
+}
+
+var (
+	bone_name_separator    = regexp.MustCompile(`[\s_.\-:|]+`)
+	bone_name_prefix       = regexp.MustCompile(`(?i)^((mixamorig\d*|j_bip([\s_]c)?|valvebiped|bip0?1|def)[\s_.\-:]*)+`)
+	bone_name_side_words   = regexp.MustCompile(`(?i)^(left|right)(.+)$|^(.+?)(left|right)$`)
+	bone_name_side_letters = regexp.MustCompile(`(?i)^([lr])[\s_.\-]+(.+)$|^(.+?)[\s_.\-]+([lr])$`)
+	bone_name_side_kanji   = regexp.MustCompile(`^([左右])(.+)$`)
+)
+
+// normalizeBoneName 比較用に、小文字化・区切り文字除去したボーン名
+func normalizeBoneName(name string) string {
+	return bone_name_separator.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "")
+}
+
+// splitBoneNameSide ボーン名を、左右と左右を除いたボーン名に分ける
+func splitBoneNameSide(name string) (pmx.BoneDirection, string) {
+	name = bone_name_prefix.ReplaceAllString(strings.TrimSpace(name), "")
+
+	toDirection := func(side string) pmx.BoneDirection {
+		switch strings.ToLower(side) {
+		case "left", "l", "左":
+			return pmx.BONE_DIRECTION_LEFT
+		}
+		return pmx.BONE_DIRECTION_RIGHT
+	}
+
+	if m := bone_name_side_kanji.FindStringSubmatch(name); m != nil {
+		return toDirection(m[1]), normalizeBoneName(m[2])
+	}
+	if m := bone_name_side_letters.FindStringSubmatch(name); m != nil {
+		if m[1] != "" {
+			return toDirection(m[1]), normalizeBoneName(m[2])
+		}
+		return toDirection(m[4]), normalizeBoneName(m[3])
+	}
+	if m := bone_name_side_words.FindStringSubmatch(name); m != nil {
+		if m[1] != "" {
+			return toDirection(m[1]), normalizeBoneName(m[2])
+		}
+		return toDirection(m[4]), normalizeBoneName(m[3])
+	}
+
+	return pmx.BONE_DIRECTION_TRUNK, normalizeBoneName(name)
+}
+
+// standardNameFromAlias エイリアスから標準ボーン名を探す
+func standardNameFromAlias(boneName string) string {
+	user_bone_aliases_lock.RLock()
+	standardName, ok := user_bone_aliases[normalizeBoneName(boneName)]
+	user_bone_aliases_lock.RUnlock()
+	if ok {
+		return standardName
+	}
+
+	direction, baseName := splitBoneNameSide(boneName)
+	for _, alias := range bone_aliases {
+		if alias.isTrunk != (direction == pmx.BONE_DIRECTION_TRUNK) {
+			continue
+		}
+		for _, aliasName := range alias.baseNames {
+			if baseName != aliasName {
+				continue
+			}
+			if alias.isTrunk {
+				return alias.boneName.String()
+			}
+			return alias.boneName.StringFromDirection(direction)
+		}
+	}
+
+	return ""
+}
+
+// --------------------------------------------------------------------
+// マッピングの解決と適用
+
+// ResolveBoneMapping モデルのボーン名を標準ボーン名に置き換えるマッピングを解決する
+// モデル毎のマッピング > 共通エイリアス の順で優先し、既にモデルにある標準ボーンは置き換えない
+// 親子関係と位置からの推測は外れることがあるので、読込時には使わず SuggestBoneMapping の候補生成だけで使う
+func ResolveBoneMapping(model *pmx.PmxModel, profile *BoneMappingProfile) map[string]string {
+	return resolveBoneMapping(model, profile, false)
+}
+
+// resolveBoneMapping isSuggest が true の場合、親子関係と位置からの推測も含めてマッピングを解決する
+func resolveBoneMapping(model *pmx.PmxModel, profile *BoneMappingProfile, isSuggest bool) map[string]string {
+	renames := make(map[string]string) // モデルのボーン名 -> 標準ボーン名
+	assigned := make(map[string]bool)  // 割り当て済みの標準ボーン名
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		if bone.Config() != nil {
+			assigned[bone.Name()] = true
+		}
+		return true
+	})
+
+	assign := func(boneName, standardName string) {
+		if standardName == "" || standardName == boneName || assigned[standardName] {
+			return
+		}
+		if _, ok := renames[boneName]; ok {
+			return
+		}
+		if model.Bones.ContainsByName(standardName) {
+			return
+		}
+		renames[boneName] = standardName
+		assigned[standardName] = true
+	}
+
+	if profile != nil {
+		model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+			assign(bone.Name(), profile.Mappings[bone.Name()])
+			return true
+		})
+	}
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		assign(bone.Name(), standardNameFromAlias(bone.Name()))
+		return true
+	})
+
+	if isSuggest {
+		for boneName, standardName := range suggestBoneMappingByHierarchy(model, renames, assigned) {
+			assign(boneName, standardName)
+		}
+	}
+
+	return renames
+}
+
+// SuggestBoneMapping モデルのボーン名マッピング候補を生成する
+// 親子関係と位置からの推測も含むので、生成結果を確認・修正して BoneMappingProfilePath に保存すると、次回の読込時に使われる
+func SuggestBoneMapping(model *pmx.PmxModel) *BoneMappingProfile {
+	profile := NewBoneMappingProfile()
+	for boneName, standardName := range resolveBoneMapping(model, nil, true) {
+		profile.Mappings[boneName] = standardName
+	}
+	return profile
+}
+
+// ApplyBoneMapping モデルのボーン名を標準ボーン名に置き換える
+func ApplyBoneMapping(model *pmx.PmxModel, renames map[string]string) {
+	if len(renames) == 0 {
+		return
+	}
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		if standardName, ok := renames[bone.Name()]; ok {
+			bone.SetName(standardName)
+			model.Bones.Update(bone)
+		}
+		return true
+	})
+
+	model.Bones.Setup()
+}
+
+// renameBoneFrames モーションのボーンキーフレームを別名のボーンに付け替える
+func renameBoneFrames(motion *vmd.VmdMotion, renames map[string]string) {
+	if motion == nil {
+		return
+	}
+
+	for fromName, toName := range renames {
+		if !motion.BoneFrames.Contains(fromName) {
+			continue
+		}
+
+		frames := make([]float32, 0)
+		motion.BoneFrames.Get(fromName).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			motion.InsertBoneFrame(toName, bf)
+			frames = append(frames, frame)
+			return true
+		})
+		for _, frame := range frames {
+			motion.BoneFrames.Get(fromName).Delete(frame)
+		}
+	}
+}
+
+// mapModelBoneNames モデルのボーン名を標準ボーン名に置き換え、置き換えたマッピングを返す
+func mapModelBoneNames(model *pmx.PmxModel, modelPath string) map[string]string {
+	profile, err := LoadBoneMappingProfile(modelPath)
+	if err != nil {
+		mlog.W(mi18n.T("ボーン名マッピング読込失敗", map[string]any{
+			"Path": BoneMappingProfilePath(modelPath), "Error": err.Error()}))
+	}
+
+	renames := ResolveBoneMapping(model, profile)
+	ApplyBoneMapping(model, renames)
+
+	// 置き換えたボーン名は全て記録する
+	boneNames := make([]string, 0, len(renames))
+	for boneName := range renames {
+		boneNames = append(boneNames, boneName)
+	}
+	sort.Strings(boneNames)
+	for _, boneName := range boneNames {
+		mlog.I(mi18n.T("ボーン名置換", map[string]any{
+			"ModelName": model.Name(), "From": boneName, "To": renames[boneName]}))
+	}
+
+	return renames
+}
+
+// --------------------------------------------------------------------
+// 親子関係と位置からの推測
+
+// suggestBoneMappingByHierarchy エイリアスで見つからなかった標準ボーンを、親子関係と位置から推測する
+//   - 下向きに左右へ枝分かれするボーンを下半身、その先を足・ひざ・足首
+//   - 横向きに左右へ、上向きに中央へ枝分かれするボーンを上半身2、横の先を肩・腕・ひじ・手首、中央の先を首・頭
+//   - 下半身から上半身2までの間を上半身
+func suggestBoneMappingByHierarchy(
+	model *pmx.PmxModel, renames map[string]string, assigned map[string]bool,
+) map[string]string {
+	suggestions := make(map[string]string)
+
+	children := make(map[int][]*pmx.Bone)
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		children[bone.ParentIndex] = append(children[bone.ParentIndex], bone)
+		return true
+	})
+
+	// 子孫の数(枝の太さ)
+	descendantCounts := make(map[int]int)
+	var countDescendants func(bone *pmx.Bone) int
+	countDescendants = func(bone *pmx.Bone) int {
+		if count, ok := descendantCounts[bone.Index()]; ok {
+			return count
+		}
+		count := 0
+		for _, child := range children[bone.Index()] {
+			count += 1 + countDescendants(child)
+		}
+		descendantCounts[bone.Index()] = count
+		return count
+	}
+
+	// 子孫の一番多い子を辿った連なり
+	mainChain := func(bone *pmx.Bone, length int) []*pmx.Bone {
+		chain := []*pmx.Bone{bone}
+		for len(chain) < length {
+			var next *pmx.Bone
+			for _, child := range children[chain[len(chain)-1].Index()] {
+				if next == nil || countDescendants(child) > countDescendants(next) {
+					next = child
+				}
+			}
+			if next == nil {
+				break
+			}
+			chain = append(chain, next)
+		}
+		return chain
+	}
+
+	suggest := func(bone *pmx.Bone, standardName string) {
+		if bone == nil || assigned[standardName] {
+			return
+		}
+		if _, ok := renames[bone.Name()]; ok {
+			return
+		}
+		if _, ok := suggestions[bone.Name()]; ok {
+			return
+		}
+		if bone.Config() != nil {
+			return
+		}
+		suggestions[bone.Name()] = standardName
+	}
+
+	// 左右に枝分かれする子の組み合わせを探す(MMDは左が+X)
+	sideChildren := func(bone *pmx.Bone, isDownward bool) (left, right *pmx.Bone) {
+		for _, child := range children[bone.Index()] {
+			if countDescendants(child) < 2 {
+				continue
+			}
+			if isDownward != (child.Position.Y < bone.Position.Y) {
+				continue
+			}
+			if child.Position.X > bone.Position.X && (left == nil || countDescendants(child) > countDescendants(left)) {
+				left = child
+			} else if child.Position.X < bone.Position.X && (right == nil || countDescendants(child) > countDescendants(right)) {
+				right = child
+			}
+		}
+		return left, right
+	}
+
+	var lowerHub, upperHub *pmx.Bone
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		if lowerHub == nil {
+			if left, right := sideChildren(bone, true); left != nil && right != nil {
+				lowerHub = bone
+			}
+		}
+		if upperHub == nil {
+			if left, right := sideChildren(bone, false); left != nil && right != nil {
+				upperHub = bone
+			}
+		}
+		return lowerHub == nil || upperHub == nil
+	})
+
+	if lowerHub != nil {
+		suggest(lowerHub, pmx.LOWER.String())
+
+		left, right := sideChildren(lowerHub, true)
+		for direction, legRoot := range map[pmx.BoneDirection]*pmx.Bone{
+			pmx.BONE_DIRECTION_LEFT: left, pmx.BONE_DIRECTION_RIGHT: right,
+		} {
+			chain := mainChain(legRoot, 3)
+			for i, boneName := range []pmx.StandardBoneName{pmx.LEG, pmx.KNEE, pmx.ANKLE} {
+				if i < len(chain) {
+					suggest(chain[i], boneName.StringFromDirection(direction))
+				}
+			}
+		}
+	}
+
+	if upperHub != nil {
+		left, right := sideChildren(upperHub, false)
+		for direction, armRoot := range map[pmx.BoneDirection]*pmx.Bone{
+			pmx.BONE_DIRECTION_LEFT: left, pmx.BONE_DIRECTION_RIGHT: right,
+		} {
+			// 3本以上に枝分かれする(指がある)ボーンまでを腕の連なりとする
+			chain := mainChain(armRoot, 6)
+			wristIndex := len(chain) - 1
+			for i, bone := range chain {
+				if len(children[bone.Index()]) >= 3 {
+					wristIndex = i
+					break
+				}
+			}
+			for i, boneName := range []pmx.StandardBoneName{pmx.WRIST, pmx.ELBOW, pmx.ARM, pmx.SHOULDER} {
+				if wristIndex-i >= 0 {
+					suggest(chain[wristIndex-i], boneName.StringFromDirection(direction))
+				}
+			}
+		}
+
+		// 中央で上向きの子を首とする
+		for _, child := range children[upperHub.Index()] {
+			if child == left || child == right || child.Position.Y <= upperHub.Position.Y {
+				continue
+			}
+			chain := mainChain(child, 2)
+			suggest(chain[0], pmx.NECK.String())
+			if len(chain) > 1 {
+				suggest(chain[1], pmx.HEAD.String())
+			}
+			break
+		}
+	}
+
+	if lowerHub != nil && upperHub != nil {
+		// 下半身の子から上半身2までの間を上半身とする
+		spine := []*pmx.Bone{upperHub}
+		for len(spine) <= 4 && spine[0].ParentIndex != lowerHub.Index() {
+			parent, _ := model.Bones.Get(spine[0].ParentIndex)
+			if parent == nil {
+				spine = nil
+				break
+			}
+			spine = append([]*pmx.Bone{parent}, spine...)
+		}
+		if len(spine) > 0 && spine[0].ParentIndex == lowerHub.Index() {
+			suggest(spine[0], pmx.UPPER.String())
+			if len(spine) > 1 {
+				suggest(spine[len(spine)-1], pmx.UPPER2.String())
+			}
+		}
+	}
+
+	return suggestions
+}
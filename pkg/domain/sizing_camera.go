@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/mfile"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+// SizingCamera 全セット共通のカメラモーション
+// カメラは1人目(No.1)のセットのサイジング結果に追従させる
+type SizingCamera struct {
+	CameraMotionPath       string         `json:"camera_motion_path"`        // カメラモーションパス
+	OutputCameraMotionPath string         `json:"output_camera_motion_path"` // 出力カメラモーションパス
+	CameraMotion           *vmd.VmdMotion `json:"-"`                         // カメラモーション
+	OutputCameraMotion     *vmd.VmdMotion `json:"-"`                         // 出力結果カメラモーション
+	CompletedSizingCamera  bool           `json:"-"`                         // カメラ補正完了フラグ
+
+	completedKey cameraCompletedKey // カメラ補正完了時に追従していたセットのモデル・モーション
+}
+
+// cameraCompletedKey カメラ補正が追従したセットのモデル・モーション
+type cameraCompletedKey struct {
+	originalModel      *pmx.PmxModel
+	sizingModel        *pmx.PmxModel
+	originalMotionHash string
+	outputMotionHash   string
+}
+
+func newCameraCompletedKey(sizingSet *SizingSet) cameraCompletedKey {
+	key := cameraCompletedKey{
+		originalModel: sizingSet.OriginalConfigModel,
+		sizingModel:   sizingSet.SizingConfigModel,
+	}
+	if sizingSet.OriginalMotion != nil {
+		key.originalMotionHash = sizingSet.OriginalMotion.Hash()
+	}
+	if sizingSet.OutputMotion != nil {
+		key.outputMotionHash = sizingSet.OutputMotion.Hash()
+	}
+	return key
+}
+
+func NewSizingCamera() *SizingCamera {
+	return &SizingCamera{}
+}
+
+// LoadCameraMotion カメラモーションを読み込む
+// 空のパスを指定した場合はカメラモーションを解除する
+func (sc *SizingCamera) LoadCameraMotion(path string) error {
+	sc.CameraMotionPath = path
+	sc.CameraMotion = nil
+	sc.OutputCameraMotion = nil
+	sc.CompletedSizingCamera = false
+
+	if path == "" {
+		return nil
+	}
+
+	vmdRep := repository.NewVmdRepository(true)
+	data, err := vmdRep.Load(path)
+	if err != nil {
+		mlog.ET(mi18n.T("読み込み失敗"), err, "")
+		return err
+	}
+
+	motion := data.(*vmd.VmdMotion)
+	if motion.CameraFrames.Len() == 0 {
+		return fmt.Errorf("camera motion has no camera frames: %s", path)
+	}
+
+	sc.CameraMotion = motion
+
+	return nil
+}
+
+// CreateOutputCameraMotionPath サイジング先モデルのファイル名を含めた出力カメラモーションパスを生成する
+func (sc *SizingCamera) CreateOutputCameraMotionPath(sizingSet *SizingSet) string {
+	if sc.CameraMotionPath == "" || sizingSet == nil || sizingSet.SizingModelPath == "" {
+		return ""
+	}
+
+	_, fileName, _ := mfile.SplitPath(sizingSet.SizingModelPath)
+
+	return mfile.CreateOutputPath(sc.CameraMotionPath, fileName)
+}
+
+// SetCompleted カメラ補正の完了を、追従したセットのモデル・モーションと一緒に記録する
+func (sc *SizingCamera) SetCompleted(sizingSet *SizingSet) {
+	sc.CompletedSizingCamera = true
+	sc.completedKey = newCameraCompletedKey(sizingSet)
+}
+
+// IsCompleted カメラ補正が完了しているか
+// 完了後に追従するセットのモデル・モーションが変わっている場合は、完了フラグを戻す
+func (sc *SizingCamera) IsCompleted(sizingSet *SizingSet) bool {
+	if sc.CompletedSizingCamera && sc.completedKey != newCameraCompletedKey(sizingSet) {
+		sc.CompletedSizingCamera = false
+	}
+	return sc.CompletedSizingCamera
+}
+
+// GetProcessCount カメラ補正の処理ステップ数を返す
+func (sc *SizingCamera) GetProcessCount() int {
+	if sc == nil || sc.CameraMotion == nil || sc.CompletedSizingCamera {
+		return 0
+	}
+
+	// 2: computeVmdDeltas (元・先)
+	// 1: カメラモーションへの反映
+	return 1 + sc.CameraMotion.CameraFrames.Len()*2
+}
+
+// BakeCameraFrames カメラのキーフレームの間にある指定フレームに、カメラのキーフレームを追加する
+// 追加したキーフレームの前後で補間曲線を分割するので、追加前のカメラの動きは変わらない
+func BakeCameraFrames(cameraMotion *vmd.VmdMotion, frames []int) {
+	keyFrames := make([]float32, 0, cameraMotion.CameraFrames.Len())
+	cameraMotion.CameraFrames.ForEach(func(frame float32, cf *vmd.CameraFrame) bool {
+		keyFrames = append(keyFrames, frame)
+		return true
+	})
+
+	for _, iFrame := range frames {
+		frame := float32(iFrame)
+		nextIndex := sort.Search(len(keyFrames), func(i int) bool { return keyFrames[i] >= frame })
+		if nextIndex == 0 || nextIndex == len(keyFrames) || keyFrames[nextIndex] == frame {
+			// 最初のキーより前・最後のキーより後ろ、もしくは既にキーがある場合は追加しない
+			continue
+		}
+		prevFrame, nextFrame := keyFrames[nextIndex-1], keyFrames[nextIndex]
+
+		cf := cameraMotion.CameraFrames.Get(frame)
+		nextCf := cameraMotion.CameraFrames.Get(nextFrame)
+		if nextCf.Curves != nil {
+			x := float64(frame-prevFrame) / float64(nextFrame-prevFrame)
+			beforeCurves := vmd.NewCameraCurves()
+			afterCurves := vmd.NewCameraCurves()
+			for _, v := range []struct {
+				curve       *mmath.Curve
+				beforeCurve **mmath.Curve
+				afterCurve  **mmath.Curve
+			}{
+				{nextCf.Curves.TranslateX, &beforeCurves.TranslateX, &afterCurves.TranslateX},
+				{nextCf.Curves.TranslateY, &beforeCurves.TranslateY, &afterCurves.TranslateY},
+				{nextCf.Curves.TranslateZ, &beforeCurves.TranslateZ, &afterCurves.TranslateZ},
+				{nextCf.Curves.Rotate, &beforeCurves.Rotate, &afterCurves.Rotate},
+				{nextCf.Curves.Distance, &beforeCurves.Distance, &afterCurves.Distance},
+				{nextCf.Curves.ViewOfAngle, &beforeCurves.ViewOfAngle, &afterCurves.ViewOfAngle},
+			} {
+				if v.curve == nil {
+					continue
+				}
+				*v.beforeCurve, *v.afterCurve = splitCurve(v.curve, x)
+			}
+			cf.Curves = beforeCurves
+			nextCf.Curves = afterCurves
+		}
+
+		cameraMotion.InsertCameraFrame(cf)
+		keyFrames = append(keyFrames[:nextIndex], append([]float32{frame}, keyFrames[nextIndex:]...)...)
+	}
+}
@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"math"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+)
+
+// curve_max 補間曲線の制御点の最大値
+const curve_max = 127.0
+
+// curveBezier 制御点 (0, v1, v2, 1) の3次ベジェ曲線の、曲線パラメータ u における値
+func curveBezier(u, v1, v2 float64) float64 {
+	return 3*(1-u)*(1-u)*u*v1 + 3*(1-u)*u*u*v2 + u*u*u
+}
+
+// CurveParameter 制御点Xが 0～1 の x1, x2 の補間曲線で、経過割合 x に対応する曲線パラメータを二分探索で求める
+func CurveParameter(x1, x2, x float64) float64 {
+	low, high := 0.0, 1.0
+	for range 30 {
+		mid := (low + high) / 2
+		if curveBezier(mid, x1, x2) < x {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2
+}
+
+// EvaluateCurve 補間曲線の経過割合 x (0～1) に対する変化割合 (0～1) を求める
+func EvaluateCurve(curve *mmath.Curve, x float64) float64 {
+	u := CurveParameter(curve.Start.X/curve_max, curve.End.X/curve_max, x)
+	return curveBezier(u, curve.Start.Y/curve_max, curve.End.Y/curve_max)
+}
+
+// NewCurve 0～1 の制御点から補間曲線を生成する
+func NewCurve(x1, y1, x2, y2 float64) *mmath.Curve {
+	return &mmath.Curve{
+		Start: mmath.MVec2{X: math.Round(x1 * curve_max), Y: math.Round(y1 * curve_max)},
+		End:   mmath.MVec2{X: math.Round(x2 * curve_max), Y: math.Round(y2 * curve_max)},
+	}
+}
+
+// splitCurve 補間曲線を、経過割合 x の位置で前半と後半に分割する(de Casteljau)
+func splitCurve(curve *mmath.Curve, x float64) (before, after *mmath.Curve) {
+	p1 := &mmath.MVec2{X: curve.Start.X / curve_max, Y: curve.Start.Y / curve_max}
+	p2 := &mmath.MVec2{X: curve.End.X / curve_max, Y: curve.End.Y / curve_max}
+
+	// x に対応する曲線パラメータ
+	u := CurveParameter(p1.X, p2.X, x)
+
+	lerp := func(a, b *mmath.MVec2) *mmath.MVec2 {
+		return &mmath.MVec2{X: a.X + (b.X-a.X)*u, Y: a.Y + (b.Y-a.Y)*u}
+	}
+	p0 := &mmath.MVec2{X: 0, Y: 0}
+	p3 := &mmath.MVec2{X: 1, Y: 1}
+	p01, p12, p23 := lerp(p0, p1), lerp(p1, p2), lerp(p2, p3)
+	p012, p123 := lerp(p01, p12), lerp(p12, p23)
+	pm := lerp(p012, p123)
+
+	// 分割した曲線を、それぞれ 0～1 に正規化する
+	newCurve := func(origin, size, c1, c2 *mmath.MVec2) *mmath.Curve {
+		if size.X < 1e-6 || size.Y < 1e-6 {
+			// 分割した側で値が変わらない場合は線形補間にする
+			return &mmath.Curve{Start: mmath.MVec2{X: 20, Y: 20}, End: mmath.MVec2{X: 107, Y: 107}}
+		}
+		normalize := func(v float64) float64 {
+			return max(0, min(1, v))
+		}
+		return NewCurve(
+			normalize((c1.X-origin.X)/size.X), normalize((c1.Y-origin.Y)/size.Y),
+			normalize((c2.X-origin.X)/size.X), normalize((c2.Y-origin.Y)/size.Y))
+	}
+
+	before = newCurve(p0, pm, p01, p012)
+	after = newCurve(pm, &mmath.MVec2{X: 1 - pm.X, Y: 1 - pm.Y}, p123, p23)
+
+	return before, after
+}
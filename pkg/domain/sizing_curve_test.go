@@ -0,0 +1,41 @@
+package domain
+
+import (
+	"math"
+	"testing"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+)
+
+func TestEvaluateCurve(t *testing.T) {
+	linear := NewCurve(0.2, 0.2, 0.8, 0.8)
+	for _, x := range []float64{0.0, 0.25, 0.5, 0.75, 1.0} {
+		if actual := EvaluateCurve(linear, x); math.Abs(actual-x) > 0.01 {
+			t.Errorf("linear x=%.2f: expected %.4f, got %.4f", x, x, actual)
+		}
+	}
+}
+
+func TestSplitCurve(t *testing.T) {
+	curve := &mmath.Curve{Start: mmath.MVec2{X: 64, Y: 0}, End: mmath.MVec2{X: 64, Y: 127}}
+	splitX := 0.3
+	splitY := EvaluateCurve(curve, splitX)
+
+	before, after := splitCurve(curve, splitX)
+
+	// 分割前後の曲線で、同じフレームの変化割合がおおよそ一致する(制御点の丸め分は許容する)
+	for _, x := range []float64{0.1, 0.2, 0.25} {
+		expected := EvaluateCurve(curve, x)
+		actual := EvaluateCurve(before, x/splitX) * splitY
+		if math.Abs(expected-actual) > 0.02 {
+			t.Errorf("before x=%.2f: expected %.4f, got %.4f", x, expected, actual)
+		}
+	}
+	for _, x := range []float64{0.4, 0.6, 0.9} {
+		expected := EvaluateCurve(curve, x)
+		actual := splitY + EvaluateCurve(after, (x-splitX)/(1-splitX))*(1-splitY)
+		if math.Abs(expected-actual) > 0.02 {
+			t.Errorf("after x=%.2f: expected %.4f, got %.4f", x, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"sync"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+)
+
+// DeltaCacheKey デフォーム結果キャッシュのキー
+type DeltaCacheKey struct {
+	Model      *pmx.PmxModel // デフォームしたモデル
+	MotionHash string        // デフォームした時点のモーションのハッシュ
+	IsMorph    bool          // ボーンモーフのみのデフォーム結果か
+	IsCalcIk   bool          // IKを計算したか
+}
+
+// NewDeltaCacheKey キャッシュキーを生成する
+func NewDeltaCacheKey(model *pmx.PmxModel, motion *vmd.VmdMotion, isMorph, isCalcIk bool) DeltaCacheKey {
+	return DeltaCacheKey{
+		Model:      model,
+		MotionHash: motion.Hash(),
+		IsMorph:    isMorph,
+		IsCalcIk:   isCalcIk,
+	}
+}
+
+type deltaCacheEntry struct {
+	key       DeltaCacheKey
+	boneNames map[string]struct{}      // デフォーム対象ボーン名
+	deltas    map[int]*delta.VmdDeltas // フレーム毎のデフォーム結果
+}
+
+// containsBoneNames 対象ボーンを全て含んでいるか
+func (entry *deltaCacheEntry) containsBoneNames(boneNames []string) bool {
+	for _, boneName := range boneNames {
+		if _, ok := entry.boneNames[boneName]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SizingDeltaCache サイジングセット単位のデフォーム結果キャッシュ
+// 補正を跨いで、同じモデル・モーション・ボーンのデフォーム結果を使い回す
+// モーション全体分を保持するので、サイジングの実行が終わったら破棄する
+type SizingDeltaCache struct {
+	entries []*deltaCacheEntry
+	mutex   sync.RWMutex
+}
+
+func NewSizingDeltaCache() *SizingDeltaCache {
+	return &SizingDeltaCache{
+		entries: make([]*deltaCacheEntry, 0),
+	}
+}
+
+// Get キャッシュからフレーム毎のデフォーム結果を取得する
+// 対象ボーンを全て含むキャッシュがない、もしくはキャッシュにないフレームは nil になる
+func (dc *SizingDeltaCache) Get(key DeltaCacheKey, boneNames []string, frames []int) []*delta.VmdDeltas {
+	dc.mutex.RLock()
+	defer dc.mutex.RUnlock()
+
+	allDeltas := make([]*delta.VmdDeltas, len(frames))
+	for _, entry := range dc.entries {
+		if entry.key != key || !entry.containsBoneNames(boneNames) {
+			continue
+		}
+
+		for i, frame := range frames {
+			if allDeltas[i] == nil {
+				allDeltas[i] = entry.deltas[frame]
+			}
+		}
+	}
+
+	return allDeltas
+}
+
+// Set フレーム毎のデフォーム結果をキャッシュに登録する
+func (dc *SizingDeltaCache) Set(
+	key DeltaCacheKey, boneNames []string, frames []int, allDeltas []*delta.VmdDeltas,
+) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	var target *deltaCacheEntry
+	for _, entry := range dc.entries {
+		if entry.key == key && len(entry.boneNames) == len(boneNames) && entry.containsBoneNames(boneNames) {
+			target = entry
+			break
+		}
+	}
+
+	if target == nil {
+		target = &deltaCacheEntry{
+			key:       key,
+			boneNames: make(map[string]struct{}, len(boneNames)),
+			deltas:    make(map[int]*delta.VmdDeltas, len(frames)),
+		}
+		for _, boneName := range boneNames {
+			target.boneNames[boneName] = struct{}{}
+		}
+		dc.entries = append(dc.entries, target)
+	}
+
+	for i, frame := range frames {
+		if allDeltas[i] != nil {
+			target.deltas[frame] = allDeltas[i]
+		}
+	}
+}
+
+// Clear キャッシュを破棄する
+func (dc *SizingDeltaCache) Clear() {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	dc.entries = make([]*deltaCacheEntry, 0)
+}
@@ -0,0 +1,215 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain/base_model"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+// JsonBoneLayout JSONモデルのボーン配置
+// ボーンの名前と位置だけを使い、それ以外の項目は素体モデルのものを使う
+type JsonBoneLayout struct {
+	Name  string            `json:"Name"`  // モデル名
+	Bones []*JsonLayoutBone `json:"Bones"` // ボーンリスト
+}
+
+// JsonLayoutBone JSONモデルのボーン1本分
+type JsonLayoutBone struct {
+	Name     string       `json:"name"`     // ボーン名
+	Position *mmath.MVec3 `json:"position"` // ボーン位置
+}
+
+// LoadJsonBoneLayout JSONモデルのボーン配置を読み込む
+func LoadJsonBoneLayout(path string) (*JsonBoneLayout, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := &JsonBoneLayout{}
+	if err := json.Unmarshal(data, layout); err != nil {
+		return nil, fmt.Errorf("invalid json model: %s: %w", path, err)
+	}
+	if len(layout.Bones) == 0 {
+		return nil, fmt.Errorf("invalid json model: %s: no bones", path)
+	}
+
+	return layout, nil
+}
+
+// loadFittedBaseModel 素体モデルを読み込み、JSONモデルのボーン配置にフィッティングする
+func loadFittedBaseModel(path string, isLog bool) (*pmx.PmxModel, error) {
+	layout, err := LoadJsonBoneLayout(path)
+	if err != nil {
+		return nil, err
+	}
+
+	baseModelPath, err := base_model.ModelPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := repository.NewPmxRepository(isLog).Load(baseModelPath)
+	if err != nil {
+		return nil, err
+	}
+	model := data.(*pmx.PmxModel)
+
+	FitBaseModel(model, layout)
+
+	// パスは素体モデルのまま(テクスチャは展開先を参照する)にして、名前だけ json に合わせる
+	if layout.Name != "" {
+		model.SetName(layout.Name)
+	}
+
+	return model, nil
+}
+
+// boneFitting ボーン1本分のフィッティング変形
+// ボーンの向きに回転し、ボーンの軸方向のみ伸縮する(太さは変えない)
+type boneFitting struct {
+	basePosition   *mmath.MVec3       // 素体モデルのボーン位置
+	targetPosition *mmath.MVec3       // フィッティング後のボーン位置
+	rotation       *mmath.MQuaternion // 素体モデルのボーン方向からフィッティング後のボーン方向への回転
+	axis           *mmath.MVec3       // 素体モデルのボーン方向(nilの場合は伸縮しない)
+	scale          float64            // ボーン方向の伸縮率
+}
+
+// transform 素体モデル上の位置を、フィッティング後の位置に変換する
+func (bf *boneFitting) transform(position *mmath.MVec3) *mmath.MVec3 {
+	offset := position.Subed(bf.basePosition)
+	if bf.axis != nil {
+		along := bf.axis.MuledScalar(offset.Dot(bf.axis))
+		offset = offset.Subed(along).Added(along.MuledScalar(bf.scale))
+	}
+	return bf.targetPosition.Added(bf.rotation.MulVec3(offset))
+}
+
+// FitBaseModel 素体モデルのボーン・頂点・剛体を、JSONモデルのボーン配置に合わせて変形する
+// JSONにないボーンは、親ボーンの変形に合わせて移動する
+func FitBaseModel(model *pmx.PmxModel, layout *JsonBoneLayout) {
+	targetPositions := make(map[string]*mmath.MVec3, len(layout.Bones))
+	for _, bone := range layout.Bones {
+		if bone.Position != nil {
+			targetPositions[bone.Name] = bone.Position
+		}
+	}
+
+	// 親から順に処理する
+	bones := make([]*pmx.Bone, 0)
+	children := make(map[int][]*pmx.Bone)
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		bones = append(bones, bone)
+		children[bone.ParentIndex] = append(children[bone.ParentIndex], bone)
+		return true
+	})
+	sort.SliceStable(bones, func(i, j int) bool {
+		return len(bones[i].ParentBoneIndexes) < len(bones[j].ParentBoneIndexes)
+	})
+
+	fittings := make(map[int]*boneFitting, len(bones))
+	for _, bone := range bones {
+		parentFitting := fittings[bone.ParentIndex]
+
+		fitting := &boneFitting{
+			basePosition: bone.Position.Copy(),
+			rotation:     mmath.NewMQuaternion(),
+			scale:        1.0,
+		}
+
+		if position, ok := targetPositions[bone.Name()]; ok {
+			fitting.targetPosition = position.Copy()
+		} else if parentFitting != nil {
+			fitting.targetPosition = parentFitting.transform(bone.Position)
+		} else {
+			fitting.targetPosition = bone.Position.Copy()
+		}
+
+		if parentFitting != nil {
+			fitting.rotation = parentFitting.rotation.Copy()
+		}
+
+		// 表示先、もしくはJSONにある子ボーンの方向に合わせる
+		var tailBone *pmx.Bone
+		if tail, err := model.Bones.Get(bone.TailIndex); err == nil && tail != nil {
+			if _, ok := targetPositions[tail.Name()]; ok {
+				tailBone = tail
+			}
+		}
+		if tailBone == nil {
+			for _, child := range children[bone.Index()] {
+				if _, ok := targetPositions[child.Name()]; ok {
+					tailBone = child
+					break
+				}
+			}
+		}
+
+		if tailBone != nil {
+			baseDirection := tailBone.Position.Subed(bone.Position)
+			targetDirection := targetPositions[tailBone.Name()].Subed(fitting.targetPosition)
+			if baseDirection.Length() > 1e-4 && targetDirection.Length() > 1e-4 {
+				fitting.axis = baseDirection.Normalized()
+				fitting.rotation = mmath.NewMQuaternionRotate(fitting.axis, targetDirection.Normalized())
+				fitting.scale = targetDirection.Length() / baseDirection.Length()
+			}
+		}
+
+		fittings[bone.Index()] = fitting
+	}
+
+	// 頂点はウェイトで按分して変形する
+	model.Vertices.ForEach(func(index int, vertex *pmx.Vertex) bool {
+		indexes := vertex.Deform.Indexes()
+		weights := vertex.Deform.Weights()
+
+		position := mmath.NewMVec3()
+		totalWeight := 0.0
+		maxWeight := -1.0
+		var mainFitting *boneFitting
+		for i, boneIndex := range indexes {
+			fitting, ok := fittings[boneIndex]
+			if !ok || i >= len(weights) || weights[i] <= 0 {
+				continue
+			}
+			position = position.Added(fitting.transform(vertex.Position).MuledScalar(weights[i]))
+			totalWeight += weights[i]
+			if weights[i] > maxWeight {
+				maxWeight = weights[i]
+				mainFitting = fitting
+			}
+		}
+
+		if mainFitting == nil || totalWeight <= 0 || math.IsNaN(totalWeight) {
+			return true
+		}
+
+		vertex.Position = position.MuledScalar(1 / totalWeight)
+		if vertex.Normal != nil {
+			vertex.Normal = mainFitting.rotation.MulVec3(vertex.Normal).Normalized()
+		}
+		return true
+	})
+
+	// 剛体は紐付くボーンに合わせて移動する
+	model.RigidBodies.ForEach(func(index int, rigidBody *pmx.RigidBody) bool {
+		if fitting, ok := fittings[rigidBody.BoneIndex]; ok {
+			rigidBody.Position = fitting.transform(rigidBody.Position)
+		}
+		return true
+	})
+
+	for _, bone := range bones {
+		bone.Position = fittings[bone.Index()].targetPosition
+	}
+
+	model.Bones.Setup()
+}
@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain/base_model"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+// loadTestBaseModel 素体モデルを読み込む
+func loadTestBaseModel(t *testing.T) *pmx.PmxModel {
+	t.Helper()
+
+	baseModelPath, err := base_model.ModelPath()
+	if err != nil {
+		t.Fatalf("failed to extract base model: %v", err)
+	}
+
+	data, err := repository.NewPmxRepository(false).Load(baseModelPath)
+	if err != nil {
+		t.Fatalf("failed to load base model: %v", err)
+	}
+
+	return data.(*pmx.PmxModel)
+}
+
+// assertBonePositions モデルのボーン位置が、期待値と一致するか確認する
+func assertBonePositions(t *testing.T, model *pmx.PmxModel, expected map[string]*mmath.MVec3) {
+	t.Helper()
+
+	for boneName, position := range expected {
+		bone, err := model.Bones.GetByName(boneName)
+		if err != nil || bone == nil {
+			t.Errorf("%s: bone not found", boneName)
+			continue
+		}
+		if bone.Position.Distance(position) > 1e-4 {
+			t.Errorf("%s: expected %v, got %v", boneName, position, bone.Position)
+		}
+	}
+}
+
+func TestFitBaseModel(t *testing.T) {
+	model := loadTestBaseModel(t)
+
+	// 横1.1倍・縦1.2倍にしたボーン配置(一部のボーンのみ指定)
+	layout := &JsonBoneLayout{Name: "fitted", Bones: make([]*JsonLayoutBone, 0)}
+	expected := make(map[string]*mmath.MVec3)
+	for _, boneName := range []string{
+		pmx.CENTER.String(), pmx.UPPER.String(), pmx.NECK.String(), pmx.HEAD.String(),
+		pmx.LOWER.String(), pmx.ARM.Left(), pmx.ELBOW.Left(), pmx.WRIST.Left(),
+		pmx.LEG.Right(), pmx.KNEE.Right(), pmx.ANKLE.Right(),
+	} {
+		bone, err := model.Bones.GetByName(boneName)
+		if err != nil || bone == nil {
+			t.Fatalf("%s: bone not found in base model", boneName)
+		}
+		position := &mmath.MVec3{X: bone.Position.X * 1.1, Y: bone.Position.Y * 1.2, Z: bone.Position.Z * 1.1}
+		layout.Bones = append(layout.Bones, &JsonLayoutBone{Name: boneName, Position: position})
+		expected[boneName] = position
+	}
+
+	FitBaseModel(model, layout)
+
+	// 指定したボーンは指定位置に、指定していない子ボーンは親に追従する
+	assertBonePositions(t, model, expected)
+
+	wristBone, _ := model.Bones.GetByName(pmx.WRIST.Left())
+	elbowBone, _ := model.Bones.GetByName(pmx.ELBOW.Left())
+	if wristBone.Position.Distance(elbowBone.Position) < 1e-4 {
+		t.Errorf("wrist collapsed onto elbow: %v", wristBone.Position)
+	}
+}
+
+func TestFitBaseModelMeasurementRoundTrip(t *testing.T) {
+	model := loadTestBaseModel(t)
+
+	layout := &JsonBoneLayout{Name: "measured", Bones: make([]*JsonLayoutBone, 0)}
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		layout.Bones = append(layout.Bones, &JsonLayoutBone{
+			Name:     bone.Name(),
+			Position: &mmath.MVec3{X: bone.Position.X * 0.9, Y: bone.Position.Y * 1.1, Z: bone.Position.Z * 0.9},
+		})
+		return true
+	})
+	FitBaseModel(model, layout)
+
+	// 計測結果のjsonを元モデルとして読み込むと、同じボーン配置になる
+	path := filepath.Join(t.TempDir(), "measurement.json")
+	if err := NewJsonMeasurement(model).Save(path); err != nil {
+		t.Fatalf("failed to save measurement: %v", err)
+	}
+
+	fittedModel, err := loadFittedBaseModel(path, false)
+	if err != nil {
+		t.Fatalf("failed to load measurement: %v", err)
+	}
+
+	expected := make(map[string]*mmath.MVec3)
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		expected[bone.Name()] = bone.Position
+		return true
+	})
+	assertBonePositions(t, fittedModel, expected)
+
+	if fittedModel.Name() != model.Name() {
+		t.Errorf("expected name %s, got %s", model.Name(), fittedModel.Name())
+	}
+
+	// テクスチャを参照できるよう、パスは展開した素体モデルのまま
+	baseModelPath, _ := base_model.ModelPath()
+	if fittedModel.Path() != baseModelPath {
+		t.Errorf("expected path %s, got %s", baseModelPath, fittedModel.Path())
+	}
+}
@@ -0,0 +1,443 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+// default_frame_range_blend 範囲の境界で既存の出力モーションと合成するフレーム数(未指定時)
+const default_frame_range_blend = 5
+
+// SizingFrameRange サイジングするフレーム範囲
+type SizingFrameRange struct {
+	Start int `json:"start"` // 開始フレーム
+	End   int `json:"end"`   // 終了フレーム(このフレームを含む)
+}
+
+// ParseSizingFrameRanges "100-300,500-800" 形式のフレーム範囲を読み取る
+// 単独のフレーム番号は、そのフレームのみの範囲とする
+func ParseSizingFrameRanges(value string) ([]*SizingFrameRange, error) {
+	frameRanges := make([]*SizingFrameRange, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		startText, endText, isRange := strings.Cut(part, "-")
+		if !isRange {
+			endText = startText
+		}
+
+		start, err := strconv.Atoi(strings.TrimSpace(startText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame range: %s", part)
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(endText))
+		if err != nil || end < start || start < 0 {
+			return nil, fmt.Errorf("invalid frame range: %s", part)
+		}
+
+		frameRanges = append(frameRanges, &SizingFrameRange{Start: start, End: end})
+	}
+
+	return frameRanges, nil
+}
+
+// NormalizedFrameRanges 開始順に並べ、重なる範囲(合成区間が重なるものを含む)をまとめたフレーム範囲を返す
+func (ss *SizingSet) NormalizedFrameRanges() []*SizingFrameRange {
+	frameRanges := make([]*SizingFrameRange, 0, len(ss.FrameRanges))
+	for _, frameRange := range ss.FrameRanges {
+		if frameRange == nil || frameRange.End < frameRange.Start || frameRange.End < 0 {
+			continue
+		}
+		frameRanges = append(frameRanges, &SizingFrameRange{Start: max(0, frameRange.Start), End: frameRange.End})
+	}
+
+	sort.Slice(frameRanges, func(i, j int) bool {
+		return frameRanges[i].Start < frameRanges[j].Start
+	})
+
+	blend := ss.frameRangeBlend()
+	merged := make([]*SizingFrameRange, 0, len(frameRanges))
+	for _, frameRange := range frameRanges {
+		if len(merged) > 0 && frameRange.Start-blend <= merged[len(merged)-1].End+blend {
+			merged[len(merged)-1].End = max(merged[len(merged)-1].End, frameRange.End)
+			continue
+		}
+		merged = append(merged, frameRange)
+	}
+
+	return merged
+}
+
+// IsInFrameRanges フレームがサイジングするフレーム範囲内か(範囲指定がない場合は常に true)
+// 範囲外は前回の出力結果のままなので、セットをまたぐ補正や計測も範囲内に限定する
+func (ss *SizingSet) IsInFrameRanges(frame int) bool {
+	frameRanges := ss.NormalizedFrameRanges()
+	if len(frameRanges) == 0 {
+		return true
+	}
+
+	for _, frameRange := range frameRanges {
+		if frame >= frameRange.Start && frame <= frameRange.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FrameRange 範囲毎に切り出したセットの場合、切り出したフレーム範囲を返す
+func (ss *SizingSet) FrameRange() *SizingFrameRange {
+	return ss.frameRange
+}
+
+// frameRangeBlend 範囲の境界で合成するフレーム数
+func (ss *SizingSet) frameRangeBlend() int {
+	if ss.FrameRangeBlend <= 0 {
+		return default_frame_range_blend
+	}
+	return ss.FrameRangeBlend
+}
+
+// frameRangeWindow 合成区間を含めて切り出すフレーム範囲
+func (ss *SizingSet) frameRangeWindow(frameRange *SizingFrameRange) (start, end int) {
+	blend := ss.frameRangeBlend()
+	return max(0, frameRange.Start-blend), frameRange.End + blend
+}
+
+// NewFrameRangeSet フレーム範囲(合成区間含む)のモーションを0フレーム始まりに切り出したセットを生成する
+// 出力モーションは元モーションから作り直す
+func (ss *SizingSet) NewFrameRangeSet(frameRange *SizingFrameRange) (*SizingSet, error) {
+	windowStart, windowEnd := ss.frameRangeWindow(frameRange)
+
+	// モデル・ボーンキャッシュは共有して良いので、浅いコピーで良い
+	rangeSet := *ss
+	rangeSet.FrameRanges = nil
+	rangeSet.frameRange = frameRange
+	rangeSet.frameOffset = windowStart
+	rangeSet.DeltaCache = NewSizingDeltaCache()
+
+	rangeSet.OriginalMotion = sliceMotion(ss.OriginalMotion, ss.OriginalConfigModel, windowStart, windowEnd)
+
+	outputMotion, err := rangeSet.OriginalMotion.Copy()
+	if err != nil {
+		return nil, err
+	}
+	rangeSet.OutputMotion = outputMotion
+
+	return &rangeSet, nil
+}
+
+// MergeFrameRangeSet 範囲毎に切り出したセットの補正結果を、出力モーションに合成する
+// 範囲内は補正結果で置き換え、合成区間は既存の出力モーションから補正結果に徐々に切り替える
+func (ss *SizingSet) MergeFrameRangeSet(rangeSet *SizingSet) {
+	frameRange := rangeSet.frameRange
+	offset := float32(rangeSet.frameOffset)
+	windowStart, windowEnd := ss.frameRangeWindow(frameRange)
+
+	ss.SizingConfigModel.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		boneName := bone.Name()
+		if !rangeSet.OutputMotion.BoneFrames.Contains(boneName) {
+			return true
+		}
+
+		existingFrames := ss.OutputMotion.BoneFrames.Get(boneName)
+		resultFrames := rangeSet.OutputMotion.BoneFrames.Get(boneName)
+
+		// 合成区間の境界をまたぐ既存の補間曲線を求める
+		keyFrames := make([]float32, 0)
+		existingFrames.ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			keyFrames = append(keyFrames, frame)
+			return true
+		})
+		startCurves := splitBoundaryCurves(existingFrames, keyFrames, float32(windowStart), true)
+		endCurves := splitBoundaryCurves(existingFrames, keyFrames, float32(windowEnd), false)
+
+		// 既存のキーフレームを消す前に、合成後のキーフレームを求める
+		mergedFrames := make([]*vmd.BoneFrame, 0)
+		appendFrame := func(frame float32, bf *vmd.BoneFrame, curves *vmd.BoneCurves) {
+			mergedBf := vmd.NewBoneFrame(frame)
+			mergedBf.Position = bf.FilledPosition().Copy()
+			mergedBf.Rotation = bf.FilledRotation().Copy()
+			if curves != nil {
+				mergedBf.Curves = curves
+			}
+			mergedFrames = append(mergedFrames, mergedBf)
+		}
+		appendBlendFrame := func(frame int, t float64, curves *vmd.BoneCurves) {
+			existingBf := existingFrames.Get(float32(frame))
+			resultBf := resultFrames.Get(float32(frame) - offset)
+
+			existingPosition := existingBf.FilledPosition()
+			blendBf := vmd.NewBoneFrame(float32(frame))
+			blendBf.Position = existingPosition.Added(
+				resultBf.FilledPosition().Subed(existingPosition).MuledScalar(t))
+			blendBf.Rotation = existingBf.FilledRotation().Slerp(resultBf.FilledRotation(), t)
+			appendFrame(float32(frame), blendBf, curves)
+		}
+
+		for frame := windowStart; frame < frameRange.Start; frame++ {
+			var curves *vmd.BoneCurves
+			if frame == windowStart {
+				// 合成区間の開始は既存の値なので、直前のキーフレームからは既存の補間曲線の前半で繋ぐ
+				curves = startCurves
+			}
+			appendBlendFrame(frame, float64(frame-windowStart)/float64(frameRange.Start-windowStart), curves)
+		}
+
+		appendFrame(float32(frameRange.Start), resultFrames.Get(float32(frameRange.Start)-offset), nil)
+		resultFrames.ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			if frame+offset > float32(frameRange.Start) && frame+offset < float32(frameRange.End) {
+				appendFrame(frame+offset, bf, bf.Curves)
+			}
+			return true
+		})
+		endBf := resultFrames.Get(float32(frameRange.End) - offset)
+		appendFrame(float32(frameRange.End), endBf, endBf.Curves)
+
+		for frame := frameRange.End + 1; frame <= windowEnd; frame++ {
+			appendBlendFrame(frame, float64(windowEnd-frame)/float64(windowEnd-frameRange.End), nil)
+		}
+
+		// 合成区間を含む範囲の既存キーフレームを置き換える
+		deleteFrames := make([]float32, 0)
+		for _, frame := range keyFrames {
+			if frame >= float32(windowStart) && frame <= float32(windowEnd) {
+				deleteFrames = append(deleteFrames, frame)
+			}
+		}
+
+		// 合成区間の直後のキーフレームは、合成区間の終了からは既存の補間曲線の後半で繋ぐ
+		if endCurves != nil {
+			for _, frame := range keyFrames {
+				if frame > float32(windowEnd) {
+					appendFrame(frame, existingFrames.Get(frame), endCurves)
+					deleteFrames = append(deleteFrames, frame)
+					break
+				}
+			}
+		}
+
+		for _, frame := range deleteFrames {
+			existingFrames.Delete(frame)
+		}
+
+		for _, bf := range mergedFrames {
+			ss.OutputMotion.InsertBoneFrame(boneName, bf)
+		}
+
+		return true
+	})
+}
+
+// MergeFrameRangeCompleted 範囲毎に切り出したセットの補正済みフラグを、セットに反映する
+// 全ての範囲で補正済みになった補正のみ、補正済みとする
+func (ss *SizingSet) MergeFrameRangeCompleted(rangeSets []*SizingSet) {
+	if len(rangeSets) == 0 {
+		return
+	}
+
+	for _, completed := range []func(sizingSet *SizingSet) *bool{
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingLeg },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingLower },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingUpper },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingShoulder },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingArmStance },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingFingerStance },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingArmTwist },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingWrist },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingFootLock },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingFloor },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingGaze },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingArmCollision },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingSelfContact },
+		func(sizingSet *SizingSet) *bool { return &sizingSet.CompletedSizingReduction },
+	} {
+		isCompleted := true
+		for _, rangeSet := range rangeSets {
+			isCompleted = isCompleted && *completed(rangeSet)
+		}
+		*completed(ss) = isCompleted
+	}
+
+	// 肩の比重はモデルから決まるので、どの範囲でも同じ
+	ss.CompletedShoulderWeight = rangeSets[len(rangeSets)-1].CompletedShoulderWeight
+}
+
+// splitBoundaryCurves 境界のフレームで既存の補間曲線を分割する
+// isBefore が true の場合は、直前のキーフレームから境界までの前半を、
+// false の場合は、境界から直後のキーフレームまでの後半を返す
+// 境界にキーフレームがある場合や、前後どちらかのキーフレームがない場合は nil を返す
+func splitBoundaryCurves(
+	boneFrames *vmd.BoneNameFrames, keyFrames []float32, boundary float32, isBefore bool,
+) *vmd.BoneCurves {
+	prevFrame, nextFrame := float32(-1), float32(-1)
+	for _, frame := range keyFrames {
+		if frame == boundary {
+			return nil
+		}
+		if frame < boundary {
+			prevFrame = frame
+		} else if nextFrame < 0 {
+			nextFrame = frame
+		}
+	}
+	if prevFrame < 0 || nextFrame < 0 {
+		return nil
+	}
+
+	curves := boneFrames.Get(nextFrame).Curves
+	if curves == nil {
+		return nil
+	}
+
+	return splitBoneCurves(curves, float64(boundary-prevFrame)/float64(nextFrame-prevFrame), isBefore)
+}
+
+// splitBoneCurves 補間曲線を経過割合 x の位置で分割し、isBefore が true の場合は前半を、false の場合は後半を返す
+func splitBoneCurves(curves *vmd.BoneCurves, x float64, isBefore bool) *vmd.BoneCurves {
+	splitCurves := vmd.NewBoneCurves()
+	for _, v := range []struct {
+		curve      *mmath.Curve
+		splitCurve **mmath.Curve
+	}{
+		{curves.Rotate, &splitCurves.Rotate},
+		{curves.TranslateX, &splitCurves.TranslateX},
+		{curves.TranslateY, &splitCurves.TranslateY},
+		{curves.TranslateZ, &splitCurves.TranslateZ},
+	} {
+		if v.curve == nil {
+			continue
+		}
+		before, after := splitCurve(v.curve, x)
+		if isBefore {
+			*v.splitCurve = before
+		} else {
+			*v.splitCurve = after
+		}
+	}
+
+	return splitCurves
+}
+
+// LoadBaseOutputMotion 範囲指定で再サイジングする時の合成先として、出力済みモーションを読み込む
+// ボーン名マッピングがある場合は、標準ボーン名に置き換えてから出力モーションとする
+func (ss *SizingSet) LoadBaseOutputMotion(path string) error {
+	data, err := repository.NewVmdRepository(false).Load(path)
+	if err != nil {
+		return err
+	}
+
+	outputMotion := data.(*vmd.VmdMotion)
+	renameBoneFrames(outputMotion, ss.SizingBoneMapping)
+	ss.OutputMotion = outputMotion
+
+	return nil
+}
+
+// sliceMotion モーションの指定範囲を0フレーム始まりに切り出す
+// 範囲の両端には、補間後のキーフレームを登録する
+func sliceMotion(motion *vmd.VmdMotion, model *pmx.PmxModel, start, end int) *vmd.VmdMotion {
+	slicedMotion := vmd.NewVmdMotion(motion.Path())
+	offset := float32(start)
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		boneName := bone.Name()
+		if !motion.BoneFrames.Contains(boneName) {
+			return true
+		}
+
+		boneFrames := motion.BoneFrames.Get(boneName)
+
+		// 範囲の境界をまたぐ補間曲線は、境界で分割して元の動きを保つ
+		keyFrames := make([]float32, 0)
+		boneFrames.ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			keyFrames = append(keyFrames, frame)
+			return true
+		})
+		startCurves := splitBoundaryCurves(boneFrames, keyFrames, float32(start), false)
+		endCurves := splitBoundaryCurves(boneFrames, keyFrames, float32(end), true)
+		if startCurves != nil && endCurves != nil {
+			if nextIndex := sort.Search(len(keyFrames), func(i int) bool {
+				return keyFrames[i] > float32(start)
+			}); keyFrames[nextIndex] > float32(end) {
+				// 範囲内にキーフレームがない場合、範囲の終了には開始から終了までの曲線を使う
+				endCurves = splitBoneCurves(startCurves,
+					float64(end-start)/float64(keyFrames[nextIndex]-float32(start)), true)
+			}
+		}
+
+		{
+			bf := boneFrames.Get(float32(start))
+			slicedBf := vmd.NewBoneFrame(0)
+			slicedBf.Position = bf.FilledPosition().Copy()
+			slicedBf.Rotation = bf.FilledRotation().Copy()
+			slicedMotion.InsertBoneFrame(boneName, slicedBf)
+		}
+		{
+			bf := boneFrames.Get(float32(end))
+			slicedBf := vmd.NewBoneFrame(float32(end) - offset)
+			slicedBf.Position = bf.FilledPosition().Copy()
+			slicedBf.Rotation = bf.FilledRotation().Copy()
+			if endCurves != nil {
+				slicedBf.Curves = endCurves
+			}
+			slicedMotion.InsertBoneFrame(boneName, slicedBf)
+		}
+
+		isFirst := true
+		boneFrames.ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			if frame > float32(start) && frame <= float32(end) {
+				slicedBf := vmd.NewBoneFrame(frame - offset)
+				slicedBf.Position = bf.FilledPosition().Copy()
+				slicedBf.Rotation = bf.FilledRotation().Copy()
+				slicedBf.Curves = bf.Curves
+				if isFirst && startCurves != nil {
+					// 範囲の開始から最初のキーフレームまでは、分割した後半の曲線を使う
+					slicedBf.Curves = startCurves
+				}
+				isFirst = false
+				slicedMotion.InsertBoneFrame(boneName, slicedBf)
+			}
+			return true
+		})
+
+		return true
+	})
+
+	model.Morphs.ForEach(func(index int, morph *pmx.Morph) bool {
+		morphName := morph.Name()
+		if !motion.MorphFrames.Contains(morphName) {
+			return true
+		}
+
+		morphFrames := motion.MorphFrames.Get(morphName)
+		for _, frame := range []float32{float32(start), float32(end)} {
+			slicedMf := vmd.NewMorphFrame(frame - offset)
+			slicedMf.Ratio = morphFrames.Get(frame).Ratio
+			slicedMotion.InsertMorphFrame(morphName, slicedMf)
+		}
+
+		morphFrames.ForEach(func(frame float32, mf *vmd.MorphFrame) bool {
+			if frame > float32(start) && frame <= float32(end) {
+				slicedMf := vmd.NewMorphFrame(frame - offset)
+				slicedMf.Ratio = mf.Ratio
+				slicedMotion.InsertMorphFrame(morphName, slicedMf)
+			}
+			return true
+		})
+
+		return true
+	})
+
+	return slicedMotion
+}
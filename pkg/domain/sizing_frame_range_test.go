@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"math"
+	"testing"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+)
+
+func TestSizingSetIsInFrameRanges(t *testing.T) {
+	ss := NewSizingSet(0)
+	if !ss.IsInFrameRanges(1000) {
+		t.Errorf("expected all frames without frame ranges")
+	}
+
+	ss.FrameRanges = []*SizingFrameRange{{Start: 100, End: 200}}
+	for frame, expected := range map[int]bool{99: false, 100: true, 200: true, 201: false} {
+		if ss.IsInFrameRanges(frame) != expected {
+			t.Errorf("frame %d: expected %v", frame, expected)
+		}
+	}
+}
+
+func TestSizingSetMergeFrameRangeCompleted(t *testing.T) {
+	ss := NewSizingSet(0)
+
+	completedSet := NewSizingSet(0)
+	completedSet.CompletedSizingLeg = true
+	completedSet.CompletedSizingUpper = true
+
+	partialSet := NewSizingSet(0)
+	partialSet.CompletedSizingLeg = true
+
+	ss.MergeFrameRangeCompleted([]*SizingSet{completedSet, partialSet})
+
+	if !ss.CompletedSizingLeg {
+		t.Errorf("expected leg completed in all ranges")
+	}
+	if ss.CompletedSizingUpper {
+		t.Errorf("expected upper not completed when a range is not completed")
+	}
+}
+
+func TestSliceMotionKeepsBoundaryCurves(t *testing.T) {
+	model := loadTestBaseModel(t)
+
+	motion := vmd.NewVmdMotion("")
+	for _, v := range []struct {
+		frame float32
+		y     float64
+	}{{0, 0}, {100, 10}, {150, 0}} {
+		bf := vmd.NewBoneFrame(v.frame)
+		bf.Position = &mmath.MVec3{X: 0, Y: v.y, Z: 0}
+		bf.Rotation = mmath.NewMQuaternion()
+		bf.Curves = vmd.NewBoneCurves()
+		bf.Curves.TranslateY = NewCurve(0.8, 0.0, 0.9, 0.3)
+		motion.InsertBoneFrame(pmx.CENTER.String(), bf)
+	}
+
+	// 範囲の開始・終了がキーフレームの間にあっても、切り出す前と同じ動きになる(制御点の丸め分は許容する)
+	for _, frameRange := range [][2]int{{30, 120}, {30, 60}} {
+		start, end := frameRange[0], frameRange[1]
+		slicedMotion := sliceMotion(motion, model, start, end)
+		for frame := start; frame <= end; frame += 5 {
+			expected := motion.BoneFrames.Get(pmx.CENTER.String()).Get(float32(frame)).FilledPosition().Y
+			actual := slicedMotion.BoneFrames.Get(pmx.CENTER.String()).Get(float32(frame - start)).FilledPosition().Y
+			if math.Abs(expected-actual) > 0.2 {
+				t.Errorf("range %d-%d frame %d: expected %.4f, got %.4f", start, end, frame, expected, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+)
+
+// JsonMeasurement 元モデルとして使える、ボーン配置と手足の長さの計測結果
+// LoadJsonBoneLayout で読み込めるよう、JsonBoneLayout と同じ項目名で出力する
+type JsonMeasurement struct {
+	Name  string                 `json:"Name"`  // モデル名
+	Bones []*JsonMeasurementBone `json:"Bones"` // ボーンリスト
+	Limbs []*JsonLimbLength      `json:"Limbs"` // 手足の長さ
+}
+
+// JsonMeasurementBone 計測結果のボーン1本分
+type JsonMeasurementBone struct {
+	Index       int          `json:"index"`        // ボーンINDEX
+	Name        string       `json:"name"`         // ボーン名
+	EnglishName string       `json:"english_name"` // ボーン英名
+	Position    *mmath.MVec3 `json:"position"`     // ボーン位置
+	ParentIndex int          `json:"parent_index"` // 親ボーンINDEX
+	TailIndex   int          `json:"tail_index"`   // 表示先ボーンINDEX
+}
+
+// JsonLimbLength 手足の長さ1区間分
+type JsonLimbLength struct {
+	Name   string  `json:"name"`   // 区間名
+	From   string  `json:"from"`   // 始点ボーン名
+	To     string  `json:"to"`     // 終点ボーン名
+	Length float64 `json:"length"` // 始点から終点までの距離
+}
+
+// measurement_limbs 計測する区間(区間名, 始点ボーン名, 終点ボーン名)
+var measurement_limbs = [][]string{
+	{"下半身", pmx.LOWER.String(), pmx.LEG_CENTER.String()},
+	{"上半身", pmx.UPPER.String(), pmx.NECK_ROOT.String()},
+	{"首", pmx.NECK.String(), pmx.HEAD.String()},
+	{"左肩", pmx.SHOULDER.Left(), pmx.ARM.Left()},
+	{"左上腕", pmx.ARM.Left(), pmx.ELBOW.Left()},
+	{"左前腕", pmx.ELBOW.Left(), pmx.WRIST.Left()},
+	{"左腕", pmx.ARM.Left(), pmx.WRIST.Left()},
+	{"左太もも", pmx.LEG.Left(), pmx.KNEE.Left()},
+	{"左すね", pmx.KNEE.Left(), pmx.ANKLE.Left()},
+	{"左足", pmx.LEG.Left(), pmx.ANKLE.Left()},
+	{"右肩", pmx.SHOULDER.Right(), pmx.ARM.Right()},
+	{"右上腕", pmx.ARM.Right(), pmx.ELBOW.Right()},
+	{"右前腕", pmx.ELBOW.Right(), pmx.WRIST.Right()},
+	{"右腕", pmx.ARM.Right(), pmx.WRIST.Right()},
+	{"右太もも", pmx.LEG.Right(), pmx.KNEE.Right()},
+	{"右すね", pmx.KNEE.Right(), pmx.ANKLE.Right()},
+	{"右足", pmx.LEG.Right(), pmx.ANKLE.Right()},
+}
+
+// NewJsonMeasurement モデルのボーン配置と手足の長さを計測する
+// 両端のボーンが揃っていない区間は出力しない
+func NewJsonMeasurement(model *pmx.PmxModel) *JsonMeasurement {
+	measurement := &JsonMeasurement{
+		Name:  model.Name(),
+		Bones: make([]*JsonMeasurementBone, 0),
+		Limbs: make([]*JsonLimbLength, 0, len(measurement_limbs)),
+	}
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		measurement.Bones = append(measurement.Bones, &JsonMeasurementBone{
+			Index:       bone.Index(),
+			Name:        bone.Name(),
+			EnglishName: bone.EnglishName(),
+			Position:    bone.Position.Copy(),
+			ParentIndex: bone.ParentIndex,
+			TailIndex:   bone.TailIndex,
+		})
+		return true
+	})
+
+	for _, limb := range measurement_limbs {
+		fromBone, err := model.Bones.GetByName(limb[1])
+		if err != nil || fromBone == nil {
+			continue
+		}
+		toBone, err := model.Bones.GetByName(limb[2])
+		if err != nil || toBone == nil {
+			continue
+		}
+
+		measurement.Limbs = append(measurement.Limbs, &JsonLimbLength{
+			Name:   limb[0],
+			From:   limb[1],
+			To:     limb[2],
+			Length: toBone.Position.Subed(fromBone.Position).Length(),
+		})
+	}
+
+	return measurement
+}
+
+// Save 計測結果をjsonで出力する
+func (measurement *JsonMeasurement) Save(path string) error {
+	output, err := json.MarshalIndent(measurement, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+// SaveOriginalMeasurement 元モデル(ボーン追加後)の計測結果をjsonで出力する
+// 出力したjsonは、元モデルとしてそのまま読み込める
+func (ss *SizingSet) SaveOriginalMeasurement(path string) error {
+	if ss.OriginalConfigModel == nil {
+		return fmt.Errorf("original model is not loaded")
+	}
+
+	return NewJsonMeasurement(ss.OriginalConfigModel).Save(path)
+}
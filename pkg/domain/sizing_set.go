@@ -2,6 +2,8 @@ package domain
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/miu200521358/mlib_go/pkg/config/merr"
@@ -14,15 +16,32 @@ import (
 	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
 )
 
+// SizingScaleMode 移動補正スケールの決め方
+type SizingScaleMode string
+
+const (
+	SizingScaleModeAuto  SizingScaleMode = "auto"  // 足の長さ比率から自動計算(未指定時)
+	SizingScaleModeFixed SizingScaleMode = "fixed" // 全軸共通の固定値
+	SizingScaleModeAxis  SizingScaleMode = "axis"  // 軸毎の固定値
+)
+
+// SizingScalePolicy 複数人居る時の移動補正スケール(XZ)の揃え方
+type SizingScalePolicy string
+
+const (
+	SizingScalePolicyMean        SizingScalePolicy = "mean"        // 複数人のXZ平均を共通で使う(未指定時)
+	SizingScalePolicyIndependent SizingScalePolicy = "independent" // セット毎のスケールをそのまま使う
+	SizingScalePolicyAnchor      SizingScalePolicy = "anchor"      // 指定したセットのXZスケールに合わせる
+)
+
 type SizingSet struct {
-	Index       int  // インデックス
-	IsTerminate bool // 処理停止フラグ
+	Index int // インデックス
 
-	OriginalMotionPath string `json:"original_motion_path"` // 元モーションパス
-	OriginalModelPath  string `json:"original_model_path"`  // 元モデルパス
-	SizingModelPath    string `json:"sizing_model_path"`    // サイジング先モデルパス
-	OutputMotionPath   string `json:"-"`                    // 出力モーションパス
-	OutputModelPath    string `json:"-"`                    // 出力モデルパス
+	OriginalMotionPath string `json:"original_motion_path"`         // 元モーションパス
+	OriginalModelPath  string `json:"original_model_path"`          // 元モデルパス
+	SizingModelPath    string `json:"sizing_model_path"`            // サイジング先モデルパス
+	OutputMotionPath   string `json:"output_motion_path,omitempty"` // 出力モーションパス
+	OutputModelPath    string `json:"output_model_path,omitempty"`  // 出力モデルパス
 
 	OriginalMotionName string `json:"-"` // 元モーション名
 	OriginalModelName  string `json:"-"` // 元モーション名
@@ -36,23 +55,49 @@ type SizingSet struct {
 	OutputMotion        *vmd.VmdMotion `json:"-"` // 出力結果モーション
 
 	IsSizingLeg          bool `json:"is_sizing_leg"`           // 足補正
+	IsSizingLower        bool `json:"is_sizing_lower"`         // 下半身補正
 	IsSizingUpper        bool `json:"is_sizing_upper"`         // 上半身補正
 	IsSizingShoulder     bool `json:"is_sizing_shoulder"`      // 肩補正
 	IsSizingArmStance    bool `json:"is_sizing_arm_stance"`    // 腕補正
 	IsSizingFingerStance bool `json:"is_sizing_finger_stance"` // 指補正
 	IsSizingArmTwist     bool `json:"is_sizing_arm_twist"`     // 腕捩補正
 	IsSizingWrist        bool `json:"is_sizing_wrist"`         // 手首補正
+	IsSizingFootLock     bool `json:"is_sizing_foot_lock"`     // 足接地固定
+	IsSizingFloor        bool `json:"is_sizing_floor"`         // 床補正
+	IsSizingGaze         bool `json:"is_sizing_gaze"`          // 視線補正
+	IsSizingArmCollision bool `json:"is_sizing_arm_collision"` // 腕貫通回避
+	IsSizingSelfContact  bool `json:"is_sizing_self_contact"`  // 自己接触維持
+	IsSizingHandContact  bool `json:"is_sizing_hand_contact"`  // 手接触維持
 	IsSizingReduction    bool `json:"is_sizing_reduction"`     // 不要キー削除補正
 
 	CompletedSizingLeg          bool `json:"-"` // 足補正完了フラグ
+	CompletedSizingLower        bool `json:"-"` // 下半身補正完了フラグ
 	CompletedSizingUpper        bool `json:"-"` // 上半身補正完了フラグ
 	CompletedSizingShoulder     bool `json:"-"` // 肩補正完了フラグ
 	CompletedSizingArmStance    bool `json:"-"` // 腕補正完了フラグ
 	CompletedSizingFingerStance bool `json:"-"` // 指補正完了フラグ
 	CompletedSizingArmTwist     bool `json:"-"` // 腕捩補正完了フラグ
 	CompletedSizingWrist        bool `json:"-"` // 手首補正完了フラグ
+	CompletedSizingFootLock     bool `json:"-"` // 足接地固定完了フラグ
+	CompletedSizingFloor        bool `json:"-"` // 床補正完了フラグ
+	CompletedSizingGaze         bool `json:"-"` // 視線補正完了フラグ
+	CompletedSizingArmCollision bool `json:"-"` // 腕貫通回避完了フラグ
+	CompletedSizingSelfContact  bool `json:"-"` // 自己接触維持完了フラグ
+	CompletedSizingHandContact  bool `json:"-"` // 手接触維持完了フラグ
 	CompletedSizingReduction    bool `json:"-"` // 不要キー削除補正完了フラグ
 
+	ScaleMode        SizingScaleMode   `json:"scale_mode,omitempty"`         // 移動補正スケールの決め方
+	ScaleValue       float64           `json:"scale_value,omitempty"`        // 固定値の移動補正スケール
+	ScaleAxis        *mmath.MVec3      `json:"scale_axis,omitempty"`         // 軸毎の移動補正スケール(0以下の軸は自動計算)
+	ScalePolicy      SizingScalePolicy `json:"scale_policy,omitempty"`       // 複数人居る時のXZスケールの揃え方
+	ScaleAnchorIndex int               `json:"scale_anchor_index,omitempty"` // XZスケールを合わせるセットINDEX
+
+	GazeTarget *mmath.MVec3 `json:"gaze_target,omitempty"` // 視線補正の注視点(未指定時は頭の向きだけ合わせる)
+
+	// 範囲指定はCLIの実行時のみの指定なので、セット設定ファイルには保存しない
+	FrameRanges     []*SizingFrameRange `json:"-"` // サイジングするフレーム範囲(未指定時は全フレーム)
+	FrameRangeBlend int                 `json:"-"` // 範囲の境界で既存の出力モーションと合成するフレーム数
+
 	ShoulderWeight          int   `json:"shoulder_weight"` // 肩の比重
 	CompletedShoulderWeight int   `json:"-"`               // 補正完了時の肩の比重
 	DefaultShoulderWeights  []int `json:"-"`               // デフォルトの肩の比重(左右別)
@@ -62,12 +107,30 @@ type SizingSet struct {
 	originalBoneCache      map[string]*pmx.Bone // 元モデルのボーンキャッシュ
 	sizingBoneCache        map[string]*pmx.Bone // サイジング先モデルのボーンキャッシュ
 	sizingVanillaBoneCache map[string]*pmx.Bone // サイジング先モデル(バニラ)のボーンキャッシュ
+
+	OriginalBoneMapping map[string]string `json:"-"` // 元モデルのボーン名 -> 標準ボーン名
+	SizingBoneMapping   map[string]string `json:"-"` // サイジング先モデルのボーン名 -> 標準ボーン名
+
+	DeltaCache *SizingDeltaCache `json:"-"` // デフォーム結果キャッシュ
+
+	frameRange  *SizingFrameRange // 範囲毎に切り出したセットの場合、切り出したフレーム範囲
+	frameOffset int               // 範囲毎に切り出したセットの場合、0フレーム目に相当する元のフレーム
 }
 
 func NewSizingSet(index int) *SizingSet {
 	return &SizingSet{
-		Index: index,
+		Index:      index,
+		DeltaCache: NewSizingDeltaCache(),
+	}
+}
+
+// ClearDeltaCache デフォーム結果キャッシュを破棄する
+func (ss *SizingSet) ClearDeltaCache() {
+	if ss.DeltaCache == nil {
+		ss.DeltaCache = NewSizingDeltaCache()
+		return
 	}
+	ss.DeltaCache.Clear()
 }
 
 func (ss *SizingSet) CreateOutputModelPath() string {
@@ -95,12 +158,27 @@ func (ss *SizingSet) CreateOutputMotionPath() string {
 	if ss.IsSizingLeg {
 		suffix += "L"
 	}
+	if ss.IsSizingLower {
+		suffix += "D"
+	}
+	if ss.IsSizingFootLock {
+		suffix += "K"
+	}
+	if ss.IsSizingFloor {
+		suffix += "G"
+	}
 	if ss.IsSizingUpper {
 		suffix += "U"
 	}
+	if ss.IsSizingGaze {
+		suffix += "E"
+	}
 	if ss.IsSizingShoulder {
 		suffix += "S"
 	}
+	if ss.IsSizingArmCollision {
+		suffix += "B"
+	}
 	if ss.IsSizingFingerStance {
 		suffix += "F"
 	}
@@ -110,6 +188,12 @@ func (ss *SizingSet) CreateOutputMotionPath() string {
 	if ss.IsSizingWrist {
 		suffix += "P"
 	}
+	if ss.IsSizingSelfContact {
+		suffix += "C"
+	}
+	if ss.IsSizingHandContact {
+		suffix += "H"
+	}
 	if ss.IsSizingReduction {
 		suffix += "R"
 	}
@@ -127,15 +211,27 @@ func (ss *SizingSet) GetProcessCount() (processCount int) {
 		return 0
 	}
 
-	maxFrame := int(ss.OutputMotion.MaxFrame())
+	// 範囲指定がある場合は、範囲毎に切り出して実行する
+	if frameRanges := ss.NormalizedFrameRanges(); len(frameRanges) > 0 {
+		for _, frameRange := range frameRanges {
+			windowStart, windowEnd := ss.frameRangeWindow(frameRange)
+			processCount += ss.processCount(windowEnd - windowStart)
+		}
+		return processCount
+	}
+
+	return ss.processCount(int(ss.OutputMotion.MaxFrame()))
+}
 
+// processCount 未補正の補正対象の処理ステップ数を求める
+func (ss *SizingSet) processCount(maxFrame int) (processCount int) {
 	if ss.IsSizingLeg && !ss.CompletedSizingLeg {
 		// 8: computeVmdDeltas
 		// 1: FK焼き込み
-		// 4*2: calculate系 / update系
+		// 3*2: calculate系 / update系
 		// 3*11: updateOutputMotion (interval / full)
 		// 1: updateLegIkOffset
-		processCount += maxFrame * (8 + 1 + 4*2 + 3*11 + 1)
+		processCount += maxFrame * (8 + 1 + 3*2 + 3*11 + 1)
 	}
 
 	if ss.IsSizingUpper && !ss.CompletedSizingUpper {
@@ -159,17 +255,79 @@ func (ss *SizingSet) GetProcessCount() (processCount int) {
 	}
 
 	if ss.IsSizingWrist && !ss.CompletedSizingWrist {
-		processCount += 0
+		// 3: computeVmdDeltas (元 / 先 / 結果)
+		// 2: calculate系 / update系
+		processCount += 2 + maxFrame*3
 	}
 
 	if ss.IsSizingArmTwist && !ss.CompletedSizingArmTwist {
-		processCount += 0
+		// 2: computeVmdDeltas (分散前 / 分散後)
+		processCount += maxFrame * 2 * 2
+	}
+
+	if ss.IsSizingFootLock && !ss.CompletedSizingFootLock {
+		// 2: computeVmdDeltas (元 / 先)
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+	}
+
+	if ss.IsSizingFloor && !ss.CompletedSizingFloor {
+		// 2: computeVmdDeltas (元 / 先)
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+	}
+
+	if ss.IsSizingHandContact && !ss.CompletedSizingHandContact {
+		// 2: computeVmdDeltas (元 / 先)
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+
+		if ss.IsSizingReduction {
+			// 手接触維持の後に間引き直す分
+			processCount += 1 + maxFrame*2
+		}
+	}
+
+	if ss.IsSizingSelfContact && !ss.CompletedSizingSelfContact {
+		// 2: computeVmdDeltas (元 / 先)
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+	}
+
+	if ss.IsSizingArmCollision && !ss.CompletedSizingArmCollision {
+		// 1: computeVmdDeltas (先)
+		// 1: 貫通判定
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+	}
+
+	if ss.IsSizingLower && !ss.CompletedSizingLower {
+		// 4: computeVmdDeltas
+		// 1*2: calculate系 / update系
+		processCount += maxFrame * (4 + 1*2)
+	}
+
+	if ss.IsSizingGaze && !ss.CompletedSizingGaze {
+		// 2: computeVmdDeltas (元・先)
+		// 1: 出力モーションへの反映
+		processCount += 1 + maxFrame*2
+	}
+
+	if ss.IsSizingReduction && !ss.CompletedSizingReduction {
+		// 2: computeVmdDeltas (間引き前 / 間引き後)
+		// 1: 間引き
+		processCount += 1 + maxFrame*2
 	}
 
 	return processCount
 }
 
 func (ss *SizingSet) setMotion(originalMotion, outputMotion *vmd.VmdMotion) {
+	// 同じモーションを読み直した場合は、キャッシュを使い回す
+	if originalMotion == nil || ss.OriginalMotion == nil || originalMotion.Hash() != ss.OriginalMotion.Hash() {
+		ss.ClearDeltaCache()
+	}
+
 	if originalMotion == nil || outputMotion == nil {
 		ss.OriginalMotionPath = ""
 		ss.OriginalMotionName = ""
@@ -191,6 +349,8 @@ func (ss *SizingSet) setMotion(originalMotion, outputMotion *vmd.VmdMotion) {
 }
 
 func (ss *SizingSet) setOriginalModel(originalModel, originalConfigModel *pmx.PmxModel) {
+	ss.ClearDeltaCache()
+
 	if originalModel == nil {
 		ss.OriginalModelPath = ""
 		ss.OriginalModelName = ""
@@ -206,6 +366,8 @@ func (ss *SizingSet) setOriginalModel(originalModel, originalConfigModel *pmx.Pm
 }
 
 func (ss *SizingSet) setSizingModel(sizingModel, sizingConfigModel *pmx.PmxModel) {
+	ss.ClearDeltaCache()
+
 	if sizingModel == nil || sizingConfigModel == nil {
 		ss.SizingModelPath = ""
 		ss.OutputModelName = ""
@@ -220,27 +382,65 @@ func (ss *SizingSet) setSizingModel(sizingModel, sizingConfigModel *pmx.PmxModel
 	ss.SizingConfigModel = sizingConfigModel
 }
 
+// setOriginalBoneMapping 元モデルのボーン名マッピングを設定する
+// 既にモーションを読み込んでいる場合は、モーションも標準ボーン名に付け替える
+func (ss *SizingSet) setOriginalBoneMapping(boneMapping map[string]string) {
+	ss.OriginalBoneMapping = boneMapping
+	if len(boneMapping) == 0 {
+		return
+	}
+
+	mlog.I(mi18n.T("ボーン名マッピング適用", map[string]any{
+		"No": ss.Index + 1, "ModelName": ss.OriginalModelName, "Count": len(boneMapping)}))
+
+	renameBoneFrames(ss.OriginalMotion, boneMapping)
+	renameBoneFrames(ss.OutputMotion, boneMapping)
+}
+
+// RestoreSizingBoneNames 出力用に、標準ボーン名に置き換えたボーンをサイジング先モデルのボーン名に戻したモーションを返す
+// ボーン名を置き換えていない場合は、そのままのモーションを返す
+func (ss *SizingSet) RestoreSizingBoneNames(motion *vmd.VmdMotion) (*vmd.VmdMotion, error) {
+	if motion == nil || len(ss.SizingBoneMapping) == 0 {
+		return motion, nil
+	}
+
+	restoredMotion, err := motion.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	restores := make(map[string]string, len(ss.SizingBoneMapping))
+	for boneName, standardName := range ss.SizingBoneMapping {
+		restores[standardName] = boneName
+	}
+	renameBoneFrames(restoredMotion, restores)
+
+	return restoredMotion, nil
+}
+
 // LoadOriginalModel サイジング元モデルを読み込む
-// TODO json の場合はフィッティングあり
+// json の場合は、素体モデルを json のボーン配置にフィッティングしたモデルを元モデルとする
 func (ss *SizingSet) LoadOriginalModel(path string) error {
 	ss.originalBoneCache = make(map[string]*pmx.Bone)
 
 	if path == "" {
 		ss.setOriginalModel(nil, nil)
+		ss.setOriginalBoneMapping(nil)
 		return nil
 	}
 
 	var wg sync.WaitGroup
 	var originalModel, originalConfigModel *pmx.PmxModel
+	var boneMapping map[string]string
 
 	wg.Add(1)
 	errChan := make(chan error, 2)
 	go func() {
 		defer wg.Done()
 
-		pmxRep := repository.NewPmxRepository(true)
-		if data, err := pmxRep.Load(path); err == nil {
-			originalModel = data.(*pmx.PmxModel)
+		if model, err := loadOriginalModelFile(path, true); err == nil {
+			originalModel = model
+			mapModelBoneNames(originalModel, path)
 
 			if err := originalModel.Bones.InsertShortageOverrideBones(); err != nil {
 				mlog.ET(mi18n.T("システム用ボーン追加失敗"), err, "")
@@ -257,8 +457,10 @@ func (ss *SizingSet) LoadOriginalModel(path string) error {
 		defer wg.Done()
 
 		pmxRep := repository.NewPmxRepository(false)
-		if data, err := pmxRep.Load(path); err == nil {
-			originalConfigModel = data.(*pmx.PmxModel)
+		if model, err := loadOriginalModelFile(path, false); err == nil {
+			originalConfigModel = model
+			boneMapping = mapModelBoneNames(originalConfigModel, path)
+
 			if err := pmxRep.CreateSticky(
 				originalConfigModel,
 				ss.insertShortageConfigBones,
@@ -285,12 +487,17 @@ func (ss *SizingSet) LoadOriginalModel(path string) error {
 	for err := range errChan {
 		if err != nil {
 			ss.setOriginalModel(nil, nil)
+			ss.setOriginalBoneMapping(nil)
 			return err
 		}
 	}
 
 	// 元モデル設定
 	ss.setOriginalModel(originalModel, originalConfigModel)
+	ss.setOriginalBoneMapping(boneMapping)
+	// json の場合、モデル自体は展開した素体モデルのパスのまま(テクスチャの参照先)にして、
+	// 元モデルパスには指定された json のパスを記録する
+	ss.OriginalModelPath = path
 
 	// 肩の比重を計算する
 	ss.ShoulderWeight = ss.calculateShoulderWeight()
@@ -302,6 +509,20 @@ func (ss *SizingSet) LoadOriginalModel(path string) error {
 	return nil
 }
 
+// loadOriginalModelFile 元モデルのファイルを読み込む
+func loadOriginalModelFile(path string, isLog bool) (*pmx.PmxModel, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return loadFittedBaseModel(path, isLog)
+	}
+
+	data, err := repository.NewPmxRepository(isLog).Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.(*pmx.PmxModel), nil
+}
+
 // LoadSizingModel サイジング先モデルを読み込む
 func (ss *SizingSet) LoadSizingModel(path string) error {
 	ss.sizingBoneCache = make(map[string]*pmx.Bone)
@@ -309,11 +530,13 @@ func (ss *SizingSet) LoadSizingModel(path string) error {
 
 	if path == "" {
 		ss.setSizingModel(nil, nil)
+		ss.SizingBoneMapping = nil
 		return nil
 	}
 
 	var wg sync.WaitGroup
 	var sizingModel, sizingConfigModel *pmx.PmxModel
+	var boneMapping map[string]string
 
 	errChan := make(chan error, 2)
 
@@ -324,6 +547,8 @@ func (ss *SizingSet) LoadSizingModel(path string) error {
 		pmxRep := repository.NewPmxRepository(true)
 		if data, err := pmxRep.Load(path); err == nil {
 			sizingModel = data.(*pmx.PmxModel)
+			mapModelBoneNames(sizingModel, path)
+
 			if err := sizingModel.Bones.InsertShortageOverrideBones(); err != nil {
 				mlog.ET(mi18n.T("システム用ボーン追加失敗"), err, "")
 				errChan <- err
@@ -341,6 +566,8 @@ func (ss *SizingSet) LoadSizingModel(path string) error {
 		pmxRep := repository.NewPmxRepository(false)
 		if data, err := pmxRep.Load(path); err == nil {
 			sizingConfigModel = data.(*pmx.PmxModel)
+			boneMapping = mapModelBoneNames(sizingConfigModel, path)
+
 			var insertDebugBones func(bones *pmx.Bones, displaySlots *pmx.DisplaySlots) error
 			if mlog.IsDebug() {
 				insertDebugBones = ss.insertDebugBones
@@ -371,12 +598,18 @@ func (ss *SizingSet) LoadSizingModel(path string) error {
 	for err := range errChan {
 		if err != nil {
 			ss.setSizingModel(nil, nil)
+			ss.SizingBoneMapping = nil
 			return err
 		}
 	}
 
 	// サイジングモデル設定
 	ss.setSizingModel(sizingModel, sizingConfigModel)
+	ss.SizingBoneMapping = boneMapping
+	if len(boneMapping) > 0 {
+		mlog.I(mi18n.T("ボーン名マッピング適用", map[string]any{
+			"No": ss.Index + 1, "ModelName": sizingModel.Name(), "Count": len(boneMapping)}))
+	}
 
 	// 出力パスを設定
 	ss.OutputModelPath = ss.CreateOutputModelPath()
@@ -440,6 +673,10 @@ func (ss *SizingSet) LoadMotion(path string) error {
 		}
 	}
 
+	// 元モデルのボーン名を置き換えている場合、モーションも標準ボーン名に付け替える
+	renameBoneFrames(originalMotion, ss.OriginalBoneMapping)
+	renameBoneFrames(sizingMotion, ss.OriginalBoneMapping)
+
 	ss.setMotion(originalMotion, sizingMotion)
 
 	// 肩の比重を計算する
@@ -975,13 +1212,25 @@ func (ss *SizingSet) Delete() {
 	ss.SizingConfigModel = nil
 	ss.OutputMotion = nil
 
+	ss.OriginalBoneMapping = nil
+	ss.SizingBoneMapping = nil
+
+	ss.ClearDeltaCache()
+
 	ss.IsSizingLeg = false
+	ss.IsSizingLower = false
 	ss.IsSizingUpper = false
 	ss.IsSizingShoulder = false
 	ss.IsSizingArmStance = false
 	ss.IsSizingFingerStance = false
 	ss.IsSizingArmTwist = false
 	ss.IsSizingWrist = false
+	ss.IsSizingFootLock = false
+	ss.IsSizingFloor = false
+	ss.IsSizingGaze = false
+	ss.IsSizingArmCollision = false
+	ss.IsSizingSelfContact = false
+	ss.IsSizingHandContact = false
 	ss.IsSizingReduction = false
 
 	ss.CompletedSizingLeg = false
@@ -990,5 +1239,12 @@ func (ss *SizingSet) Delete() {
 	ss.CompletedSizingArmStance = false
 	ss.CompletedSizingFingerStance = false
 	ss.CompletedSizingArmTwist = false
+	ss.CompletedSizingGaze = false
+	ss.CompletedSizingLower = false
+	ss.CompletedSizingArmCollision = false
+	ss.CompletedSizingSelfContact = false
+	ss.CompletedSizingHandContact = false
+	ss.CompletedSizingFloor = false
+	ss.CompletedSizingFootLock = false
 	ss.CompletedSizingReduction = false
 }
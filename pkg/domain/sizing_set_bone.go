@@ -330,10 +330,18 @@ func (ss *SizingSet) SizingArmBone(direction pmx.BoneDirection) *pmx.Bone {
 	return ss.getOrFetchBone(ss.SizingConfigModel, ss.sizingBoneCache, pmx.ARM.StringFromDirection(direction))
 }
 
+func (ss *SizingSet) SizingArmTwistBone(direction pmx.BoneDirection) *pmx.Bone {
+	return ss.getOrFetchBone(ss.SizingConfigModel, ss.sizingBoneCache, pmx.ARM_TWIST.StringFromDirection(direction))
+}
+
 func (ss *SizingSet) SizingElbowBone(direction pmx.BoneDirection) *pmx.Bone {
 	return ss.getOrFetchBone(ss.SizingConfigModel, ss.sizingBoneCache, pmx.ELBOW.StringFromDirection(direction))
 }
 
+func (ss *SizingSet) SizingWristTwistBone(direction pmx.BoneDirection) *pmx.Bone {
+	return ss.getOrFetchBone(ss.SizingConfigModel, ss.sizingBoneCache, pmx.WRIST_TWIST.StringFromDirection(direction))
+}
+
 func (ss *SizingSet) SizingWristBone(direction pmx.BoneDirection) *pmx.Bone {
 	return ss.getOrFetchBone(ss.SizingConfigModel, ss.sizingBoneCache, pmx.WRIST.StringFromDirection(direction))
 }
@@ -0,0 +1,215 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+)
+
+// SizingSetFileVersion セット設定ファイルの現行バージョン
+//
+//	0: サイジングセットの配列のみ(バージョン情報なし)
+//	1: バージョン・アプリバージョン・出力パスを保持
+//	2: 下半身補正を足補正から分離(is_sizing_lower)
+const SizingSetFileVersion = 2
+
+// SizingSetFile セット設定ファイル
+type SizingSetFile struct {
+	Version    int          `json:"version"`     // ファイル形式のバージョン
+	AppVersion string       `json:"app_version"` // 保存したアプリのバージョン
+	SizingSets []*SizingSet `json:"sizing_sets"` // サイジングセットリスト
+}
+
+// SaveSizingSetFile セット設定ファイルを保存する
+// json と同じ場所以下にあるファイルは、jsonからの相対パスで保存する
+func SaveSizingSetFile(path string, sizingSets []*SizingSet, appVersion string) error {
+	baseDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	file := &SizingSetFile{
+		Version:    SizingSetFileVersion,
+		AppVersion: appVersion,
+		SizingSets: make([]*SizingSet, 0, len(sizingSets)),
+	}
+
+	for _, sizingSet := range sizingSets {
+		// パスだけ書き換えるので、モデル等は参照のままの浅いコピーで良い
+		fileSet := *sizingSet
+		fileSet.OriginalMotionPath = relativePath(baseDir, sizingSet.OriginalMotionPath)
+		fileSet.OriginalModelPath = relativePath(baseDir, sizingSet.OriginalModelPath)
+		fileSet.SizingModelPath = relativePath(baseDir, sizingSet.SizingModelPath)
+		fileSet.OutputMotionPath = relativePath(baseDir, sizingSet.OutputMotionPath)
+		fileSet.OutputModelPath = relativePath(baseDir, sizingSet.OutputModelPath)
+		file.SizingSets = append(file.SizingSets, &fileSet)
+	}
+
+	output, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, output, 0644)
+}
+
+// ReadSizingSetFile セット設定ファイルを読み込む
+// 旧形式のファイルは現行バージョンに移行し、相対パスはjsonの場所を基準に解決する
+// モデル・モーションは読み込まないので、必要な場合は LoadSizingSets を使う
+func ReadSizingSetFile(path string) (*SizingSetFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := parseSizingSetFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sizing set file: %s: %w", path, err)
+	}
+
+	baseDir := filepath.Dir(path)
+	for i, sizingSet := range file.SizingSets {
+		sizingSet.Index = i
+		sizingSet.OriginalMotionPath = resolvePath(baseDir, sizingSet.OriginalMotionPath)
+		sizingSet.OriginalModelPath = resolvePath(baseDir, sizingSet.OriginalModelPath)
+		sizingSet.SizingModelPath = resolvePath(baseDir, sizingSet.SizingModelPath)
+		sizingSet.OutputMotionPath = resolvePath(baseDir, sizingSet.OutputMotionPath)
+		sizingSet.OutputModelPath = resolvePath(baseDir, sizingSet.OutputModelPath)
+	}
+
+	return file, nil
+}
+
+// LoadSizingSets セット設定ファイルを読み込み、モデル・モーションまで読み込んだサイジングセットを返す
+// 読み込みに失敗したセットがあっても残りのセットは読み込み、エラーはまとめて返す
+func LoadSizingSets(path string) ([]*SizingSet, error) {
+	file, err := ReadSizingSetFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sizingSets := make([]*SizingSet, 0, len(file.SizingSets))
+	errs := make([]error, 0)
+
+	for i, fileSet := range file.SizingSets {
+		sizingSet := NewSizingSet(i)
+		if err := sizingSet.loadFrom(fileSet); err != nil {
+			mlog.W(mi18n.T("サイジングセット復元失敗", map[string]any{"No": i + 1, "Error": err.Error()}))
+			errs = append(errs, fmt.Errorf("sizing set %d: %w", i+1, err))
+		}
+		sizingSets = append(sizingSets, sizingSet)
+	}
+
+	return sizingSets, errors.Join(errs...)
+}
+
+// loadFrom セット設定ファイルの内容から、モデル・モーションを読み込んで設定を復元する
+func (ss *SizingSet) loadFrom(fileSet *SizingSet) error {
+	// 補正オプションは出力パスの生成に使うので先に設定する
+	ss.IsSizingLeg = fileSet.IsSizingLeg
+	ss.IsSizingLower = fileSet.IsSizingLower
+	ss.IsSizingUpper = fileSet.IsSizingUpper
+	ss.IsSizingShoulder = fileSet.IsSizingShoulder
+	ss.IsSizingArmStance = fileSet.IsSizingArmStance
+	ss.IsSizingFingerStance = fileSet.IsSizingFingerStance
+	ss.IsSizingArmTwist = fileSet.IsSizingArmTwist
+	ss.IsSizingWrist = fileSet.IsSizingWrist
+	ss.IsSizingFootLock = fileSet.IsSizingFootLock
+	ss.IsSizingFloor = fileSet.IsSizingFloor
+	ss.IsSizingGaze = fileSet.IsSizingGaze
+	ss.IsSizingArmCollision = fileSet.IsSizingArmCollision
+	ss.IsSizingSelfContact = fileSet.IsSizingSelfContact
+	ss.IsSizingHandContact = fileSet.IsSizingHandContact
+	ss.IsSizingReduction = fileSet.IsSizingReduction
+
+	ss.ScaleMode = fileSet.ScaleMode
+	ss.ScaleValue = fileSet.ScaleValue
+	ss.ScaleAxis = fileSet.ScaleAxis
+	ss.ScalePolicy = fileSet.ScalePolicy
+	ss.ScaleAnchorIndex = fileSet.ScaleAnchorIndex
+
+	ss.GazeTarget = fileSet.GazeTarget
+
+	if err := ss.LoadOriginalModel(fileSet.OriginalModelPath); err != nil {
+		return err
+	}
+	if err := ss.LoadSizingModel(fileSet.SizingModelPath); err != nil {
+		return err
+	}
+	if err := ss.LoadMotion(fileSet.OriginalMotionPath); err != nil {
+		return err
+	}
+
+	// 読込時に計算し直した値を、保存時の値で上書きする
+	if fileSet.ShoulderWeight > 0 {
+		ss.ShoulderWeight = fileSet.ShoulderWeight
+		ss.CompletedShoulderWeight = fileSet.ShoulderWeight
+	}
+	if fileSet.OutputMotionPath != "" {
+		ss.OutputMotionPath = fileSet.OutputMotionPath
+	}
+	if fileSet.OutputModelPath != "" {
+		ss.OutputModelPath = fileSet.OutputModelPath
+	}
+
+	return nil
+}
+
+// parseSizingSetFile バージョン毎の形式を読み分けて、現行バージョンに移行する
+func parseSizingSetFile(data []byte) (*SizingSetFile, error) {
+	file := &SizingSetFile{}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// バージョン0: サイジングセットの配列のみ
+		if err := json.Unmarshal(trimmed, &file.SizingSets); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+
+	if file.Version > SizingSetFileVersion {
+		return nil, fmt.Errorf("unsupported sizing set file version: %d", file.Version)
+	}
+
+	// バージョン0 -> 1: 追加した項目は未設定のままで、読込時に再計算する
+
+	// バージョン1 -> 2: 足補正に含まれていた下半身補正を引き継ぐ
+	if file.Version < 2 {
+		for _, sizingSet := range file.SizingSets {
+			if sizingSet != nil && sizingSet.IsSizingLeg {
+				sizingSet.IsSizingLower = true
+			}
+		}
+	}
+
+	file.Version = SizingSetFileVersion
+
+	if file.SizingSets == nil {
+		file.SizingSets = make([]*SizingSet, 0)
+	}
+
+	return file, nil
+}
+
+// relativePath 基準ディレクトリ以下のパスを相対パスに変換する
+// 基準ディレクトリ外のパスは絶対パスのまま返す
+func relativePath(baseDir, path string) string {
+	if path == "" || !filepath.IsAbs(path) {
+		return path
+	}
+
+	rel, err := filepath.Rel(baseDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+
+	return rel
+}
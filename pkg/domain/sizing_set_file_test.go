@@ -0,0 +1,45 @@
+package domain
+
+import "testing"
+
+func TestParseSizingSetFileMigratesLower(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected []bool
+	}{
+		{
+			name:     "バージョン0は足補正の下半身補正を引き継ぐ",
+			data:     `[{"is_sizing_leg": true}, {"is_sizing_leg": false}]`,
+			expected: []bool{true, false},
+		},
+		{
+			name:     "バージョン1は足補正の下半身補正を引き継ぐ",
+			data:     `{"version": 1, "sizing_sets": [{"is_sizing_leg": true}]}`,
+			expected: []bool{true},
+		},
+		{
+			name:     "バージョン2は保存時の指定をそのまま使う",
+			data:     `{"version": 2, "sizing_sets": [{"is_sizing_leg": true, "is_sizing_lower": false}]}`,
+			expected: []bool{false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file, err := parseSizingSetFile([]byte(tc.data))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if file.Version != SizingSetFileVersion {
+				t.Errorf("expected version %d, got %d", SizingSetFileVersion, file.Version)
+			}
+			if len(file.SizingSets) != len(tc.expected) {
+				t.Fatalf("expected %d sets, got %d", len(tc.expected), len(file.SizingSets))
+			}
+			for i, expected := range tc.expected {
+				if file.SizingSets[i].IsSizingLower != expected {
+					t.Errorf("set %d: expected is_sizing_lower %v, got %v", i, expected, file.SizingSets[i].IsSizingLower)
+				}
+			}
+		})
+	}
+}
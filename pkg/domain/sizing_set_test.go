@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestSizingSetCreateOutputMotionPath(t *testing.T) {
+	motionPath := filepath.Join("motion", "dance.vmd")
+	modelPath := filepath.Join("model", "target.pmx")
+
+	for _, tc := range []struct {
+		name     string
+		setup    func(ss *SizingSet)
+		expected string
+	}{
+		{
+			name:     "補正なし",
+			setup:    func(ss *SizingSet) {},
+			expected: "target",
+		},
+		{
+			name: "補正毎の記号を決まった順で付ける",
+			setup: func(ss *SizingSet) {
+				ss.IsSizingReduction = true
+				ss.IsSizingLeg = true
+				ss.IsSizingArmStance = true
+				ss.IsSizingUpper = true
+			},
+			expected: "target_ALUR",
+		},
+		{
+			name: "全補正",
+			setup: func(ss *SizingSet) {
+				ss.IsSizingLeg = true
+				ss.IsSizingLower = true
+				ss.IsSizingFootLock = true
+				ss.IsSizingFloor = true
+				ss.IsSizingUpper = true
+				ss.IsSizingGaze = true
+				ss.IsSizingShoulder = true
+				ss.IsSizingArmCollision = true
+				ss.IsSizingArmStance = true
+				ss.IsSizingFingerStance = true
+				ss.IsSizingArmTwist = true
+				ss.IsSizingWrist = true
+				ss.IsSizingSelfContact = true
+				ss.IsSizingHandContact = true
+				ss.IsSizingReduction = true
+			},
+			expected: "target_ALDKGUESBFWPCHR",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := NewSizingSet(0)
+			ss.OriginalMotionPath = motionPath
+			ss.SizingModelPath = modelPath
+			tc.setup(ss)
+
+			outputPath := ss.CreateOutputMotionPath()
+			if filepath.Dir(outputPath) != filepath.Dir(motionPath) {
+				t.Errorf("expected output in %s, got %s", filepath.Dir(motionPath), outputPath)
+			}
+			if filepath.Ext(outputPath) != ".vmd" {
+				t.Errorf("expected .vmd, got %s", outputPath)
+			}
+			// ファイル名は「元モーション名_サイジング先モデル名_補正記号_日時」になる
+			pattern := regexp.MustCompile(`^dance_` + tc.expected + `_\d{8}_\d{6}\.vmd$`)
+			if !pattern.MatchString(filepath.Base(outputPath)) {
+				t.Errorf("expected %s, got %s", pattern, filepath.Base(outputPath))
+			}
+		})
+	}
+}
+
+func TestSizingSetCreateOutputMotionPathEmpty(t *testing.T) {
+	ss := NewSizingSet(0)
+	ss.OriginalMotionPath = "dance.vmd"
+	if outputPath := ss.CreateOutputMotionPath(); outputPath != "" {
+		t.Errorf("expected empty path without sizing model, got %s", outputPath)
+	}
+
+	ss = NewSizingSet(0)
+	ss.SizingModelPath = "target.pmx"
+	if outputPath := ss.CreateOutputMotionPath(); outputPath != "" {
+		t.Errorf("expected empty path without motion, got %s", outputPath)
+	}
+}
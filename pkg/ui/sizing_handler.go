@@ -1,7 +1,7 @@
 package ui
 
 import (
-	"sync"
+	"context"
 	"sync/atomic"
 	"time"
 
@@ -25,12 +25,20 @@ func changeSizingCheck(cw *controller.ControlWindow, sizingState *SizingState) {
 
 	for _, sizingSet := range sizingState.SizingSets[startIndex:endIndex] {
 		sizingSet.IsSizingLeg = sizingState.SizingLegCheck.Checked()
+		sizingSet.IsSizingLower = sizingState.SizingLowerCheck.Checked()
 		sizingSet.IsSizingUpper = sizingState.SizingUpperCheck.Checked()
 		sizingSet.IsSizingShoulder = sizingState.SizingShoulderCheck.Checked()
 		sizingSet.IsSizingArmStance = sizingState.SizingArmStanceCheck.Checked()
 		sizingSet.IsSizingFingerStance = sizingState.SizingFingerStanceCheck.Checked()
 		sizingSet.IsSizingArmTwist = sizingState.SizingArmTwistCheck.Checked()
 		sizingSet.IsSizingWrist = sizingState.SizingWristCheck.Checked()
+		sizingSet.IsSizingFootLock = sizingState.SizingFootLockCheck.Checked()
+		sizingSet.IsSizingFloor = sizingState.SizingFloorCheck.Checked()
+		sizingSet.IsSizingGaze = sizingState.SizingGazeCheck.Checked()
+		sizingSet.IsSizingArmCollision = sizingState.SizingArmCollisionCheck.Checked()
+		sizingSet.IsSizingSelfContact = sizingState.SizingSelfContactCheck.Checked()
+		sizingSet.IsSizingHandContact = sizingState.SizingHandContactCheck.Checked()
+		sizingSet.IsSizingReduction = sizingState.SizingReductionCheck.Checked()
 		sizingSet.ShoulderWeight = sizingState.ShoulderWeightSlider.Value()
 
 		outputPath := sizingSet.CreateOutputMotionPath()
@@ -79,22 +87,40 @@ func execSizing(cw *controller.ControlWindow, sizingState *SizingState) error {
 
 	for _, sizingSet := range sizingState.SizingSets {
 		if !sizingSet.IsSizingLeg && sizingSet.CompletedSizingLeg ||
+			!sizingSet.IsSizingLower && sizingSet.CompletedSizingLower ||
 			!sizingSet.IsSizingUpper && sizingSet.CompletedSizingUpper ||
 			!sizingSet.IsSizingShoulder && sizingSet.CompletedSizingShoulder ||
 			!sizingSet.IsSizingArmStance && sizingSet.CompletedSizingArmStance ||
 			!sizingSet.IsSizingFingerStance && sizingSet.CompletedSizingFingerStance ||
 			!sizingSet.IsSizingArmTwist && sizingSet.CompletedSizingArmTwist ||
 			!sizingSet.IsSizingWrist && sizingSet.CompletedSizingWrist ||
+			!sizingSet.IsSizingFootLock && sizingSet.CompletedSizingFootLock ||
+			!sizingSet.IsSizingFloor && sizingSet.CompletedSizingFloor ||
+			!sizingSet.IsSizingGaze && sizingSet.CompletedSizingGaze ||
+			!sizingSet.IsSizingArmCollision && sizingSet.CompletedSizingArmCollision ||
+			!sizingSet.IsSizingSelfContact && sizingSet.CompletedSizingSelfContact ||
+			!sizingSet.IsSizingHandContact && sizingSet.CompletedSizingHandContact ||
+			!sizingSet.IsSizingReduction && sizingSet.CompletedSizingReduction ||
+			// 間引き後に補正を追加する場合も、間引き前から処理し直す
+			sizingSet.CompletedSizingReduction && sizingSet.GetProcessCount() > 0 ||
 			sizingSet.ShoulderWeight != sizingSet.CompletedShoulderWeight {
 
 			// チェックを外したら読み直し
 			sizingSet.CompletedSizingLeg = false
+			sizingSet.CompletedSizingLower = false
 			sizingSet.CompletedSizingUpper = false
 			sizingSet.CompletedSizingShoulder = false
 			sizingSet.CompletedSizingArmStance = false
 			sizingSet.CompletedSizingFingerStance = false
 			sizingSet.CompletedSizingArmTwist = false
 			sizingSet.CompletedSizingWrist = false
+			sizingSet.CompletedSizingFootLock = false
+			sizingSet.CompletedSizingFloor = false
+			sizingSet.CompletedSizingGaze = false
+			sizingSet.CompletedSizingArmCollision = false
+			sizingSet.CompletedSizingSelfContact = false
+			sizingSet.CompletedSizingHandContact = false
+			sizingSet.CompletedSizingReduction = false
 
 			// オリジナルモーションをサイジング先モーションとして読み直し
 			sizingState.SetCurrentIndex(sizingSet.Index)
@@ -102,11 +128,11 @@ func execSizing(cw *controller.ControlWindow, sizingState *SizingState) error {
 		}
 	}
 
+	pipeline := usecase.NewSizingPipeline(sizingState.SizingSets)
+	pipeline.Camera = sizingState.Camera
+
 	var completedProcessCount int32 = 0
-	totalProcessCount := 0
-	for _, sizingSet := range sizingState.SizingSets {
-		totalProcessCount += sizingSet.GetProcessCount()
-	}
+	totalProcessCount := pipeline.ProcessCount()
 
 	cw.Synchronize(func() {
 		sizingState.SetSizingEnabled(false)
@@ -116,112 +142,38 @@ func execSizing(cw *controller.ControlWindow, sizingState *SizingState) error {
 		cw.ProgressBar().SetValue(int(completedProcessCount))
 	})
 
+	pipeline.OnProgress = func() {
+		atomic.AddInt32(&completedProcessCount, 1)
+		cw.Synchronize(func() {
+			cw.ProgressBar().Increment()
+		})
+	}
+	pipeline.OnMotionUpdated = func(sizingSet *domain.SizingSet) {
+		cw.StoreMotion(0, sizingSet.Index, sizingSet.OutputMotion)
+	}
+
 	// 処理時間の計測開始
 	start := time.Now()
 
-	scales := usecase.GenerateSizingScales(sizingState.SizingSets)
-	isExec := false
-
-	errorChan := make(chan error, len(sizingState.SizingSets))
-
 	mlog.IL(mi18n.T("サイジング開始"))
 
-	var wg sync.WaitGroup
-	for _, sizingSet := range sizingState.SizingSets {
-		if sizingSet.OriginalConfigModel == nil || sizingSet.SizingConfigModel == nil ||
-			sizingSet.OutputMotion == nil {
-			continue
-		}
-
-		wg.Add(1)
-		go func(sizingSet *domain.SizingSet) {
-			defer wg.Done()
-
-			incrementCompletedCount := func() {
-				atomic.AddInt32(&completedProcessCount, 1)
-				cw.Synchronize(func() {
-					cw.ProgressBar().Increment()
-				})
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	sizingState.SetCancelSizing(cancel)
 
-			// 腕指スタンス補正
-			if execResult, err := usecase.NewSizingArmStanceUsecase().Exec(sizingSet, len(sizingState.SizingSets), incrementCompletedCount); err != nil {
-				errorChan <- err
-				return
-			} else {
-				if sizingSet.IsTerminate {
-					isExec = false
-					return
-				}
+	isExec, err := pipeline.Exec(ctx)
 
-				isExec = execResult || isExec
+	sizingState.SetCancelSizing(nil)
+	cancel()
 
-				if isExec {
-					sizingSet.OutputMotion.SetRandHash()
-					sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
-					cw.StoreMotion(0, sizingSet.Index, sizingSet.OutputMotion)
-				}
-			}
-
-			// 下半身・足補正
-			if execResult, err := usecase.NewSizingLegUsecase().Exec(sizingSet, scales[sizingSet.Index], len(sizingState.SizingSets), incrementCompletedCount); err != nil {
-				errorChan <- err
-				return
-			} else {
-				if sizingSet.IsTerminate {
-					isExec = false
-					return
-				}
-
-				isExec = execResult || isExec
-
-				if isExec {
-					sizingSet.OutputMotion.SetRandHash()
-					sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
-					cw.StoreMotion(0, sizingSet.Index, sizingSet.OutputMotion)
-				}
-			}
-
-			for _, uc := range []usecase.ISizingUsecase{
-				usecase.NewSizingUpperUsecase(),    // 上半身補正
-				usecase.NewSizingShoulderUsecase(), // 肩補正
-			} {
-				if execResult, err := uc.Exec(sizingSet, len(sizingState.SizingSets), incrementCompletedCount); err != nil {
-					errorChan <- err
-					return
-				} else {
-					if sizingSet.IsTerminate {
-						isExec = false
-						return
-					}
-
-					isExec = execResult || isExec
-
-					if isExec {
-						sizingSet.OutputMotion.SetRandHash()
-						sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
-						cw.StoreMotion(0, sizingSet.Index, sizingSet.OutputMotion)
-					}
-				}
-			}
-
-		}(sizingSet)
-	}
-
-	wg.Wait()
-	close(errorChan)
-
-	// チャネルからエラーを受け取る
-	for err := range errorChan {
-		if err != nil {
-			if merr.IsTerminateError(err) {
-				mlog.I(mi18n.T("サイジング中断"))
-				break
-			} else {
-				mlog.E(mi18n.T("サイジングエラー", map[string]interface{}{
-					"AppName": cw.AppConfig().Name, "AppVersion": cw.AppConfig().Version}), err, "")
-				return err
-			}
+	isTerminated := false
+	if err != nil {
+		if merr.IsTerminateError(err) {
+			isTerminated = true
+			mlog.I(mi18n.T("サイジング中断"))
+		} else {
+			mlog.E(mi18n.T("サイジングエラー", map[string]interface{}{
+				"AppName": cw.AppConfig().Name, "AppVersion": cw.AppConfig().Version}), err, "")
+			return err
 		}
 	}
 
@@ -235,15 +187,13 @@ func execSizing(cw *controller.ControlWindow, sizingState *SizingState) error {
 		mlog.I(mi18n.T("サイジング終了"))
 	}
 
-	// 中断したら、データを戻してフラグを落としておく
-	for _, sizingSet := range sizingState.SizingSets {
-		if sizingSet.IsTerminate {
+	// 中断したら、データを戻しておく
+	if isTerminated {
+		for _, sizingSet := range sizingState.SizingSets {
 			// オリジナルモーションをサイジング先モーションとして読み直し
 			outputMotion := cw.LoadMotion(1, sizingSet.Index)
 			outputMotion.SetRandHash()
 			cw.StoreMotion(0, sizingSet.Index, outputMotion)
-
-			sizingSet.IsTerminate = false
 		}
 	}
 
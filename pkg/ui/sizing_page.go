@@ -20,6 +20,7 @@ import (
 func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 	var sizingTab *walk.TabPage
 	sizingState := new(SizingState)
+	sizingState.Camera = domain.NewSizingCamera()
 
 	sizingState.Player = widget.NewMotionPlayer()
 	sizingState.Player.SetOnChangePlayingPre(func(playing bool) {
@@ -35,7 +36,11 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 				return
 			}
 
-			if err := rep.Save(path, motion, false); err != nil {
+			motion, err := sizingState.CurrentSet().RestoreSizingBoneNames(motion)
+			if err == nil {
+				err = rep.Save(path, motion, false)
+			}
+			if err != nil {
 				mlog.ET(mi18n.T("保存失敗"), err, "")
 				if ok := merr.ShowErrorDialog(cw.AppConfig(), err); ok {
 					sizingState.SetSizingEnabled(true)
@@ -62,6 +67,19 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 		},
 	)
 
+	sizingState.CameraMotionPicker = widget.NewVmdVpdLoadFilePicker(
+		"camera_vmd",
+		mi18n.T("カメラモーション(Vmd)"),
+		mi18n.T("カメラモーションツールチップ"),
+		func(cw *controller.ControlWindow, rep repository.IRepository, path string) {
+			if err := sizingState.Camera.LoadCameraMotion(path); err != nil {
+				if ok := merr.ShowErrorDialog(cw.AppConfig(), err); ok {
+					sizingState.SetSizingEnabled(true)
+				}
+			}
+		},
+	)
+
 	sizingState.OriginalMotionPicker = widget.NewVmdVpdLoadFilePicker(
 		"vmd",
 		mi18n.T("サイジング対象モーション(Vmd/Vpd)"),
@@ -160,31 +178,7 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 				}
 			}
 
-			sizingState.ResetSet()
-			sizingState.LoadSet(dlg.FilePath)
-
-			for range len(sizingState.SizingSets) - 1 {
-				sizingState.AddAction()
-			}
-
-			for index := range sizingState.SizingSets {
-				sizingState.ChangeCurrentAction(index)
-				sizingState.OriginalMotionPicker.SetForcePath(sizingState.SizingSets[index].OriginalMotionPath)
-				sizingState.OriginalModelPicker.SetForcePath(sizingState.SizingSets[index].OriginalModelPath)
-				sizingState.SizingModelPicker.SetForcePath(sizingState.SizingSets[index].SizingModelPath)
-
-				sizingState.SizingArmStanceCheck.SetChecked(sizingState.SizingSets[index].IsSizingArmStance)
-				sizingState.SizingLegCheck.SetChecked(sizingState.SizingSets[index].IsSizingLeg)
-				sizingState.SizingUpperCheck.SetChecked(sizingState.SizingSets[index].IsSizingUpper)
-				sizingState.SizingShoulderCheck.SetChecked(sizingState.SizingSets[index].IsSizingShoulder)
-				sizingState.SizingFingerStanceCheck.SetChecked(sizingState.SizingSets[index].IsSizingFingerStance)
-				sizingState.SizingArmTwistCheck.SetChecked(sizingState.SizingSets[index].IsSizingArmTwist)
-				sizingState.SizingWristCheck.SetChecked(sizingState.SizingSets[index].IsSizingWrist)
-				sizingState.ShoulderWeightEdit.ChangeText(strconv.Itoa(sizingState.SizingSets[index].ShoulderWeight))
-				sizingState.ShoulderWeightSlider.ChangeValue(sizingState.SizingSets[index].ShoulderWeight)
-			}
-
-			sizingState.SetCurrentIndex(0)
+			sizingState.LoadSet(cw, dlg.FilePath)
 			sizingState.SetSizingEnabled(true)
 		}
 	})
@@ -209,7 +203,7 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 		if ok, err := dlg.ShowSave(nil); err != nil {
 			walk.MsgBox(nil, mi18n.T("ファイル選択ダイアログ選択エラー"), err.Error(), walk.MsgBoxIconError)
 		} else if ok {
-			sizingState.SaveSet(dlg.FilePath)
+			sizingState.SaveSet(dlg.FilePath, cw.AppConfig().Version)
 			mconfig.SaveUserConfig("sizing_set_path", dlg.FilePath, 1)
 		}
 	})
@@ -221,9 +215,7 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 	sizingState.TerminateButton.SetOnClicked(func(cw *controller.ControlWindow) {
 		// 押したら非活性
 		sizingState.TerminateButton.SetEnabled(false)
-		for _, sizingSet := range sizingState.SizingSets {
-			sizingSet.IsTerminate = true
-		}
+		sizingState.CancelSizing()
 	})
 
 	sizingState.SaveButton = widget.NewMPushButton()
@@ -237,7 +229,11 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 		for _, sizingSet := range sizingState.SizingSets {
 			if sizingSet.OutputMotionPath != "" && sizingSet.OutputMotion != nil {
 				rep := repository.NewVmdRepository(true)
-				if err := rep.Save(sizingSet.OutputMotionPath, sizingSet.OutputMotion, false); err != nil {
+				outputMotion, err := sizingSet.RestoreSizingBoneNames(sizingSet.OutputMotion)
+				if err == nil {
+					err = rep.Save(sizingSet.OutputMotionPath, outputMotion, false)
+				}
+				if err != nil {
 					mlog.ET(mi18n.T("保存失敗"), err, "")
 					if ok := merr.ShowErrorDialog(cw.AppConfig(), err); ok {
 						sizingState.SetSizingEnabled(true)
@@ -246,14 +242,29 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 			}
 		}
 
+		if sizingState.Camera.OutputCameraMotion != nil && len(sizingState.SizingSets) > 0 {
+			// カメラは1人目のセットに追従しているので、1人目のサイジング先モデル名で出力する
+			camera := sizingState.Camera
+			camera.OutputCameraMotionPath = camera.CreateOutputCameraMotionPath(sizingState.SizingSets[0])
+
+			rep := repository.NewVmdRepository(true)
+			if err := rep.Save(camera.OutputCameraMotionPath, camera.OutputCameraMotion, false); err != nil {
+				mlog.ET(mi18n.T("保存失敗"), err, "")
+				if ok := merr.ShowErrorDialog(cw.AppConfig(), err); ok {
+					sizingState.SetSizingEnabled(true)
+				}
+			}
+		}
+
 		sizingState.SetSizingEnabled(true)
 		controller.Beep()
 	})
 
 	mWidgets.Widgets = append(mWidgets.Widgets, sizingState.Player, sizingState.OriginalMotionPicker,
 		sizingState.OriginalModelPicker, sizingState.SizingModelPicker, sizingState.OutputMotionPicker,
-		sizingState.OutputModelPicker, sizingState.AddSetButton, sizingState.ResetSetButton,
-		sizingState.LoadSetButton, sizingState.SaveSetButton, sizingState.TerminateButton, sizingState.SaveButton)
+		sizingState.OutputModelPicker, sizingState.CameraMotionPicker, sizingState.AddSetButton,
+		sizingState.ResetSetButton, sizingState.LoadSetButton, sizingState.SaveSetButton,
+		sizingState.TerminateButton, sizingState.SaveButton)
 	mWidgets.SetOnLoaded(func() {
 		sizingState.SizingSets = append(sizingState.SizingSets, domain.NewSizingSet(len(sizingState.SizingSets)))
 		sizingState.AddAction()
@@ -336,6 +347,14 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 									changeSizingCheck(mWidgets.Window(), sizingState)
 								},
 							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingLowerCheck,
+								Text:        mi18n.T("下半身補正"),
+								ToolTipText: mi18n.T("下半身補正説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
 							declarative.CheckBox{
 								AssignTo:    &sizingState.SizingUpperCheck,
 								Text:        mi18n.T("上半身補正"),
@@ -373,7 +392,63 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 								Text:        mi18n.T("手首位置合わせ"),
 								ToolTipText: mi18n.T("手首位置合わせ説明"),
 								OnCheckStateChanged: func() {
-									// changeSizingCheck(mWidgets.Window(), sizingState)
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingFootLockCheck,
+								Text:        mi18n.T("足接地固定"),
+								ToolTipText: mi18n.T("足接地固定説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingFloorCheck,
+								Text:        mi18n.T("床補正"),
+								ToolTipText: mi18n.T("床補正説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingGazeCheck,
+								Text:        mi18n.T("視線補正"),
+								ToolTipText: mi18n.T("視線補正説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingArmCollisionCheck,
+								Text:        mi18n.T("腕貫通回避"),
+								ToolTipText: mi18n.T("腕貫通回避説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingSelfContactCheck,
+								Text:        mi18n.T("自己接触維持"),
+								ToolTipText: mi18n.T("自己接触維持説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingHandContactCheck,
+								Text:        mi18n.T("手接触維持"),
+								ToolTipText: mi18n.T("手接触維持説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
+								},
+							},
+							declarative.CheckBox{
+								AssignTo:    &sizingState.SizingReductionCheck,
+								Text:        mi18n.T("不要キー間引き"),
+								ToolTipText: mi18n.T("不要キー間引き説明"),
+								OnCheckStateChanged: func() {
+									changeSizingCheck(mWidgets.Window(), sizingState)
 								},
 							},
 						},
@@ -438,6 +513,7 @@ func NewSizingPage(mWidgets *controller.MWidgets) declarative.TabPage {
 					sizingState.OutputModelPicker.Widgets(),
 				},
 			},
+			sizingState.CameraMotionPicker.Widgets(),
 			sizingState.SaveButton.Widgets(),
 			sizingState.Player.Widgets(),
 		},
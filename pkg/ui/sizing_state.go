@@ -1,11 +1,11 @@
 package ui
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
 
@@ -28,21 +28,51 @@ type SizingState struct {
 	SizingModelPicker       *widget.FilePicker   // サイジング先モデル
 	OutputMotionPicker      *widget.FilePicker   // 出力モーション
 	OutputModelPicker       *widget.FilePicker   // 出力モデル
+	CameraMotionPicker      *widget.FilePicker   // カメラモーション
 	AdoptSizingCheck        *walk.CheckBox       // サイジング反映チェック
 	AdoptAllCheck           *walk.CheckBox       // 全セット反映チェック
 	TerminateButton         *widget.MPushButton  // 終了ボタン
 	SaveButton              *widget.MPushButton  // 保存ボタン
 	SizingArmStanceCheck    *walk.CheckBox       // 腕スタンスチェック
 	SizingLegCheck          *walk.CheckBox       // 足チェック
+	SizingLowerCheck        *walk.CheckBox       // 下半身補正チェック
 	SizingUpperCheck        *walk.CheckBox       // 上半身チェック
 	SizingShoulderCheck     *walk.CheckBox       // 肩チェック
 	SizingFingerStanceCheck *walk.CheckBox       // 指チェック
 	SizingArmTwistCheck     *walk.CheckBox       // 腕捩りチェック
 	SizingWristCheck        *walk.CheckBox       // 手首位置合わせチェック
+	SizingFootLockCheck     *walk.CheckBox       // 足接地固定チェック
+	SizingFloorCheck        *walk.CheckBox       // 床補正チェック
+	SizingGazeCheck         *walk.CheckBox       // 視線補正チェック
+	SizingArmCollisionCheck *walk.CheckBox       // 腕貫通回避チェック
+	SizingSelfContactCheck  *walk.CheckBox       // 自己接触維持チェック
+	SizingHandContactCheck  *walk.CheckBox       // 手接触維持チェック
+	SizingReductionCheck    *walk.CheckBox       // 不要キー間引きチェック
 	ShoulderWeightSlider    *walk.Slider         // 肩の重みスライダー
 	ShoulderWeightEdit      *walk.TextEdit       // 肩の重みエディット
 	Player                  *widget.MotionPlayer // モーションプレイヤー
 	SizingSets              []*domain.SizingSet  `json:"sizing_sets"` // サイジングセット
+	Camera                  *domain.SizingCamera // カメラ(全セット共通)
+	cancelSizing            context.CancelFunc   // サイジング中断関数
+	cancelMutex             sync.Mutex           // サイジング中断関数のロック
+}
+
+// SetCancelSizing 実行中のサイジングを中断する関数を設定する
+func (ss *SizingState) SetCancelSizing(cancel context.CancelFunc) {
+	ss.cancelMutex.Lock()
+	defer ss.cancelMutex.Unlock()
+
+	ss.cancelSizing = cancel
+}
+
+// CancelSizing 実行中のサイジングを中断する
+func (ss *SizingState) CancelSizing() {
+	ss.cancelMutex.Lock()
+	defer ss.cancelMutex.Unlock()
+
+	if ss.cancelSizing != nil {
+		ss.cancelSizing()
+	}
 }
 
 func (ss *SizingState) AddAction() {
@@ -102,11 +132,19 @@ func (ss *SizingState) ChangeCurrentAction(index int) {
 	// サイジングオプションの情報を表示
 	ss.SizingArmStanceCheck.SetChecked(ss.CurrentSet().IsSizingArmStance)
 	ss.SizingLegCheck.SetChecked(ss.CurrentSet().IsSizingLeg)
+	ss.SizingLowerCheck.SetChecked(ss.CurrentSet().IsSizingLower)
 	ss.SizingUpperCheck.SetChecked(ss.CurrentSet().IsSizingUpper)
 	ss.SizingShoulderCheck.SetChecked(ss.CurrentSet().IsSizingShoulder)
 	ss.SizingFingerStanceCheck.SetChecked(ss.CurrentSet().IsSizingFingerStance)
 	ss.SizingArmTwistCheck.SetChecked(ss.CurrentSet().IsSizingArmTwist)
 	ss.SizingWristCheck.SetChecked(ss.CurrentSet().IsSizingWrist)
+	ss.SizingFootLockCheck.SetChecked(ss.CurrentSet().IsSizingFootLock)
+	ss.SizingFloorCheck.SetChecked(ss.CurrentSet().IsSizingFloor)
+	ss.SizingGazeCheck.SetChecked(ss.CurrentSet().IsSizingGaze)
+	ss.SizingArmCollisionCheck.SetChecked(ss.CurrentSet().IsSizingArmCollision)
+	ss.SizingSelfContactCheck.SetChecked(ss.CurrentSet().IsSizingSelfContact)
+	ss.SizingHandContactCheck.SetChecked(ss.CurrentSet().IsSizingHandContact)
+	ss.SizingReductionCheck.SetChecked(ss.CurrentSet().IsSizingReduction)
 
 	ss.ShoulderWeightEdit.ChangeText(fmt.Sprintf("%d", ss.CurrentSet().ShoulderWeight))
 	ss.ShoulderWeightSlider.ChangeValue(ss.CurrentSet().ShoulderWeight)
@@ -115,11 +153,19 @@ func (ss *SizingState) ChangeCurrentAction(index int) {
 func (ss *SizingState) ClearOptions() {
 	ss.SizingArmStanceCheck.SetChecked(false)
 	ss.SizingLegCheck.SetChecked(false)
+	ss.SizingLowerCheck.SetChecked(false)
 	ss.SizingUpperCheck.SetChecked(false)
 	ss.SizingShoulderCheck.SetChecked(false)
 	ss.SizingFingerStanceCheck.SetChecked(false)
 	ss.SizingArmTwistCheck.SetChecked(false)
 	ss.SizingWristCheck.SetChecked(false)
+	ss.SizingFootLockCheck.SetChecked(false)
+	ss.SizingFloorCheck.SetChecked(false)
+	ss.SizingGazeCheck.SetChecked(false)
+	ss.SizingArmCollisionCheck.SetChecked(false)
+	ss.SizingSelfContactCheck.SetChecked(false)
+	ss.SizingHandContactCheck.SetChecked(false)
+	ss.SizingReductionCheck.SetChecked(false)
 	ss.ShoulderWeightEdit.ChangeText("")
 	ss.ShoulderWeightSlider.ChangeValue(0)
 	ss.Player.Reset(ss.MaxFrame())
@@ -149,43 +195,65 @@ func (ss *SizingState) CurrentSet() *domain.SizingSet {
 }
 
 // SaveSet セット情報を保存
-func (ss *SizingState) SaveSet(jsonPath string) error {
+func (ss *SizingState) SaveSet(jsonPath string, appVersion string) error {
 	if strings.ToLower(filepath.Ext(jsonPath)) != ".json" {
 		// 拡張子が.jsonでない場合は付与
 		jsonPath += ".json"
 	}
 
 	// セット情報をJSONに変換してファイルダイアログで選択した箇所に保存
-	if output, err := json.Marshal(ss.SizingSets); err == nil && len(output) > 0 {
-		if err := os.WriteFile(jsonPath, output, 0644); err == nil {
-			mlog.I(mi18n.T("サイジングセット保存成功", map[string]any{"Path": jsonPath}))
-		} else {
-			mlog.E(mi18n.T("サイジングセット保存失敗エラー"), err, "")
-			return err
-		}
-	} else {
+	if err := domain.SaveSizingSetFile(jsonPath, ss.SizingSets, appVersion); err != nil {
 		mlog.E(mi18n.T("サイジングセット保存失敗エラー"), err, "")
 		return err
 	}
 
+	mlog.I(mi18n.T("サイジングセット保存成功", map[string]any{"Path": jsonPath}))
+
 	return nil
 }
 
 // LoadSet セット情報を読み込む
-func (ss *SizingState) LoadSet(jsonPath string) error {
-	// セット情報をJSONから読み込んでセット情報を更新
-	if input, err := os.ReadFile(jsonPath); err == nil && len(input) > 0 {
-		if err := json.Unmarshal(input, &ss.SizingSets); err == nil {
-			mlog.I(mi18n.T("サイジングセット読込成功", map[string]any{"Path": jsonPath}))
-		} else {
-			mlog.E(mi18n.T("サイジングセット読込失敗エラー"), err, "")
-			return err
-		}
-	} else {
+// モデル・モーションも読み込み直して、セット毎のタブを作り直す
+func (ss *SizingState) LoadSet(cw *controller.ControlWindow, jsonPath string) error {
+	sizingSets, err := domain.LoadSizingSets(jsonPath)
+	if sizingSets == nil {
 		mlog.E(mi18n.T("サイジングセット読込失敗エラー"), err, "")
 		return err
 	}
 
+	// 既存のセットを削除して、読み込んだセットで作り直す
+	for range ss.NavToolBar.Actions().Len() {
+		index := ss.NavToolBar.Actions().Len() - 1
+		ss.SizingSets[index].Delete()
+		ss.NavToolBar.Actions().RemoveAt(index)
+	}
+	ss.SizingSets = sizingSets
+	ss.currentIndex = -1
+
+	if len(ss.SizingSets) == 0 {
+		ss.SizingSets = append(ss.SizingSets, domain.NewSizingSet(0))
+	}
+
+	for index, sizingSet := range ss.SizingSets {
+		ss.NavToolBar.Actions().Add(ss.newAction(index))
+
+		cw.StoreModel(0, index, sizingSet.SizingModel)
+		cw.StoreModel(1, index, sizingSet.OriginalModel)
+		cw.StoreMotion(0, index, sizingSet.OutputMotion)
+		cw.StoreMotion(1, index, sizingSet.OriginalMotion)
+	}
+
+	ss.ChangeCurrentAction(0)
+	ss.Player.Reset(ss.MaxFrame())
+
+	if err != nil {
+		// 一部のセットの読み込みに失敗した場合も、読み込めたセットはそのまま使う
+		mlog.E(mi18n.T("サイジングセット読込失敗エラー"), err, "")
+		return err
+	}
+
+	mlog.I(mi18n.T("サイジングセット読込成功", map[string]any{"Path": jsonPath}))
+
 	return nil
 }
 
@@ -281,6 +349,7 @@ func (sizingState *SizingState) SetSizingEnabled(enabled bool) {
 	sizingState.SizingModelPicker.SetEnabled(enabled)
 	sizingState.OutputMotionPicker.SetEnabled(enabled)
 	sizingState.OutputModelPicker.SetEnabled(enabled)
+	sizingState.CameraMotionPicker.SetEnabled(enabled)
 
 	sizingState.Player.SetEnabled(enabled)
 
@@ -295,11 +364,19 @@ func (sizingState *SizingState) SetSizingOptionEnabled(enabled bool) {
 
 	sizingState.SizingArmStanceCheck.SetEnabled(enabled)
 	sizingState.SizingLegCheck.SetEnabled(enabled)
+	sizingState.SizingLowerCheck.SetEnabled(enabled)
 	sizingState.SizingUpperCheck.SetEnabled(enabled)
 	sizingState.SizingShoulderCheck.SetEnabled(enabled)
 	sizingState.SizingFingerStanceCheck.SetEnabled(enabled)
 	sizingState.SizingArmTwistCheck.SetEnabled(enabled)
 	sizingState.SizingWristCheck.SetEnabled(enabled)
+	sizingState.SizingFootLockCheck.SetEnabled(enabled)
+	sizingState.SizingFloorCheck.SetEnabled(enabled)
+	sizingState.SizingGazeCheck.SetEnabled(enabled)
+	sizingState.SizingArmCollisionCheck.SetEnabled(enabled)
+	sizingState.SizingSelfContactCheck.SetEnabled(enabled)
+	sizingState.SizingHandContactCheck.SetEnabled(enabled)
+	sizingState.SizingReductionCheck.SetEnabled(enabled)
 
 	sizingState.ShoulderWeightEdit.SetEnabled(enabled)
 	sizingState.ShoulderWeightSlider.SetEnabled(enabled)
@@ -1,6 +1,8 @@
 package usecase
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
 
@@ -19,82 +21,151 @@ import (
 	"github.com/miu200521358/mlib_go/pkg/usecase/deform"
 )
 
+// GenerateSizingScales セット毎の移動補正スケールを求める
+// XZはセットの設定に応じて、複数人の平均・セット単体・基準セットのいずれかに揃える
 func GenerateSizingScales(sizingSets []*domain.SizingSet) (scales []*mmath.MVec3) {
 	scales = make([]*mmath.MVec3, len(sizingSets))
+	baseScales := make([]*mmath.MVec3, len(sizingSets))
 
 	// 複数人居るときはXZは共通のスケールを使用する
 	meanXZScale := 0.0
+	meanCount := 0
 
 	for i, sizingSet := range sizingSets {
-		originalModel := sizingSet.OriginalModel
-		sizingModel := sizingSet.SizingConfigModel
+		baseScales[i] = generateSetSizingScale(sizingSet)
 
-		if originalModel == nil || sizingModel == nil {
-			scales[i] = &mmath.MVec3{X: 1.0, Y: 1.0, Z: 1.0}
-			meanXZScale += 1.0
-			continue
+		if isMeanSizingScale(sizingSet) {
+			meanXZScale += baseScales[i].X
+			meanCount++
 		}
+	}
 
-		sizingNeckRoot, _ := sizingModel.Bones.GetNeckRoot()
-		sizingLeftLeg, _ := sizingModel.Bones.GetLeg(pmx.BONE_DIRECTION_LEFT)
-		sizingLeftKnee, _ := sizingModel.Bones.GetKnee(pmx.BONE_DIRECTION_LEFT)
-		sizingLeftAnkle, _ := sizingModel.Bones.GetAnkle(pmx.BONE_DIRECTION_LEFT)
-		sizingLeftLegIK, _ := sizingModel.Bones.GetLegIk(pmx.BONE_DIRECTION_LEFT)
-		sizingTrunkRoot, _ := sizingModel.Bones.GetTrunkRoot()
-		originalNeckRoot, _ := originalModel.Bones.GetNeckRoot()
-		originalLeftLeg, _ := originalModel.Bones.GetLeg(pmx.BONE_DIRECTION_LEFT)
-		originalLeftKnee, _ := originalModel.Bones.GetKnee(pmx.BONE_DIRECTION_LEFT)
-		originalLeftAnkle, _ := originalModel.Bones.GetAnkle(pmx.BONE_DIRECTION_LEFT)
-		originalLeftLegIK, _ := originalModel.Bones.GetLegIk(pmx.BONE_DIRECTION_LEFT)
-		originalTrunkRoot, _ := originalModel.Bones.GetTrunkRoot()
-
-		if sizingLeftLeg == nil || sizingLeftKnee == nil || sizingLeftAnkle == nil || sizingLeftLegIK == nil ||
-			originalLeftLeg == nil || originalLeftKnee == nil || originalLeftAnkle == nil || originalLeftLegIK == nil ||
-			sizingTrunkRoot == nil || originalTrunkRoot == nil {
-			if sizingNeckRoot != nil && originalNeckRoot != nil {
-				// 首根元までの長さ比率
-				neckLengthRatio := sizingNeckRoot.Position.Y / originalNeckRoot.Position.Y
-				scales[i] = &mmath.MVec3{X: neckLengthRatio, Y: neckLengthRatio, Z: neckLengthRatio}
-				meanXZScale += neckLengthRatio
-			} else {
-				scales[i] = &mmath.MVec3{X: 1.0, Y: 1.0, Z: 1.0}
-				meanXZScale += 1.0
-			}
-		} else {
-			// 足の長さ比率(XZ)
-			legLengthScale := (sizingLeftLeg.Position.Distance(sizingLeftKnee.Position) +
-				sizingLeftKnee.Position.Distance(sizingLeftAnkle.Position)) /
-				(originalLeftLeg.Position.Distance(originalLeftKnee.Position) +
-					originalLeftKnee.Position.Distance(originalLeftAnkle.Position))
-			// // 体幹中心までの長さ比率
-			// trunkRootScale := sizingTrunkRoot.Position.Y / originalTrunkRoot.Position.Y
-
-			scales[i] = &mmath.MVec3{X: legLengthScale, Y: legLengthScale, Z: legLengthScale}
-			meanXZScale += legLengthScale
+	newXZScale := 1.0
+	if meanCount > 0 {
+		newXZScale = meanXZScale / float64(meanCount)
+		if meanCount > 1 {
+			newXZScale = min(1.2, newXZScale)
+		}
+	}
+
+	for i, sizingSet := range sizingSets {
+		scales[i] = baseScales[i].Copy()
+		if isMeanSizingScale(sizingSet) {
+			scales[i].X = newXZScale
+			scales[i].Z = newXZScale
 		}
 	}
 
-	// 複数人いるときはXZは共通のスケールを使用する
-	meanXZScale /= float64(len(scales))
-	newXZScale := meanXZScale
-	if len(sizingSets) > 1 {
-		newXZScale = min(1.2, meanXZScale)
+	// 基準セットに合わせる場合は、基準セットのスケール確定後に揃える
+	for i, sizingSet := range sizingSets {
+		if sizingSet.ScaleMode == domain.SizingScaleModeAxis ||
+			sizingSet.ScalePolicy != domain.SizingScalePolicyAnchor {
+			continue
+		}
+
+		anchorIndex := sizingSet.ScaleAnchorIndex
+		if anchorIndex < 0 || anchorIndex >= len(sizingSets) || anchorIndex == i ||
+			sizingSets[anchorIndex].ScalePolicy == domain.SizingScalePolicyAnchor {
+			// 基準セットが不正な場合は、セット単体のスケールを使う
+			continue
+		}
+
+		scales[i].X = scales[anchorIndex].X
+		scales[i].Z = scales[anchorIndex].Z
 	}
 
 	for i, sizingSet := range sizingSets {
 		if sizingSet.IsSizingLeg && !sizingSet.CompletedSizingLeg {
 			mlog.I(mi18n.T("移動補正スケール", map[string]any{
-				"No": i + 1, "XZ": fmt.Sprintf("%.3f", newXZScale),
-				"OrgXZ": fmt.Sprintf("%.3f", scales[i].X), "Y": fmt.Sprintf("%.3f", scales[i].Y)}))
+				"No": i + 1, "XZ": fmt.Sprintf("%.3f", scales[i].X),
+				"OrgXZ": fmt.Sprintf("%.3f", baseScales[i].X), "Y": fmt.Sprintf("%.3f", scales[i].Y)}))
 		}
-
-		scales[i].X = newXZScale
-		scales[i].Z = newXZScale
 	}
 
 	return scales
 }
 
+// isMeanSizingScale 複数人のXZ平均を共通で使うセットか
+// 固定値・軸毎に指定している場合は、指定値をそのまま使う(平均にも含めない)
+func isMeanSizingScale(sizingSet *domain.SizingSet) bool {
+	if sizingSet.ScaleMode == domain.SizingScaleModeFixed || sizingSet.ScaleMode == domain.SizingScaleModeAxis {
+		return false
+	}
+	return sizingSet.ScalePolicy == "" || sizingSet.ScalePolicy == domain.SizingScalePolicyMean
+}
+
+// generateSetSizingScale セット単体の移動補正スケールを求める
+func generateSetSizingScale(sizingSet *domain.SizingSet) *mmath.MVec3 {
+	switch sizingSet.ScaleMode {
+	case domain.SizingScaleModeFixed:
+		if sizingSet.ScaleValue > 0 {
+			return &mmath.MVec3{X: sizingSet.ScaleValue, Y: sizingSet.ScaleValue, Z: sizingSet.ScaleValue}
+		}
+	case domain.SizingScaleModeAxis:
+		scale := generateAutoSizingScale(sizingSet)
+		if sizingSet.ScaleAxis != nil {
+			// 0以下の軸は自動計算の値を使う
+			if sizingSet.ScaleAxis.X > 0 {
+				scale.X = sizingSet.ScaleAxis.X
+			}
+			if sizingSet.ScaleAxis.Y > 0 {
+				scale.Y = sizingSet.ScaleAxis.Y
+			}
+			if sizingSet.ScaleAxis.Z > 0 {
+				scale.Z = sizingSet.ScaleAxis.Z
+			}
+		}
+		return scale
+	}
+
+	return generateAutoSizingScale(sizingSet)
+}
+
+// generateAutoSizingScale 足の長さ比率から移動補正スケールを求める
+// 足ボーンが揃っていない場合は、首根元までの高さ比率を使う
+func generateAutoSizingScale(sizingSet *domain.SizingSet) *mmath.MVec3 {
+	originalModel := sizingSet.OriginalModel
+	sizingModel := sizingSet.SizingConfigModel
+
+	if originalModel == nil || sizingModel == nil {
+		return &mmath.MVec3{X: 1.0, Y: 1.0, Z: 1.0}
+	}
+
+	sizingNeckRoot, _ := sizingModel.Bones.GetNeckRoot()
+	sizingLeftLeg, _ := sizingModel.Bones.GetLeg(pmx.BONE_DIRECTION_LEFT)
+	sizingLeftKnee, _ := sizingModel.Bones.GetKnee(pmx.BONE_DIRECTION_LEFT)
+	sizingLeftAnkle, _ := sizingModel.Bones.GetAnkle(pmx.BONE_DIRECTION_LEFT)
+	sizingLeftLegIK, _ := sizingModel.Bones.GetLegIk(pmx.BONE_DIRECTION_LEFT)
+	sizingTrunkRoot, _ := sizingModel.Bones.GetTrunkRoot()
+	originalNeckRoot, _ := originalModel.Bones.GetNeckRoot()
+	originalLeftLeg, _ := originalModel.Bones.GetLeg(pmx.BONE_DIRECTION_LEFT)
+	originalLeftKnee, _ := originalModel.Bones.GetKnee(pmx.BONE_DIRECTION_LEFT)
+	originalLeftAnkle, _ := originalModel.Bones.GetAnkle(pmx.BONE_DIRECTION_LEFT)
+	originalLeftLegIK, _ := originalModel.Bones.GetLegIk(pmx.BONE_DIRECTION_LEFT)
+	originalTrunkRoot, _ := originalModel.Bones.GetTrunkRoot()
+
+	if sizingLeftLeg == nil || sizingLeftKnee == nil || sizingLeftAnkle == nil || sizingLeftLegIK == nil ||
+		originalLeftLeg == nil || originalLeftKnee == nil || originalLeftAnkle == nil || originalLeftLegIK == nil ||
+		sizingTrunkRoot == nil || originalTrunkRoot == nil {
+		if sizingNeckRoot != nil && originalNeckRoot != nil {
+			// 首根元までの長さ比率
+			neckLengthRatio := sizingNeckRoot.Position.Y / originalNeckRoot.Position.Y
+			return &mmath.MVec3{X: neckLengthRatio, Y: neckLengthRatio, Z: neckLengthRatio}
+		}
+		return &mmath.MVec3{X: 1.0, Y: 1.0, Z: 1.0}
+	}
+
+	// 足の長さ比率(XZ)
+	legLengthScale := (sizingLeftLeg.Position.Distance(sizingLeftKnee.Position) +
+		sizingLeftKnee.Position.Distance(sizingLeftAnkle.Position)) /
+		(originalLeftLeg.Position.Distance(originalLeftKnee.Position) +
+			originalLeftKnee.Position.Distance(originalLeftAnkle.Position))
+	// // 体幹中心までの長さ比率
+	// trunkRootScale := sizingTrunkRoot.Position.Y / originalTrunkRoot.Position.Y
+
+	return &mmath.MVec3{X: legLengthScale, Y: legLengthScale, Z: legLengthScale}
+}
+
 // getFrames 処理対象のフレームを取得する
 func getFrames(motion *vmd.VmdMotion, boneNames []string) []int {
 	frames := motion.BoneFrames.IndexesByNames(boneNames)
@@ -125,7 +196,7 @@ func outputVerboseMotion(title string, motionPath string, motion *vmd.VmdMotion)
 
 // computeVmdDeltas は、各フレームごとのデフォーム結果を並列処理で取得します。
 func computeVmdDeltas(
-	frames []int, blockSize int,
+	ctx context.Context, frames []int, blockSize int,
 	model *pmx.PmxModel, motion *vmd.VmdMotion,
 	sizingSet *domain.SizingSet,
 	isCalcIk bool, target_bone_names []string, logKey string,
@@ -134,8 +205,8 @@ func computeVmdDeltas(
 	allDeltas := make([]*delta.VmdDeltas, len(frames))
 	err := miter.IterParallelByList(frames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			allDeltas[index] = deform.DeformBone(model, motion, motion, isCalcIk, iFrame, target_bone_names)
@@ -156,7 +227,7 @@ func computeVmdDeltas(
 
 // computeVmdDeltasWithDeltas は、各フレームごとのデフォーム結果を並列処理で取得します。
 func computeVmdDeltasWithDeltas(
-	frames []int, blockSize int,
+	ctx context.Context, frames []int, blockSize int,
 	model *pmx.PmxModel, motion *vmd.VmdMotion, allDeltas []*delta.VmdDeltas,
 	sizingSet *domain.SizingSet,
 	isCalcIk bool, target_bone_names []string, logKey string,
@@ -164,8 +235,8 @@ func computeVmdDeltasWithDeltas(
 ) ([]*delta.VmdDeltas, error) {
 	err := miter.IterParallelByList(frames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			allDeltas[index] = deform.DeformBoneWithDeltas(model, motion, allDeltas[index], isCalcIk, iFrame, target_bone_names)
@@ -186,7 +257,7 @@ func computeVmdDeltasWithDeltas(
 
 // computeVmdDeltas は、各フレームごとのボーンモーフだけのデフォーム結果を並列処理で取得します。
 func computeMorphVmdDeltas(
-	frames []int, blockSize int,
+	ctx context.Context, frames []int, blockSize int,
 	model *pmx.PmxModel, motion *vmd.VmdMotion,
 	sizingSet *domain.SizingSet, target_bone_names []string, logKey string,
 	incrementCompletedCount func(),
@@ -194,8 +265,8 @@ func computeMorphVmdDeltas(
 	allDeltas := make([]*delta.VmdDeltas, len(frames))
 	err := miter.IterParallelByList(frames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			allDeltas[index] = deform.DeformBone(model, motion, vmd.InitialMotion, true, iFrame, target_bone_names)
@@ -214,6 +285,79 @@ func computeMorphVmdDeltas(
 	return allDeltas, err
 }
 
+// computeCachedVmdDeltas は、サイジングセットのキャッシュを使ってデフォーム結果を取得します。
+// キャッシュはモーションのハッシュ単位で管理するため、処理中に書き換えるモーションには使用しないでください。
+func computeCachedVmdDeltas(
+	ctx context.Context, frames []int, blockSize int,
+	model *pmx.PmxModel, motion *vmd.VmdMotion,
+	sizingSet *domain.SizingSet,
+	isCalcIk bool, target_bone_names []string, logKey string,
+	incrementCompletedCount func(),
+) ([]*delta.VmdDeltas, error) {
+	key := domain.NewDeltaCacheKey(model, motion, false, isCalcIk)
+	return computeDeltasWithCache(sizingSet, key, frames, target_bone_names, incrementCompletedCount,
+		func(targetFrames []int) ([]*delta.VmdDeltas, error) {
+			return computeVmdDeltas(ctx, targetFrames, blockSize, model, motion, sizingSet,
+				isCalcIk, target_bone_names, logKey, incrementCompletedCount)
+		})
+}
+
+// computeCachedMorphVmdDeltas は、サイジングセットのキャッシュを使ってボーンモーフだけのデフォーム結果を取得します。
+func computeCachedMorphVmdDeltas(
+	ctx context.Context, frames []int, blockSize int,
+	model *pmx.PmxModel, motion *vmd.VmdMotion,
+	sizingSet *domain.SizingSet, target_bone_names []string, logKey string,
+	incrementCompletedCount func(),
+) ([]*delta.VmdDeltas, error) {
+	key := domain.NewDeltaCacheKey(model, motion, true, true)
+	return computeDeltasWithCache(sizingSet, key, frames, target_bone_names, incrementCompletedCount,
+		func(targetFrames []int) ([]*delta.VmdDeltas, error) {
+			return computeMorphVmdDeltas(ctx, targetFrames, blockSize, model, motion, sizingSet,
+				target_bone_names, logKey, incrementCompletedCount)
+		})
+}
+
+// computeDeltasWithCache は、キャッシュにないフレームだけをデフォームし、キャッシュに登録します。
+// キャッシュから取得したフレームも、進捗は1フレームずつ進めます。
+func computeDeltasWithCache(
+	sizingSet *domain.SizingSet, key domain.DeltaCacheKey, frames []int, target_bone_names []string,
+	incrementCompletedCount func(), compute func(targetFrames []int) ([]*delta.VmdDeltas, error),
+) ([]*delta.VmdDeltas, error) {
+	if sizingSet.DeltaCache == nil {
+		return compute(frames)
+	}
+
+	allDeltas := sizingSet.DeltaCache.Get(key, target_bone_names, frames)
+
+	missingIndexes := make([]int, 0)
+	missingFrames := make([]int, 0)
+	for i, frame := range frames {
+		if allDeltas[i] == nil {
+			missingIndexes = append(missingIndexes, i)
+			missingFrames = append(missingFrames, frame)
+		} else if incrementCompletedCount != nil {
+			incrementCompletedCount()
+		}
+	}
+
+	if len(missingFrames) == 0 {
+		return allDeltas, nil
+	}
+
+	missingDeltas, err := compute(missingFrames)
+	if err != nil {
+		return nil, err
+	}
+
+	sizingSet.DeltaCache.Set(key, target_bone_names, missingFrames, missingDeltas)
+
+	for i, index := range missingIndexes {
+		allDeltas[index] = missingDeltas[i]
+	}
+
+	return allDeltas, nil
+}
+
 type debugTarget int
 
 const (
@@ -337,77 +481,79 @@ func checkBones(
 	sizingDirectionChecks []domain.CheckDirectionBoneType,
 ) error {
 	var err error
-	errorMessage := make([]string, 0)
+	missingBones := make([]*SizingMissingBone, 0)
+
+	appendMissingBone := func(modelType, boneName string, isStandard bool) {
+		keyName := "ボーン不足エラー"
+		if !isStandard {
+			keyName = "検証ボーン不足エラー"
+		}
+		modelTypeName := "元モデル"
+		modelName := sizingSet.OriginalModelName
+		if modelType == SizingReportSizingModel {
+			modelTypeName = "先モデル"
+			modelName = sizingSet.OutputModelName
+		}
+		message := mi18n.T(keyName, map[string]any{
+			"Process": mi18n.T("足補正"), "No": sizingSet.Index + 1,
+			"ModelType": modelTypeName, "BoneName": boneName})
+		mlog.WT(mi18n.T("ボーン不足"), message)
+		missingBones = append(missingBones, &SizingMissingBone{
+			ModelType: modelType, ModelName: modelName, BoneName: boneName})
+		err = merr.NewNameNotFoundError(boneName, message)
+	}
 
 	for _, v := range originalTrunkChecks {
 		if v.CheckFunk() == nil {
-			keyName := "ボーン不足エラー"
-			if !v.IsStandard() {
-				keyName = "検証ボーン不足エラー"
-			}
-			message := mi18n.T(keyName, map[string]any{
-				"Process": mi18n.T("足補正"), "No": sizingSet.Index + 1,
-				"ModelType": "元モデル", "BoneName": v.BoneName.String()})
-			mlog.WT(mi18n.T("ボーン不足"), message)
-			errorMessage = append(errorMessage, message)
-			err = merr.NewNameNotFoundError(v.BoneName.String(), message)
+			appendMissingBone(SizingReportOriginalModel, v.BoneName.String(), v.IsStandard())
 		}
 	}
 
 	for _, v := range originalDirectionChecks {
 		for _, direction := range directions {
 			if v.CheckFunk(direction) == nil {
-				keyName := "ボーン不足エラー"
-				if !v.IsStandard(direction) {
-					keyName = "検証ボーン不足エラー"
-				}
-				message := mi18n.T(keyName, map[string]any{
-					"Process": mi18n.T("足補正"), "No": sizingSet.Index + 1,
-					"ModelType": "元モデル", "BoneName": v.BoneName.StringFromDirection(direction)})
-				mlog.WT(mi18n.T("ボーン不足"), message)
-				errorMessage = append(errorMessage, message)
-				err = merr.NewNameNotFoundError(v.BoneName.StringFromDirection(direction), message)
+				appendMissingBone(SizingReportOriginalModel,
+					v.BoneName.StringFromDirection(direction), v.IsStandard(direction))
 			}
 		}
 	}
 
 	for _, v := range sizingTrunkChecks {
 		if v.CheckFunk() == nil {
-			keyName := "ボーン不足エラー"
-			if !v.IsStandard() {
-				keyName = "検証ボーン不足エラー"
-			}
-			message := mi18n.T(keyName, map[string]any{
-				"Process": mi18n.T("足補正"), "No": sizingSet.Index + 1,
-				"ModelType": "先モデル", "BoneName": v.BoneName.String()})
-			mlog.WT(mi18n.T("ボーン不足"), message)
-			errorMessage = append(errorMessage, message)
-			err = merr.NewNameNotFoundError(v.BoneName.String(), message)
+			appendMissingBone(SizingReportSizingModel, v.BoneName.String(), v.IsStandard())
 		}
 	}
 
 	for _, v := range sizingDirectionChecks {
 		for _, direction := range directions {
 			if v.CheckFunk(direction) == nil {
-				keyName := "ボーン不足エラー"
-				if !v.IsStandard(direction) {
-					keyName = "検証ボーン不足エラー"
-				}
-				message := mi18n.T(keyName, map[string]any{
-					"Process": mi18n.T("足補正"), "No": sizingSet.Index + 1,
-					"ModelType": "先モデル", "BoneName": v.BoneName.StringFromDirection(direction)})
-				mlog.WT(mi18n.T("ボーン不足"), message)
-				errorMessage = append(errorMessage, message)
-				err = merr.NewNameNotFoundError(v.BoneName.StringFromDirection(direction), message)
+				appendMissingBone(SizingReportSizingModel,
+					v.BoneName.StringFromDirection(direction), v.IsStandard(direction))
 			}
 		}
 	}
 
-	return err
+	if len(missingBones) == 0 {
+		return nil
+	}
+
+	return &MissingBonesError{MissingBones: missingBones, err: err}
 }
 
 type ISizingUsecase interface {
-	Exec(sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func()) (bool, error)
+	Exec(ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func()) (bool, error)
+}
+
+// checkTerminate は、処理の中断・タイムアウトを確認します。
+// 中断された場合は TerminateError を、期限切れの場合は context のエラーをそのまま返します。
+func checkTerminate(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return merr.NewTerminateError("manual terminate")
+		}
+		return err
+	}
+	return nil
 }
 
 // ログはCPUのサイズに応じて可変でブロッキングして出力する
@@ -447,6 +593,12 @@ var trunk_upper_bone_names = []string{
 	pmx.UPPER_ROOT.String(), pmx.UPPER.String(), pmx.UPPER2.String(), pmx.NECK_ROOT.String(),
 	pmx.SHOULDER.Left(), pmx.SHOULDER.Right(), pmx.ARM.Left(), pmx.ARM.Right(), pmx.NECK.String()}
 
+// 元モーションのデフォーム対象ボーン名（足系の補正でキャッシュを共有する）
+// キャッシュは対象ボーンを全て含む結果を使い回すので、他の補正は必要なボーンだけ指定すれば良い
+var shared_original_bone_names = uniqueBoneNames(
+	all_lower_leg_bone_names, trunk_upper_bone_names, all_arm_bone_names[0], all_arm_bone_names[1],
+	[]string{pmx.HEAD.String()})
+
 // 腕系ボーン名（左右別）
 var all_arm_stance_bone_names = [][]string{
 	{pmx.ARM.Left(), pmx.ELBOW.Left(), pmx.WRIST.Left(), pmx.WRIST_TAIL.Left(),
@@ -470,3 +622,80 @@ var all_arm_bone_names = [][]string{
 	{pmx.TRUNK_ROOT.String(), pmx.NECK_ROOT.String(), pmx.SHOULDER.Right(),
 		pmx.ARM.Right(), pmx.ELBOW.Right(), pmx.WRIST.Right(), pmx.WRIST_TAIL.Right()},
 }
+
+// 捩り系ボーン名（左右別）
+var all_arm_twist_bone_names = [][]string{
+	{pmx.ARM.Left(), pmx.ARM_TWIST.Left(), pmx.ELBOW.Left(), pmx.WRIST_TWIST.Left(),
+		pmx.WRIST.Left(), pmx.WRIST_TAIL.Left()},
+	{pmx.ARM.Right(), pmx.ARM_TWIST.Right(), pmx.ELBOW.Right(), pmx.WRIST_TWIST.Right(),
+		pmx.WRIST.Right(), pmx.WRIST_TAIL.Right()},
+}
+
+// easeInOut は 0-1 の値を、両端がなめらかになるように補間します。
+func easeInOut(t float64) float64 {
+	t = max(0, min(1, t))
+	return t * t * (3 - 2*t)
+}
+
+// easeContactValues は接触区間外の補正量を、前後の接触区間の端の補正量から徐々に0に近付けた値で埋めます。
+// 前後両方の接触区間から埋まるフレームは、近い方の区間の端の補正量を使う(同じ距離の場合は前の区間)
+// scale は補正量に 0-1 の重みを掛けた値を返す
+func easeContactValues[T any](
+	values []T, contactFlags []bool, easeFrames int, scale func(value T, weight float64) T,
+) []T {
+	easedValues := make([]T, len(values))
+	copy(easedValues, values)
+	easedWeights := make([]float64, len(values))
+
+	for index := range values {
+		if !contactFlags[index] {
+			continue
+		}
+		for _, step := range []int{-1, 1} {
+			for k := 1; k <= easeFrames; k++ {
+				i := index + step*k
+				if i < 0 || i >= len(values) || contactFlags[i] {
+					break
+				}
+				weight := easeInOut(1 - float64(k)/float64(easeFrames+1))
+				if weight > easedWeights[i] {
+					easedValues[i] = scale(values[index], weight)
+					easedWeights[i] = weight
+				}
+			}
+		}
+	}
+
+	return easedValues
+}
+
+// scaleDiff は easeContactValues 用に、補正量に重みを掛けます。
+func scaleDiff(diff float64, weight float64) float64 {
+	return diff * weight
+}
+
+// scaleOffset は easeContactValues 用に、移動量に重みを掛けます。
+func scaleOffset(offset *mmath.MVec3, weight float64) *mmath.MVec3 {
+	return offset.MuledScalar(weight)
+}
+
+// scaleRotation は easeContactValues 用に、回転量に重みを掛けます。
+func scaleRotation(rotation *mmath.MQuaternion, weight float64) *mmath.MQuaternion {
+	return mmath.NewMQuaternion().Slerp(rotation, weight)
+}
+
+// uniqueBoneNames は、ボーン名リストを重複なしで結合します。
+func uniqueBoneNames(boneNamesList ...[]string) []string {
+	boneNames := make([]string, 0)
+	exists := make(map[string]struct{})
+	for _, names := range boneNamesList {
+		for _, name := range names {
+			if _, ok := exists[name]; ok {
+				continue
+			}
+			exists[name] = struct{}{}
+			boneNames = append(boneNames, name)
+		}
+	}
+	return boneNames
+}
@@ -0,0 +1,465 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// arm_collision_margin 体の剛体から、腕を余分に離す距離
+const arm_collision_margin = 0.05
+
+// arm_collision_shoulder_ratio 腕を押し出す回転のうち、肩で受け持つ割合
+const arm_collision_shoulder_ratio = 0.2
+
+// arm_collision_ease_frames 貫通区間の前後で、補正量を徐々に切り替えるフレーム数
+const arm_collision_ease_frames = 3
+
+// arm_collision_arm_root_ratio 腕のカプセルのうち、付け根側で判定から外す割合(付け根は上半身の剛体と常に接しているため)
+const arm_collision_arm_root_ratio = 0.3
+
+// arm_collision_default_radii 腕・ひじ・手首に剛体が無い場合の、カプセルの半径
+var arm_collision_default_radii = []float64{0.5, 0.4, 0.3}
+
+// arm_collision_trunk_bone_names 貫通判定の対象とする剛体が紐付く体幹ボーン名
+var arm_collision_trunk_bone_names = []string{
+	pmx.UPPER.String(), pmx.UPPER2.String(), pmx.LOWER.String(),
+}
+
+// arm_collision_stop_bone_names 体幹の剛体を親ボーンから探す時に、ここで打ち切るボーン名(袖・髪・脚などを除くため)
+var arm_collision_stop_bone_names = []string{
+	pmx.NECK.String(), pmx.HEAD.String(),
+	pmx.SHOULDER.Left(), pmx.ARM.Left(), pmx.ELBOW.Left(), pmx.WRIST.Left(),
+	pmx.SHOULDER.Right(), pmx.ARM.Right(), pmx.ELBOW.Right(), pmx.WRIST.Right(),
+	pmx.LEG_ROOT.Left(), pmx.LEG.Left(), pmx.KNEE.Left(), pmx.ANKLE.Left(),
+	pmx.LEG_D.Left(), pmx.KNEE_D.Left(), pmx.ANKLE_D.Left(),
+	pmx.LEG_ROOT.Right(), pmx.LEG.Right(), pmx.KNEE.Right(), pmx.ANKLE.Right(),
+	pmx.LEG_D.Right(), pmx.KNEE_D.Right(), pmx.ANKLE_D.Right(),
+}
+
+// arm_collision_bone_names 腕貫通回避でデフォームするボーン名
+var arm_collision_bone_names = uniqueBoneNames(
+	trunk_upper_bone_names, []string{pmx.LOWER.String()}, all_arm_bone_names[0], all_arm_bone_names[1])
+
+// collisionCapsule 貫通判定用のカプセル(半径0の線分の場合は球)
+type collisionCapsule struct {
+	boneName string       // 紐付くボーン名
+	start    *mmath.MVec3 // 線分の始点(ボーン位置からの相対位置)
+	end      *mmath.MVec3 // 線分の終点(ボーン位置からの相対位置)
+	radius   float64      // 半径
+}
+
+// globalSegment はボーンのデフォーム結果から、カプセルの線分のグローバル位置を求めます。
+func (capsule *collisionCapsule) globalSegment(vmdDeltas *delta.VmdDeltas) (start, end *mmath.MVec3, ok bool) {
+	boneDelta := vmdDeltas.Bones.GetByName(capsule.boneName)
+	if boneDelta == nil {
+		return nil, nil, false
+	}
+	globalMatrix := boneDelta.FilledGlobalMatrix()
+	return globalMatrix.MulVec3(capsule.start), globalMatrix.MulVec3(capsule.end), true
+}
+
+type SizingArmCollisionUsecase struct {
+}
+
+func NewSizingArmCollisionUsecase() *SizingArmCollisionUsecase {
+	return &SizingArmCollisionUsecase{}
+}
+
+// Exec はサイジング先モデルの体幹の剛体に、腕・ひじ・手首のカプセルがめり込んでいるフレームで、
+// めり込まなくなるまで、腕と肩を最小限回転させて外側に押し出します。
+func (su *SizingArmCollisionUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingArmCollision || sizingSet.CompletedSizingArmCollision {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	trunkCapsules := su.createTrunkCapsules(sizingSet)
+	if len(trunkCapsules) == 0 {
+		// 体幹に剛体が無い場合は補正しない
+		sizingSet.CompletedSizingArmCollision = true
+		return false, nil
+	}
+
+	mlog.I(mi18n.T("腕貫通回避開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, arm_collision_bone_names, "腕貫通回避01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	armCapsules := make([][]*collisionCapsule, len(directions))
+	pushRotations := make([][]*mmath.MQuaternion, len(directions))
+	collisionFlags := make([][]bool, len(directions))
+	for d, direction := range directions {
+		armCapsules[d] = su.createArmCapsules(sizingSet, direction)
+		pushRotations[d] = make([]*mmath.MQuaternion, len(allFrames))
+		collisionFlags[d] = make([]bool, len(allFrames))
+	}
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for d, direction := range directions {
+				pushRotations[d][index] = su.calculatePushRotation(
+					sizingSet, direction, sizingAllDeltas[index], armCapsules[d], trunkCapsules)
+				collisionFlags[d][index] = pushRotations[d][index] != nil
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("腕貫通回避02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return false, err
+	}
+
+	// 回転の加算元として、補正前のモーションを残しておく
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	isExec := false
+	for d, direction := range directions {
+		rotations := easeContactValues(pushRotations[d], collisionFlags[d], arm_collision_ease_frames, scaleRotation)
+		if su.updateOutputMotion(sizingSet, sizingProcessMotion, direction, allFrames, sizingAllDeltas, rotations) {
+			isExec = true
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("腕貫通回避03", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	incrementCompletedCount()
+
+	sizingSet.CompletedSizingArmCollision = true
+
+	return isExec, nil
+}
+
+// createTrunkCapsules はサイジング先モデルの体幹(上半身・上半身2・下半身)に紐付く剛体を、カプセルに変換します。
+// スカートなどの物理剛体は、親を辿って見つかった体幹ボーンに、初期姿勢のまま追従するものとして扱う
+// 箱剛体は、剛体のY軸を軸としたカプセルで近似する
+func (su *SizingArmCollisionUsecase) createTrunkCapsules(sizingSet *domain.SizingSet) []*collisionCapsule {
+	model := sizingSet.SizingConfigModel
+
+	trunkBoneIndexes := make(map[int]string)
+	for _, boneName := range arm_collision_trunk_bone_names {
+		if bone, err := model.Bones.GetByName(boneName); err == nil && bone != nil {
+			trunkBoneIndexes[bone.Index()] = boneName
+		}
+	}
+
+	stopBoneIndexes := make(map[int]bool)
+	for _, boneName := range arm_collision_stop_bone_names {
+		if bone, err := model.Bones.GetByName(boneName); err == nil && bone != nil {
+			stopBoneIndexes[bone.Index()] = true
+		}
+	}
+
+	capsules := make([]*collisionCapsule, 0)
+	model.RigidBodies.ForEach(func(index int, rigidBody *pmx.RigidBody) bool {
+		boneName, ok := su.findTrunkBoneName(model, rigidBody.BoneIndex, trunkBoneIndexes, stopBoneIndexes)
+		if !ok {
+			return true
+		}
+		if capsule := newRigidBodyCapsule(model, rigidBody, boneName); capsule != nil {
+			capsules = append(capsules, capsule)
+		}
+		return true
+	})
+
+	return capsules
+}
+
+// findTrunkBoneName はボーンから親を辿り、最初に見つかった体幹ボーン名を返します。
+// 首・腕・足などの打ち切りボーンを先に通る場合は、体幹の剛体ではないものとする
+func (su *SizingArmCollisionUsecase) findTrunkBoneName(
+	model *pmx.PmxModel, boneIndex int, trunkBoneIndexes map[int]string, stopBoneIndexes map[int]bool,
+) (string, bool) {
+	visited := make(map[int]bool)
+	for boneIndex >= 0 && !visited[boneIndex] {
+		visited[boneIndex] = true
+
+		if boneName, ok := trunkBoneIndexes[boneIndex]; ok {
+			return boneName, true
+		}
+		if stopBoneIndexes[boneIndex] {
+			return "", false
+		}
+
+		bone, err := model.Bones.Get(boneIndex)
+		if err != nil || bone == nil {
+			return "", false
+		}
+		boneIndex = bone.ParentIndex
+	}
+
+	return "", false
+}
+
+// createArmCapsules はサイジング先モデルの腕・ひじ・手首を、ボーンの間を軸としたカプセルに変換します。
+// 半径は紐付く剛体があればその大きさ、無ければ既定値とする
+func (su *SizingArmCollisionUsecase) createArmCapsules(
+	sizingSet *domain.SizingSet, direction pmx.BoneDirection,
+) []*collisionCapsule {
+	bones := []*pmx.Bone{
+		sizingSet.SizingArmBone(direction),
+		sizingSet.SizingElbowBone(direction),
+		sizingSet.SizingWristBone(direction),
+		sizingSet.SizingWristTailBone(direction),
+	}
+
+	capsules := make([]*collisionCapsule, 0, len(bones)-1)
+	for i, bone := range bones[:len(bones)-1] {
+		nextBone := bones[i+1]
+		if bone == nil || nextBone == nil {
+			continue
+		}
+
+		radius := arm_collision_default_radii[i]
+		sizingSet.SizingConfigModel.RigidBodies.ForEach(func(index int, rigidBody *pmx.RigidBody) bool {
+			if rigidBody.BoneIndex != bone.Index() || rigidBody.Size == nil {
+				return true
+			}
+			if rigidBody.ShapeType == pmx.SHAPE_SPHERE || rigidBody.ShapeType == pmx.SHAPE_CAPSULE {
+				radius = rigidBody.Size.X
+				return false
+			}
+			return true
+		})
+
+		segment := nextBone.Position.Subed(bone.Position)
+		start := mmath.NewMVec3()
+		if i == 0 {
+			start = segment.MuledScalar(arm_collision_arm_root_ratio)
+		}
+
+		capsules = append(capsules, &collisionCapsule{
+			boneName: bone.Name(),
+			start:    start,
+			end:      segment,
+			radius:   radius,
+		})
+	}
+
+	return capsules
+}
+
+// newRigidBodyCapsule は剛体を、紐付くボーンからの相対位置のカプセルに変換します。
+func newRigidBodyCapsule(model *pmx.PmxModel, rigidBody *pmx.RigidBody, boneName string) *collisionCapsule {
+	bone, err := model.Bones.GetByName(boneName)
+	if err != nil || bone == nil || rigidBody.Size == nil || rigidBody.Position == nil || rigidBody.Rotation == nil {
+		return nil
+	}
+
+	var radius, halfHeight float64
+	switch rigidBody.ShapeType {
+	case pmx.SHAPE_SPHERE:
+		radius = rigidBody.Size.X
+	case pmx.SHAPE_CAPSULE:
+		radius = rigidBody.Size.X
+		halfHeight = rigidBody.Size.Y / 2
+	case pmx.SHAPE_BOX:
+		// 箱に内接するカプセルにする(幅広で薄い胸の箱の前にある腕を、めり込んでいると判定しないように)
+		radius = min(rigidBody.Size.X, rigidBody.Size.Z)
+		halfHeight = max(0, rigidBody.Size.Y-radius)
+	default:
+		return nil
+	}
+
+	rotation := mmath.NewMQuaternionFromRadians(rigidBody.Rotation.X, rigidBody.Rotation.Y, rigidBody.Rotation.Z)
+	axis := rotation.MulVec3(mmath.MVec3UnitY).MuledScalar(halfHeight)
+	center := rigidBody.Position.Subed(bone.Position)
+
+	return &collisionCapsule{
+		boneName: boneName,
+		start:    center.Subed(axis),
+		end:      center.Added(axis),
+		radius:   radius,
+	}
+}
+
+// calculatePushRotation は腕のカプセルが一番深くめり込んでいる点を、体の剛体の外側に押し出すための、
+// 腕の付け根を中心としたグローバル回転を求めます。
+// めり込んでいない場合はnilを返す
+func (su *SizingArmCollisionUsecase) calculatePushRotation(
+	sizingSet *domain.SizingSet, direction pmx.BoneDirection, vmdDeltas *delta.VmdDeltas,
+	armCapsules, trunkCapsules []*collisionCapsule,
+) *mmath.MQuaternion {
+	maxDepth := 0.0
+	var contactPosition, pushDirection *mmath.MVec3
+
+	for _, armCapsule := range armCapsules {
+		armStart, armEnd, ok := armCapsule.globalSegment(vmdDeltas)
+		if !ok {
+			continue
+		}
+		for _, trunkCapsule := range trunkCapsules {
+			trunkStart, trunkEnd, ok := trunkCapsule.globalSegment(vmdDeltas)
+			if !ok {
+				continue
+			}
+
+			armPoint, trunkPoint := closestPointsBetweenSegments(armStart, armEnd, trunkStart, trunkEnd)
+			depth := armCapsule.radius + trunkCapsule.radius + arm_collision_margin - armPoint.Distance(trunkPoint)
+			if depth <= maxDepth {
+				continue
+			}
+
+			normal := armPoint.Subed(trunkPoint)
+			if mmath.NearEquals(normal.Length(), 0, 1e-6) {
+				// 軸同士が交差している場合は、剛体の軸から水平方向に押し出す
+				normal = armEnd.Subed(trunkStart)
+				normal.Y = 0
+				if mmath.NearEquals(normal.Length(), 0, 1e-6) {
+					continue
+				}
+			}
+
+			maxDepth = depth
+			contactPosition = armPoint
+			pushDirection = normal.Normalized()
+		}
+	}
+
+	if contactPosition == nil {
+		return nil
+	}
+
+	armPosition := vmdDeltas.Bones.GetByName(sizingSet.SizingArmBone(direction).Name()).FilledGlobalPosition()
+	fromDirection := contactPosition.Subed(armPosition)
+	toDirection := fromDirection.Added(pushDirection.MuledScalar(maxDepth))
+	if mmath.NearEquals(fromDirection.Length(), 0, 1e-6) {
+		return nil
+	}
+
+	return mmath.NewMQuaternionRotate(fromDirection.Normalized(), toDirection.Normalized())
+}
+
+// updateOutputMotion は押し出すためのグローバル回転を、肩と腕のローカル回転に振り分けて、出力モーションに反映します。
+// 元の回転は補正前のモーションから取得する(出力モーションから取得すると、直前のフレームの補正が補間で漏れる)
+func (su *SizingArmCollisionUsecase) updateOutputMotion(
+	sizingSet *domain.SizingSet, sizingProcessMotion *vmd.VmdMotion, direction pmx.BoneDirection, allFrames []int,
+	sizingAllDeltas []*delta.VmdDeltas, pushRotations []*mmath.MQuaternion,
+) bool {
+	shoulderBone := sizingSet.SizingShoulderBone(direction)
+	armBone := sizingSet.SizingArmBone(direction)
+
+	isExec := false
+	for index, iFrame := range allFrames {
+		if pushRotations[index] == nil {
+			continue
+		}
+
+		frame := float32(iFrame)
+		vmdDeltas := sizingAllDeltas[index]
+
+		shoulderPushRotation := mmath.NewMQuaternion().Slerp(pushRotations[index], arm_collision_shoulder_ratio)
+		armPushRotation := pushRotations[index].Muled(shoulderPushRotation.Inverted())
+
+		// 肩: 親のグローバル回転で、押し出す回転をローカルに変換する
+		shoulderParentQuat := vmdDeltas.Bones.Get(shoulderBone.ParentIndex).FilledGlobalMatrix().Quaternion()
+		shoulderBf := sizingSet.OutputMotion.BoneFrames.Get(shoulderBone.Name()).Get(frame)
+		shoulderBf.Rotation = shoulderParentQuat.Inverted().Muled(shoulderPushRotation).Muled(shoulderParentQuat).
+			Muled(sizingProcessMotion.BoneFrames.Get(shoulderBone.Name()).Get(frame).FilledRotation())
+		sizingSet.OutputMotion.InsertBoneFrame(shoulderBone.Name(), shoulderBf)
+
+		// 腕: 肩を回した分、親のグローバル回転も回っている
+		armParentQuat := shoulderPushRotation.Muled(
+			vmdDeltas.Bones.Get(armBone.ParentIndex).FilledGlobalMatrix().Quaternion())
+		armBf := sizingSet.OutputMotion.BoneFrames.Get(armBone.Name()).Get(frame)
+		armBf.Rotation = armParentQuat.Inverted().Muled(armPushRotation).Muled(armParentQuat).
+			Muled(sizingProcessMotion.BoneFrames.Get(armBone.Name()).Get(frame).FilledRotation())
+		sizingSet.OutputMotion.InsertBoneFrame(armBone.Name(), armBf)
+
+		isExec = true
+
+		if index > 0 && index%1000 == 0 {
+			processLog("腕貫通回避03", sizingSet.Index, index, len(allFrames))
+		}
+	}
+
+	return isExec
+}
+
+// closestPointsBetweenSegments は2つの線分の、互いに最も近い点を求めます。
+func closestPointsBetweenSegments(start1, end1, start2, end2 *mmath.MVec3) (point1, point2 *mmath.MVec3) {
+	d1 := end1.Subed(start1)
+	d2 := end2.Subed(start2)
+	r := start1.Subed(start2)
+	a := d1.Dot(d1)
+	e := d2.Dot(d2)
+	f := d2.Dot(r)
+
+	var s, t float64
+	switch {
+	case a <= 1e-8 && e <= 1e-8:
+		return start1, start2
+	case a <= 1e-8:
+		t = max(0, min(1, f/e))
+	default:
+		c := d1.Dot(r)
+		if e <= 1e-8 {
+			s = max(0, min(1, -c/a))
+		} else {
+			b := d1.Dot(d2)
+			denom := a*e - b*b
+			if denom > 1e-8 {
+				s = max(0, min(1, (b*f-c*e)/denom))
+			}
+			t = (b*s + f) / e
+			if t < 0 {
+				t = 0
+				s = max(0, min(1, -c/a))
+			} else if t > 1 {
+				t = 1
+				s = max(0, min(1, (b-c)/a))
+			}
+		}
+	}
+
+	return start1.Added(d1.MuledScalar(s)), start2.Added(d2.MuledScalar(t))
+}
+
+func (su *SizingArmCollisionUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingUpperBone, BoneName: pmx.UPPER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingShoulderBone, BoneName: pmx.SHOULDER},
+			{CheckFunk: sizingSet.SizingArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.SizingElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.SizingWristBone, BoneName: pmx.WRIST},
+		},
+	)
+}
@@ -1,11 +1,11 @@
 package usecase
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
 
-	"github.com/miu200521358/mlib_go/pkg/config/merr"
 	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
 	"github.com/miu200521358/mlib_go/pkg/config/mlog"
 	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
@@ -22,7 +22,7 @@ func NewSizingArmStanceUsecase() *SizingArmStanceUsecase {
 }
 
 func (su *SizingArmStanceUsecase) Exec(
-	sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
 ) (bool, error) {
 	// 対象外の場合は何もせず終了
 	if (!sizingSet.IsSizingArmStance || sizingSet.CompletedSizingArmStance) &&
@@ -37,12 +37,12 @@ func (su *SizingArmStanceUsecase) Exec(
 
 	mlog.I(mi18n.T("腕指スタンス補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
 
-	stanceRotations, err := su.createArmFingerStanceRotations(sizingSet)
+	stanceRotations, err := su.createArmFingerStanceRotations(ctx, sizingSet)
 	if err != nil {
 		return false, err
 	}
 
-	if err := su.updateStanceRotations(sizingSet, stanceRotations, incrementCompletedCount); err != nil {
+	if err := su.updateStanceRotations(ctx, sizingSet, stanceRotations, incrementCompletedCount); err != nil {
 		return false, err
 	}
 
@@ -58,7 +58,7 @@ func (su *SizingArmStanceUsecase) Exec(
 }
 
 func (su *SizingArmStanceUsecase) updateStanceRotations(
-	sizingSet *domain.SizingSet, stanceRotations map[int][]*mmath.MMat4, incrementCompletedCount func(),
+	ctx context.Context, sizingSet *domain.SizingSet, stanceRotations map[int][]*mmath.MMat4, incrementCompletedCount func(),
 ) (err error) {
 	count := int(sizingSet.OutputMotion.MaxFrame()) + 1
 
@@ -87,7 +87,7 @@ func (su *SizingArmStanceUsecase) updateStanceRotations(
 				}
 
 				sizingSet.OutputMotion.BoneFrames.Get(boneName).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
-					if sizingSet.IsTerminate {
+					if ctx.Err() != nil {
 						return false
 					}
 
@@ -100,8 +100,8 @@ func (su *SizingArmStanceUsecase) updateStanceRotations(
 					return true
 				})
 
-				if sizingSet.IsTerminate {
-					return merr.NewTerminateError("manual terminate")
+				if err := checkTerminate(ctx); err != nil {
+					return err
 				}
 			}
 
@@ -121,7 +121,7 @@ func (su *SizingArmStanceUsecase) updateStanceRotations(
 	for boneName, rotations := range boneRotations {
 		maxFrame := int(sizingSet.OutputMotion.BoneFrames.Get(boneName).MaxFrame())
 		sizingSet.OutputMotion.BoneFrames.Get(boneName).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
-			if sizingSet.IsTerminate {
+			if ctx.Err() != nil {
 				return false
 			}
 
@@ -147,6 +147,10 @@ func (su *SizingArmStanceUsecase) updateStanceRotations(
 		})
 	}
 
+	if err := checkTerminate(ctx); err != nil {
+		return err
+	}
+
 	if mlog.IsDebug() {
 		outputVerboseMotion("腕01", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
 	}
@@ -156,18 +160,18 @@ func (su *SizingArmStanceUsecase) updateStanceRotations(
 	return nil
 }
 
-func (su *SizingArmStanceUsecase) createArmFingerStanceRotations(sizingSet *domain.SizingSet) (stanceRotations map[int][]*mmath.MMat4, err error) {
+func (su *SizingArmStanceUsecase) createArmFingerStanceRotations(ctx context.Context, sizingSet *domain.SizingSet) (stanceRotations map[int][]*mmath.MMat4, err error) {
 	stanceRotations = make(map[int][]*mmath.MMat4)
 
 	for i, direction := range directions {
 		stanceBoneNames := make([][]string, 0)
 
-		originalVmdDeltas, err := computeVmdDeltas([]int{0}, 1, sizingSet.OriginalConfigModel, vmd.InitialMotion, sizingSet, true, all_arm_stance_bone_names[i], "", nil)
+		originalVmdDeltas, err := computeVmdDeltas(ctx, []int{0}, 1, sizingSet.OriginalConfigModel, vmd.InitialMotion, sizingSet, true, all_arm_stance_bone_names[i], "", nil)
 		if err != nil {
 			return nil, err
 		}
 
-		sizingVmdDeltas, err := computeVmdDeltas([]int{0}, 1, sizingSet.SizingConfigModel, vmd.InitialMotion, sizingSet, true, all_arm_stance_bone_names[i], "", nil)
+		sizingVmdDeltas, err := computeVmdDeltas(ctx, []int{0}, 1, sizingSet.SizingConfigModel, vmd.InitialMotion, sizingSet, true, all_arm_stance_bone_names[i], "", nil)
 
 		if sizingSet.IsSizingArmStance {
 			// 腕スタンス補正対象
@@ -0,0 +1,297 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/merr"
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+type SizingArmTwistUsecase struct {
+}
+
+func NewSizingArmTwistUsecase() *SizingArmTwistUsecase {
+	return &SizingArmTwistUsecase{}
+}
+
+// twistRotations 捩り分散後の腕系ボーンの回転
+type twistRotations struct {
+	arm        *mmath.MQuaternion
+	armTwist   *mmath.MQuaternion
+	elbow      *mmath.MQuaternion
+	wristTwist *mmath.MQuaternion
+}
+
+// Exec は腕と肘の捩り成分を腕捩・手捩に振り分けます。
+func (su *SizingArmTwistUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingArmTwist || sizingSet.CompletedSizingArmTwist {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("捩り補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	// 捩り分散前のモーション
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	for dIndex, direction := range directions {
+		// 捩り分散前の腕の変形情報
+		processAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+			sizingProcessMotion, sizingSet, true, all_arm_twist_bone_names[dIndex], "", incrementCompletedCount)
+		if err != nil {
+			return false, err
+		}
+
+		mlog.I(mi18n.T("捩り補正01", map[string]interface{}{
+			"No": sizingSet.Index + 1, "Direction": direction.String(),
+			"IterIndex": fmt.Sprintf("%04d", len(allFrames)), "AllCount": fmt.Sprintf("%04d", len(allFrames))}))
+
+		// キーフレームがある箇所だけ振り分ける
+		keyFrames := getFrames(sizingProcessMotion, all_arm_twist_bone_names[dIndex][:4])
+		if err := su.updateTwistRotations(ctx, sizingSet, direction, keyFrames, sizingProcessMotion); err != nil {
+			return false, err
+		}
+
+		if err := su.updateOutputMotion(ctx, sizingSet, direction, dIndex, allFrames, blockSize,
+			sizingProcessMotion, processAllDeltas, incrementCompletedCount); err != nil {
+			return false, err
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("捩05", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	sizingSet.CompletedSizingArmTwist = true
+
+	return true, nil
+}
+
+// calculateTwistRotations は指定フレームの腕系ボーンの回転から捩りを分離して振り分けます。
+func (su *SizingArmTwistUsecase) calculateTwistRotations(
+	sizingSet *domain.SizingSet, direction pmx.BoneDirection, motion *vmd.VmdMotion, frame float32,
+) *twistRotations {
+	armTwistBone := sizingSet.SizingArmTwistBone(direction)
+	wristTwistBone := sizingSet.SizingWristTwistBone(direction)
+
+	armAxis := su.twistAxis(armTwistBone, sizingSet.SizingArmBone(direction), sizingSet.SizingElbowBone(direction))
+	elbowAxis := su.twistAxis(wristTwistBone, sizingSet.SizingElbowBone(direction), sizingSet.SizingWristBone(direction))
+
+	armQuat := motion.BoneFrames.Get(pmx.ARM.StringFromDirection(direction)).Get(frame).FilledRotation()
+	armTwistQuat := motion.BoneFrames.Get(armTwistBone.Name()).Get(frame).FilledRotation()
+	elbowQuat := motion.BoneFrames.Get(pmx.ELBOW.StringFromDirection(direction)).Get(frame).FilledRotation()
+	wristTwistQuat := motion.BoneFrames.Get(wristTwistBone.Name()).Get(frame).FilledRotation()
+
+	// 腕: 捩り成分を腕捩に移す
+	armTwistOffsetQuat, _ := armQuat.SeparateTwistByAxis(armAxis)
+	armSwingQuat := armQuat.Muled(armTwistOffsetQuat.Inverted())
+
+	// ひじ: 捩り成分を手捩に移す
+	elbowTwistOffsetQuat, _ := elbowQuat.SeparateTwistByAxis(elbowAxis)
+	elbowSwingQuat := elbowQuat.Muled(elbowTwistOffsetQuat.Inverted())
+
+	// ひじの曲げをY回転(曲げ軸周り)のみに限定する
+	// 曲げ軸からずれている分は、捩り軸周りの回転として腕捩と手捩で打ち消し合うように振り分ける
+	bendAxis := elbowAxis.Cross(&mmath.MVec3{X: 0, Y: 0, Z: -1}).Normalized()
+	bendAngle := 0.0
+	bendOffsetAngle := 0.0
+	if !elbowSwingQuat.IsIdent() {
+		swingAxis, swingAngle := elbowSwingQuat.ToAxisAngle()
+		bendAngle = swingAngle
+		bendOffsetAngle = math.Atan2(elbowAxis.Dot(bendAxis.Cross(swingAxis)), bendAxis.Dot(swingAxis))
+
+		// 曲げ軸と逆向きの場合、角度を反転させて捩り量を最小にする
+		if bendOffsetAngle > math.Pi/2 {
+			bendOffsetAngle -= math.Pi
+			bendAngle = -bendAngle
+		} else if bendOffsetAngle < -math.Pi/2 {
+			bendOffsetAngle += math.Pi
+			bendAngle = -bendAngle
+		}
+	}
+
+	return &twistRotations{
+		arm: armSwingQuat,
+		armTwist: armTwistOffsetQuat.Muled(armTwistQuat).Muled(
+			mmath.NewMQuaternionFromAxisAngles(armAxis, bendOffsetAngle)),
+		elbow: mmath.NewMQuaternionFromAxisAngles(bendAxis, bendAngle),
+		wristTwist: mmath.NewMQuaternionFromAxisAngles(elbowAxis, -bendOffsetAngle).Muled(
+			elbowTwistOffsetQuat).Muled(wristTwistQuat),
+	}
+}
+
+// twistAxis は捩りボーンの軸を取得します。軸制限がない場合はボーンの向きを軸とします。
+func (su *SizingArmTwistUsecase) twistAxis(twistBone, fromBone, toBone *pmx.Bone) *mmath.MVec3 {
+	if twistBone.HasFixedAxis() {
+		return twistBone.FixedAxis.Normalized()
+	}
+	return toBone.Position.Subed(fromBone.Position).Normalized()
+}
+
+// updateTwistRotations は捩り分散した回転を出力モーションのキーフレームに反映します。
+func (su *SizingArmTwistUsecase) updateTwistRotations(
+	ctx context.Context, sizingSet *domain.SizingSet, direction pmx.BoneDirection, frames []int, sizingProcessMotion *vmd.VmdMotion,
+) error {
+	for i, iFrame := range frames {
+		if err := checkTerminate(ctx); err != nil {
+			return err
+		}
+
+		su.insertTwistRotations(sizingSet, direction, sizingProcessMotion, float32(iFrame))
+
+		if i > 0 && i%1000 == 0 {
+			mlog.I(mi18n.T("捩り補正02", map[string]interface{}{
+				"No": sizingSet.Index + 1, "Direction": direction.String(),
+				"IterIndex": fmt.Sprintf("%04d", i), "AllCount": fmt.Sprintf("%04d", len(frames))}))
+		}
+	}
+
+	return nil
+}
+
+// insertTwistRotations は指定フレームの捩り分散結果を出力モーションに登録します。
+func (su *SizingArmTwistUsecase) insertTwistRotations(
+	sizingSet *domain.SizingSet, direction pmx.BoneDirection, sizingProcessMotion *vmd.VmdMotion, frame float32,
+) {
+	rotations := su.calculateTwistRotations(sizingSet, direction, sizingProcessMotion, frame)
+
+	for _, v := range []struct {
+		boneName string
+		rotation *mmath.MQuaternion
+	}{
+		{pmx.ARM.StringFromDirection(direction), rotations.arm},
+		{pmx.ARM_TWIST.StringFromDirection(direction), rotations.armTwist},
+		{pmx.ELBOW.StringFromDirection(direction), rotations.elbow},
+		{pmx.WRIST_TWIST.StringFromDirection(direction), rotations.wristTwist},
+	} {
+		bf := sizingSet.OutputMotion.BoneFrames.Get(v.boneName).Get(frame)
+		bf.Rotation = v.rotation
+		sizingSet.OutputMotion.InsertBoneFrame(v.boneName, bf)
+	}
+}
+
+// updateOutputMotion は中間キーフレームのズレをチェックし、ズレている箇所にキーフレームを追加します。
+func (su *SizingArmTwistUsecase) updateOutputMotion(
+	ctx context.Context, sizingSet *domain.SizingSet, direction pmx.BoneDirection, dIndex int, allFrames []int, blockSize int,
+	sizingProcessMotion *vmd.VmdMotion, processAllDeltas []*delta.VmdDeltas, incrementCompletedCount func(),
+) error {
+	threshold := 0.05
+
+	resultAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, all_arm_twist_bone_names[dIndex], "", incrementCompletedCount)
+	if err != nil {
+		return err
+	}
+
+	driftFrames := make([]bool, len(allFrames))
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for _, boneName := range []string{
+				pmx.WRIST.StringFromDirection(direction), pmx.WRIST_TAIL.StringFromDirection(direction),
+			} {
+				processDelta := processAllDeltas[index].Bones.GetByName(boneName)
+				resultDelta := resultAllDeltas[index].Bones.GetByName(boneName)
+				if processDelta == nil || resultDelta == nil {
+					continue
+				}
+
+				if processDelta.FilledGlobalPosition().Distance(resultDelta.FilledGlobalPosition()) > threshold {
+					driftFrames[index] = true
+				}
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			mlog.I(mi18n.T("捩り補正05", map[string]interface{}{
+				"No": sizingSet.Index + 1, "Direction": direction.String(),
+				"IterIndex": fmt.Sprintf("%04d", iterIndex), "AllCount": fmt.Sprintf("%04d", allCount)}))
+		})
+	if err != nil {
+		return err
+	}
+
+	// ズレている箇所は、その時点の回転から振り分け直したキーフレームを追加する
+	for index, iFrame := range allFrames {
+		if driftFrames[index] {
+			su.insertTwistRotations(sizingSet, direction, sizingProcessMotion, float32(iFrame))
+		}
+	}
+
+	return nil
+}
+
+func (su *SizingArmTwistUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	if err := checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{},
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.SizingArmTwistBone, BoneName: pmx.ARM_TWIST},
+			{CheckFunk: sizingSet.SizingElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.SizingWristTwistBone, BoneName: pmx.WRIST_TWIST},
+			{CheckFunk: sizingSet.SizingWristBone, BoneName: pmx.WRIST},
+			{CheckFunk: sizingSet.SizingWristTailBone, BoneName: pmx.WRIST_TAIL},
+		},
+	); err != nil {
+		return err
+	}
+
+	// 腕 -> 腕捩 -> ひじ -> 手捩 -> 手首 の親子関係になっていない場合、振り分けられない
+	missingBones := make([]*SizingMissingBone, 0)
+	for _, direction := range directions {
+		for _, v := range [][]*pmx.Bone{
+			{sizingSet.SizingArmBone(direction), sizingSet.SizingArmTwistBone(direction)},
+			{sizingSet.SizingArmTwistBone(direction), sizingSet.SizingElbowBone(direction)},
+			{sizingSet.SizingElbowBone(direction), sizingSet.SizingWristTwistBone(direction)},
+			{sizingSet.SizingWristTwistBone(direction), sizingSet.SizingWristBone(direction)},
+		} {
+			parentBone, childBone := v[0], v[1]
+			if childBone.ParentIndex != parentBone.Index() {
+				message := mi18n.T("捩り補正ボーン不足", map[string]any{
+					"No": sizingSet.Index + 1, "ModelType": "先モデル",
+					"BoneName": fmt.Sprintf("%s(%s)", childBone.Name(), parentBone.Name())})
+				mlog.WT(mi18n.T("ボーン不足"), message)
+				missingBones = append(missingBones, &SizingMissingBone{
+					ModelType: SizingReportSizingModel, ModelName: sizingSet.OutputModelName,
+					BoneName: childBone.Name()})
+				err = merr.NewNameNotFoundError(childBone.Name(), message)
+			}
+		}
+	}
+
+	if len(missingBones) == 0 {
+		return nil
+	}
+
+	return &MissingBonesError{MissingBones: missingBones, err: err}
+}
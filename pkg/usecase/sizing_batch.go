@@ -0,0 +1,172 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+type SizingBatchStatus string
+
+const (
+	SizingBatchSucceeded SizingBatchStatus = "succeeded" // 成功
+	SizingBatchFailed    SizingBatchStatus = "failed"    // 失敗
+	SizingBatchSkipped   SizingBatchStatus = "skipped"   // ボーン不足のためスキップ
+)
+
+// SizingBatchResult バッチ1組み合わせ分の結果
+type SizingBatchResult struct {
+	OriginalMotionPath string            `json:"original_motion_path"` // 元モーションパス
+	OriginalModelPath  string            `json:"original_model_path"`  // 元モデルパス
+	SizingModelPath    string            `json:"sizing_model_path"`    // サイジング先モデルパス
+	OutputMotionPath   string            `json:"output_motion_path"`   // 出力モーションパス
+	Status             SizingBatchStatus `json:"status"`               // 結果
+	Message            string            `json:"message,omitempty"`    // 失敗・スキップ理由
+	Report             *SizingReport     `json:"report,omitempty"`     // 補正毎の結果
+}
+
+// SizingBatchSummary バッチ全体の結果
+type SizingBatchSummary struct {
+	Succeeded int                  `json:"succeeded"` // 成功件数
+	Failed    int                  `json:"failed"`    // 失敗件数
+	Skipped   int                  `json:"skipped"`   // スキップ件数
+	Results   []*SizingBatchResult `json:"results"`   // 組み合わせ毎の結果
+}
+
+// Save 結果をjsonで出力する
+func (summary *SizingBatchSummary) Save(path string) error {
+	output, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+func (summary *SizingBatchSummary) append(result *SizingBatchResult) {
+	switch result.Status {
+	case SizingBatchSucceeded:
+		summary.Succeeded++
+	case SizingBatchFailed:
+		summary.Failed++
+	case SizingBatchSkipped:
+		summary.Skipped++
+	}
+	summary.Results = append(summary.Results, result)
+}
+
+type SizingBatchUsecase struct {
+	Timeout time.Duration // 1組み合わせ毎の制限時間(0の場合は無制限)
+}
+
+func NewSizingBatchUsecase() *SizingBatchUsecase {
+	return &SizingBatchUsecase{}
+}
+
+// Exec ジョブファイルの全組み合わせを順番にサイジングする
+// 1組み合わせの失敗で全体は止めず、結果をサマリーに記録する
+// ctx がキャンセルされた場合は、残りの組み合わせを処理せずに終了する
+func (su *SizingBatchUsecase) Exec(ctx context.Context, batch *domain.SizingBatch) *SizingBatchSummary {
+	items := batch.Items()
+	summary := &SizingBatchSummary{Results: make([]*SizingBatchResult, 0, len(items))}
+
+	for i, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+
+		mlog.I(mi18n.T("バッチサイジング開始", map[string]any{
+			"Index": i + 1, "Count": len(items),
+			"MotionPath": item.OriginalMotionPath, "ModelPath": item.SizingModelPath}))
+
+		result := su.execItem(ctx, item)
+		summary.append(result)
+
+		switch result.Status {
+		case SizingBatchSucceeded:
+			mlog.I(mi18n.T("バッチサイジング成功", map[string]any{
+				"Index": i + 1, "Count": len(items), "Path": result.OutputMotionPath}))
+		case SizingBatchSkipped:
+			mlog.W(mi18n.T("バッチサイジングスキップ", map[string]any{
+				"Index": i + 1, "Count": len(items), "Message": result.Message}))
+		default:
+			mlog.W(mi18n.T("バッチサイジング失敗", map[string]any{
+				"Index": i + 1, "Count": len(items), "Message": result.Message}))
+		}
+	}
+
+	mlog.I(mi18n.T("バッチサイジング終了", map[string]any{
+		"Succeeded": summary.Succeeded, "Failed": summary.Failed, "Skipped": summary.Skipped}))
+
+	return summary
+}
+
+func (su *SizingBatchUsecase) execItem(ctx context.Context, item *domain.SizingBatchItem) *SizingBatchResult {
+	result := &SizingBatchResult{
+		OriginalMotionPath: item.OriginalMotionPath,
+		OriginalModelPath:  item.OriginalModelPath,
+		SizingModelPath:    item.SizingModelPath,
+	}
+
+	sizingSet, err := item.NewSizingSet()
+	if err != nil {
+		result.Status = SizingBatchFailed
+		result.Message = err.Error()
+		return result
+	}
+	defer sizingSet.Delete()
+
+	result.OutputMotionPath = sizingSet.OutputMotionPath
+
+	pipeline := NewSizingPipeline([]*domain.SizingSet{sizingSet})
+	pipeline.IsSkipMissingBones = true
+
+	// ボーン不足の場合は処理せずスキップ
+	if err := pipeline.CheckBones(sizingSet); err != nil {
+		if IsMissingBonesError(err) {
+			result.Status = SizingBatchSkipped
+		} else {
+			result.Status = SizingBatchFailed
+		}
+		result.Message = err.Error()
+		return result
+	}
+
+	if su.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, su.Timeout)
+		defer cancel()
+	}
+
+	_, err = pipeline.Exec(ctx)
+	if reports := pipeline.Reports(); len(reports) > 0 {
+		result.Report = reports[0]
+	}
+	if err != nil {
+		result.Status = SizingBatchFailed
+		result.Message = err.Error()
+		return result
+	}
+
+	sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
+
+	outputMotion, err := sizingSet.RestoreSizingBoneNames(sizingSet.OutputMotion)
+	if err == nil {
+		rep := repository.NewVmdRepository(true)
+		err = rep.Save(result.OutputMotionPath, outputMotion, false)
+	}
+	if err != nil {
+		result.Status = SizingBatchFailed
+		result.Message = err.Error()
+		return result
+	}
+
+	result.Status = SizingBatchSucceeded
+	return result
+}
@@ -0,0 +1,164 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// camera_bone_names カメラ補正でデフォームするボーン名
+var camera_bone_names = uniqueBoneNames(trunk_upper_bone_names, []string{pmx.HEAD.String()})
+
+type SizingCameraUsecase struct {
+}
+
+func NewSizingCameraUsecase() *SizingCameraUsecase {
+	return &SizingCameraUsecase{}
+}
+
+// Exec はカメラモーションの注視点と距離を、1人目のセットのサイジング結果に合わせて補正します。
+// 1人目のモデル・モーションが補正済みの時から変わっていない場合は、何もしない
+// 注視点は元モデルの上半身～頭からの相対位置を、サイジング先モデルの上半身～頭からの相対位置に移し替え、
+// 相対位置と距離は移動補正スケールで伸縮する
+func (su *SizingCameraUsecase) Exec(
+	ctx context.Context, sizingCamera *domain.SizingCamera, sizingSets []*domain.SizingSet,
+	scales []*mmath.MVec3, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if sizingCamera == nil || sizingCamera.CameraMotion == nil || len(sizingSets) == 0 {
+		return false, nil
+	}
+
+	sizingSet := sizingSets[0]
+	if sizingSet.OriginalConfigModel == nil || sizingSet.SizingConfigModel == nil ||
+		sizingSet.OutputMotion == nil || sizingCamera.IsCompleted(sizingSet) {
+		return false, nil
+	}
+
+	// 範囲外のカメラは補正前のままになり、補正済みのカメラを渡すと範囲内が二重に補正されるため、範囲指定とは併用できない
+	if len(sizingSet.FrameRanges) > 0 {
+		return false, fmt.Errorf("camera sizing does not support frame ranges")
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("カメラ補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	// 進捗は元のカメラのキーフレーム数で数える
+	cameraFrameCount := sizingCamera.CameraMotion.CameraFrames.Len()
+
+	outputCameraMotion, err := sizingCamera.CameraMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	// カメラのキーの間で1人目が動いた分も追従できるよう、元モーションのキーフレームにカメラのキーを追加する
+	domain.BakeCameraFrames(outputCameraMotion, getFrames(sizingSet.OriginalMotion, camera_bone_names))
+
+	// カメラのキーフレームだけ補正し、補間曲線はそのまま使う
+	cameraFrames := make([]*vmd.CameraFrame, 0, outputCameraMotion.CameraFrames.Len())
+	outputCameraMotion.CameraFrames.ForEach(func(frame float32, cf *vmd.CameraFrame) bool {
+		cameraFrames = append(cameraFrames, cf)
+		return true
+	})
+
+	frames := make([]int, len(cameraFrames))
+	for i, cf := range cameraFrames {
+		frames[i] = int(cf.Index())
+	}
+
+	blockSize, _ := miter.GetBlockSize(len(frames))
+
+	// 上半身と頭はIKの影響を受けないので、IKは計算しない
+	originalAllDeltas, err := computeVmdDeltas(ctx, frames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, false, camera_bone_names, "カメラ補正01", nil)
+	if err != nil {
+		return false, err
+	}
+	for range cameraFrameCount {
+		incrementCompletedCount()
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, frames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, false, camera_bone_names, "カメラ補正01", nil)
+	if err != nil {
+		return false, err
+	}
+	for range cameraFrameCount {
+		incrementCompletedCount()
+	}
+
+	scale := scales[sizingSet.Index]
+	for i, cf := range cameraFrames {
+		if err := checkTerminate(ctx); err != nil {
+			return false, err
+		}
+
+		cf.Position = su.calculateAdjustedLookAt(cf.Position, scale, originalAllDeltas[i], sizingAllDeltas[i])
+		// 距離は身長の比率で伸縮する
+		cf.Distance *= scale.Y
+
+		if i > 0 && i%1000 == 0 {
+			processLog("カメラ補正02", sizingSet.Index, i, len(cameraFrames))
+		}
+	}
+
+	sizingCamera.OutputCameraMotion = outputCameraMotion
+	sizingCamera.SetCompleted(sizingSet)
+
+	incrementCompletedCount()
+
+	return true, nil
+}
+
+// calculateAdjustedLookAt は元モデルに対する注視点の位置を、サイジング先モデルに対する位置に変換します。
+// 注視点の高さに応じて、上半身～頭の間で基準位置を決める
+func (su *SizingCameraUsecase) calculateAdjustedLookAt(
+	lookAt, scale *mmath.MVec3, originalDeltas, sizingDeltas *delta.VmdDeltas,
+) *mmath.MVec3 {
+	originalUpperPosition := originalDeltas.Bones.GetByName(pmx.UPPER.String()).FilledGlobalPosition()
+	originalHeadPosition := originalDeltas.Bones.GetByName(pmx.HEAD.String()).FilledGlobalPosition()
+	sizingUpperPosition := sizingDeltas.Bones.GetByName(pmx.UPPER.String()).FilledGlobalPosition()
+	sizingHeadPosition := sizingDeltas.Bones.GetByName(pmx.HEAD.String()).FilledGlobalPosition()
+
+	// 上半身より下なら上半身、頭より上なら頭を基準にする
+	ratio := 0.0
+	if height := originalHeadPosition.Y - originalUpperPosition.Y; !mmath.NearEquals(height, 0, 1e-6) {
+		ratio = max(0, min(1, (lookAt.Y-originalUpperPosition.Y)/height))
+	}
+
+	originalBasePosition := originalUpperPosition.Added(
+		originalHeadPosition.Subed(originalUpperPosition).MuledScalar(ratio))
+	sizingBasePosition := sizingUpperPosition.Added(
+		sizingHeadPosition.Subed(sizingUpperPosition).MuledScalar(ratio))
+
+	return sizingBasePosition.Added(lookAt.Subed(originalBasePosition).Muled(scale))
+}
+
+func (su *SizingCameraUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.OriginalUpperBone, BoneName: pmx.UPPER},
+			{CheckFunk: sizingSet.OriginalHeadBone, BoneName: pmx.HEAD},
+		},
+		[]domain.CheckDirectionBoneType{},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingUpperBone, BoneName: pmx.UPPER},
+			{CheckFunk: sizingSet.SizingHeadBone, BoneName: pmx.HEAD},
+		},
+		[]domain.CheckDirectionBoneType{},
+	)
+}
@@ -0,0 +1,291 @@
+package usecase
+
+import (
+	"context"
+	"math"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// floor_contact_height 元モデルのつま先・かかとの高さがこれ未満の場合、床に接地しているとみなす
+const floor_contact_height = 0.5
+
+// floor_sole_range 足裏とみなす頂点の範囲(足の最も低い頂点からの高さ)
+const floor_sole_range = 0.3
+
+// floor_ease_frames 接地区間の前後で、補正量を徐々に切り替えるフレーム数
+const floor_ease_frames = 3
+
+// solePoint 足裏の頂点1つ分(足首・足首D・足先EXのうち、ウェイトが最も大きいボーンからの相対位置)
+type solePoint struct {
+	boneName      string       // 頂点が追従するボーン名
+	localPosition *mmath.MVec3 // ボーン位置からの相対位置
+}
+
+type SizingFloorUsecase struct {
+}
+
+func NewSizingFloorUsecase() *SizingFloorUsecase {
+	return &SizingFloorUsecase{}
+}
+
+// Exec は元モーションで足が床に接地しているフレームで、サイジング先の足裏の頂点が床に沈まず浮かないように、グルーブと足IKを上下させます。
+func (su *SizingFloorUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingFloor || sizingSet.CompletedSizingFloor {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	solePoints := su.createSolePoints(sizingSet)
+	if len(solePoints[0]) == 0 || len(solePoints[1]) == 0 {
+		// 足に頂点がない(ボーンのみのモデル等)場合は補正しない
+		sizingSet.CompletedSizingFloor = true
+		return false, nil
+	}
+
+	mlog.I(mi18n.T("床補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, shared_original_bone_names, "床補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, all_lower_leg_bone_names, "床補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	contactFlags, originalHeights := su.detectFloorContacts(sizingSet, originalAllDeltas)
+
+	legIkOffsets, grooveOffsets, err := su.calculateFloorOffsets(
+		ctx, sizingSet, allFrames, blockSize, solePoints, contactFlags, originalHeights, sizingAllDeltas)
+	if err != nil {
+		return false, err
+	}
+
+	// 補正量の加算元として、補正前のモーションを残しておく
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	for index, iFrame := range allFrames {
+		for d, direction := range directions {
+			insertGlobalOffset(sizingProcessMotion, sizingSet.OutputMotion, sizingAllDeltas[index],
+				sizingSet.SizingLegIkBone(direction), iFrame, legIkOffsets[d][index])
+		}
+		insertGlobalOffset(sizingProcessMotion, sizingSet.OutputMotion, sizingAllDeltas[index],
+			sizingSet.SizingGrooveBone(), iFrame, grooveOffsets[index])
+
+		if index > 0 && index%1000 == 0 {
+			processLog("床補正03", sizingSet.Index, index, len(allFrames))
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("床03", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	incrementCompletedCount()
+
+	sizingSet.CompletedSizingFloor = true
+
+	return true, nil
+}
+
+// createSolePoints はサイジング先モデルの足首・足首D・足先EXに乗っている頂点のうち、足裏付近の頂点を左右別に求めます。
+// 厚底の靴などは、つま先・かかとボーンより下に頂点があるので、ボーンではなく頂点で判定する
+func (su *SizingFloorUsecase) createSolePoints(sizingSet *domain.SizingSet) [][]*solePoint {
+	solePoints := make([][]*solePoint, len(directions))
+
+	vertexMap := sizingSet.SizingConfigModel.Vertices.GetMapByBoneIndex(1e-1)
+	if vertexMap == nil {
+		return solePoints
+	}
+
+	for d, direction := range directions {
+		solePoints[d] = make([]*solePoint, 0)
+
+		footBones := make(map[int]*pmx.Bone)
+		for _, bone := range []*pmx.Bone{
+			sizingSet.SizingAnkleBone(direction),
+			sizingSet.SizingAnkleDBone(direction),
+			sizingSet.SizingToeExBone(direction),
+		} {
+			if bone != nil {
+				footBones[bone.Index()] = bone
+			}
+		}
+
+		footVertices := make(map[int]*solePoint)
+		minY := math.MaxFloat64
+		for _, footBone := range footBones {
+			for _, vertex := range vertexMap[footBone.Index()] {
+				if _, ok := footVertices[vertex.Index()]; ok {
+					continue
+				}
+
+				// 足のボーンのうち、ウェイトが最も大きいボーンに追従させる
+				var bone *pmx.Bone
+				maxWeight := 0.0
+				weights := vertex.Deform.Weights()
+				for i, boneIndex := range vertex.Deform.Indexes() {
+					if b, ok := footBones[boneIndex]; ok && i < len(weights) && weights[i] > maxWeight {
+						bone = b
+						maxWeight = weights[i]
+					}
+				}
+				if bone == nil {
+					continue
+				}
+
+				footVertices[vertex.Index()] = &solePoint{
+					boneName:      bone.Name(),
+					localPosition: vertex.Position.Subed(bone.Position),
+				}
+				minY = min(minY, vertex.Position.Y)
+			}
+		}
+
+		for _, point := range footVertices {
+			bone, _ := sizingSet.SizingConfigModel.Bones.GetByName(point.boneName)
+			if bone.Position.Y+point.localPosition.Y <= minY+floor_sole_range {
+				solePoints[d] = append(solePoints[d], point)
+			}
+		}
+	}
+
+	return solePoints
+}
+
+// detectFloorContacts は元モーションで、つま先・かかとのどちらかが床に接地しているフレームと、その時の高さを左右別に求めます。
+func (su *SizingFloorUsecase) detectFloorContacts(
+	sizingSet *domain.SizingSet, originalAllDeltas []*delta.VmdDeltas,
+) (contactFlags [][]bool, originalHeights [][]float64) {
+	contactFlags = make([][]bool, len(directions))
+	originalHeights = make([][]float64, len(directions))
+	for d, direction := range directions {
+		contactFlags[d] = make([]bool, len(originalAllDeltas))
+		originalHeights[d] = make([]float64, len(originalAllDeltas))
+
+		toeBoneName := sizingSet.OriginalToeTailDBone(direction).Name()
+		heelBoneName := sizingSet.OriginalHeelDBone(direction).Name()
+		for index, originalDeltas := range originalAllDeltas {
+			toeY := originalDeltas.Bones.GetByName(toeBoneName).FilledGlobalPosition().Y
+			heelY := originalDeltas.Bones.GetByName(heelBoneName).FilledGlobalPosition().Y
+			originalHeights[d][index] = max(0, min(toeY, heelY))
+			contactFlags[d][index] = min(toeY, heelY) < floor_contact_height
+		}
+	}
+
+	return contactFlags, originalHeights
+}
+
+// calculateFloorOffsets は接地しているフレームで、足裏の最も低い頂点を元モデルと同じ高さに合わせるための、足IK・グルーブのグローバル移動量を求めます。
+// 床より下には沈めず、元モデルより浮いている分は下げる
+// グルーブは左右の補正量の平均(接地していない足は0)だけ上下させる
+// 片足のみ接地の場合はその足の半分になり、浮いている足が接地足の補正量で持ち上がりすぎないようにする
+func (su *SizingFloorUsecase) calculateFloorOffsets(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int,
+	solePoints [][]*solePoint, contactFlags [][]bool, originalHeights [][]float64, sizingAllDeltas []*delta.VmdDeltas,
+) (legIkOffsets [][]*mmath.MVec3, grooveOffsets []*mmath.MVec3, err error) {
+	// 接地しているフレームの、足裏を床に合わせる上下移動量
+	floorDiffs := make([][]float64, len(directions))
+	for d := range directions {
+		floorDiffs[d] = make([]float64, len(allFrames))
+	}
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for d := range directions {
+				if !contactFlags[d][index] {
+					continue
+				}
+
+				soleY := math.MaxFloat64
+				for _, point := range solePoints[d] {
+					boneDelta := sizingAllDeltas[index].Bones.GetByName(point.boneName)
+					soleY = min(soleY, boneDelta.FilledGlobalMatrix().MulVec3(point.localPosition).Y)
+				}
+				floorDiffs[d][index] = originalHeights[d][index] - soleY
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("床補正02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 接地区間の前後は、補正量を徐々に切り替える
+	for d := range directions {
+		floorDiffs[d] = easeContactValues(floorDiffs[d], contactFlags[d], floor_ease_frames, scaleDiff)
+	}
+
+	legIkOffsets = make([][]*mmath.MVec3, len(directions))
+	for d := range directions {
+		legIkOffsets[d] = make([]*mmath.MVec3, len(allFrames))
+	}
+	grooveOffsets = make([]*mmath.MVec3, len(allFrames))
+
+	for index := range allFrames {
+		grooveY := 0.0
+		isContact := false
+		for d := range directions {
+			if floorDiffs[d][index] == 0 {
+				continue
+			}
+			legIkOffsets[d][index] = &mmath.MVec3{Y: floorDiffs[d][index]}
+			grooveY += floorDiffs[d][index]
+			isContact = true
+		}
+		if isContact {
+			grooveOffsets[index] = &mmath.MVec3{Y: grooveY / float64(len(directions))}
+		}
+	}
+
+	return legIkOffsets, grooveOffsets, nil
+}
+
+func (su *SizingFloorUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalToeTailBone, BoneName: pmx.TOE_T},
+			{CheckFunk: sizingSet.OriginalHeelBone, BoneName: pmx.HEEL},
+		},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingGrooveBone, BoneName: pmx.GROOVE},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingLegIkBone, BoneName: pmx.LEG_IK},
+			{CheckFunk: sizingSet.SizingAnkleBone, BoneName: pmx.ANKLE},
+		},
+	)
+}
@@ -0,0 +1,192 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// foot_contact_threshold 前フレームからの足IKの移動量がこれ未満の場合、接地しているとみなす
+const foot_contact_threshold = 0.005
+
+// foot_sliding_threshold 接地区間内の足首接地点のずれが、元モデルのずれよりこれ以上大きい場合、足滑りとみなす
+const foot_sliding_threshold = 0.1
+
+// direction_names 結果出力用の左右の名前
+var direction_names = []string{"left", "right"}
+
+// footContactSpan 元モーションで足が接地している区間
+type footContactSpan struct {
+	directionIndex int               // directions のINDEX
+	direction      pmx.BoneDirection // 左右
+	start          int               // 開始フレーム(接地したフレーム)
+	end            int               // 終了フレーム(このフレームを含む)
+}
+
+// detectFootContactFlags 元モーションの足IKが前フレームから動いていないフレームを、左右別に求める
+// 足IK親などで動かされている場合もあるので、足IKのグローバル位置で判定する
+// 足首だと、足IKの結果で少し沈んだ時とかに誤判定してしまう
+func detectFootContactFlags(originalAllDeltas []*delta.VmdDeltas) [][]bool {
+	contactFlags := make([][]bool, len(directions))
+	for d, direction := range directions {
+		contactFlags[d] = make([]bool, len(originalAllDeltas))
+
+		legIkBoneName := pmx.LEG_IK.StringFromDirection(direction)
+		for i := 1; i < len(originalAllDeltas); i++ {
+			nowLegIkPosition := originalAllDeltas[i].Bones.GetByName(legIkBoneName).FilledGlobalPosition()
+			prevLegIkPosition := originalAllDeltas[i-1].Bones.GetByName(legIkBoneName).FilledGlobalPosition()
+
+			contactFlags[d][i] = nowLegIkPosition.Distance(prevLegIkPosition) < foot_contact_threshold
+		}
+	}
+
+	return contactFlags
+}
+
+// detectFootContactSpans 接地フラグから、左右別の接地区間を求める
+// 動いていないフレームが続く区間の、直前のフレーム(接地したフレーム)から区間とする
+func detectFootContactSpans(contactFlags [][]bool) []*footContactSpan {
+	spans := make([]*footContactSpan, 0)
+	for d, direction := range directions {
+		var span *footContactSpan
+		for i, isContact := range contactFlags[d] {
+			if isContact {
+				if span == nil {
+					span = &footContactSpan{directionIndex: d, direction: direction, start: max(0, i-1)}
+				}
+				span.end = i
+				continue
+			}
+			if span != nil {
+				spans = append(spans, span)
+				span = nil
+			}
+		}
+		if span != nil {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// FootSlidingSpan 接地区間1つ分の足滑り
+type FootSlidingSpan struct {
+	Direction     string  `json:"direction"`      // 左右(left/right)
+	StartFrame    int     `json:"start_frame"`    // 開始フレーム
+	EndFrame      int     `json:"end_frame"`      // 終了フレーム
+	OriginalDrift float64 `json:"original_drift"` // 元モデルの足首接地点の、区間開始時からの最大ずれ
+	SizingDrift   float64 `json:"sizing_drift"`   // サイジング先モデルの足首接地点の、区間開始時からの最大ずれ
+	ExcessDrift   float64 `json:"excess_drift"`   // 元モデルのずれを超えた分(サイジングで増えたずれ)
+	IsSliding     bool    `json:"is_sliding"`     // サイジングで足滑りが増えたか
+}
+
+// FootSlidingReport 元モーションで足が接地している区間毎の、サイジング先モーションの足滑り
+type FootSlidingReport struct {
+	Spans            []*FootSlidingSpan `json:"spans"`              // 接地区間毎の結果
+	SlidingSpanCount int                `json:"sliding_span_count"` // 足滑りしている区間数
+	MaxDrift         float64            `json:"max_drift"`          // サイジング先の最大ずれ
+	MeanDrift        float64            `json:"mean_drift"`         // サイジング先の区間毎の最大ずれの平均
+}
+
+// AnalyzeFootSliding 元モーションで足が接地している区間に、出力モーションの足がどれだけずれているかを計測する
+// サイジング後の確認用で、モーションは変更しない
+func AnalyzeFootSliding(ctx context.Context, sizingSet *domain.SizingSet) (*FootSlidingReport, error) {
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames))
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, shared_original_bone_names, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, all_lower_leg_bone_names, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FootSlidingReport{Spans: make([]*FootSlidingSpan, 0)}
+	totalDrift := 0.0
+
+	// 範囲指定がある場合は、補正した範囲内の接地区間のみ計測する
+	contactFlags := detectFootContactFlags(originalAllDeltas)
+	for d := range contactFlags {
+		for i := range contactFlags[d] {
+			contactFlags[d][i] = contactFlags[d][i] && sizingSet.IsInFrameRanges(allFrames[i])
+		}
+	}
+
+	for _, span := range detectFootContactSpans(contactFlags) {
+		groundBoneName := pmx.ANKLE_D_GROUND.StringFromDirection(span.direction)
+
+		slidingSpan := &FootSlidingSpan{
+			Direction:     direction_names[span.directionIndex],
+			StartFrame:    span.start,
+			EndFrame:      span.end,
+			OriginalDrift: maxGlobalDrift(originalAllDeltas, groundBoneName, span.start, span.end),
+			SizingDrift:   maxGlobalDrift(sizingAllDeltas, groundBoneName, span.start, span.end),
+		}
+		// 元モーションで既に足がずれている分は、サイジングによる足滑りとはみなさない
+		slidingSpan.ExcessDrift = max(0, slidingSpan.SizingDrift-slidingSpan.OriginalDrift)
+		slidingSpan.IsSliding = slidingSpan.ExcessDrift > foot_sliding_threshold
+
+		report.Spans = append(report.Spans, slidingSpan)
+		report.MaxDrift = max(report.MaxDrift, slidingSpan.SizingDrift)
+		totalDrift += slidingSpan.SizingDrift
+		if slidingSpan.IsSliding {
+			report.SlidingSpanCount++
+		}
+	}
+
+	if len(report.Spans) > 0 {
+		report.MeanDrift = totalDrift / float64(len(report.Spans))
+	}
+
+	mlog.I(mi18n.T("足滑り計測結果", map[string]any{
+		"No":           sizingSet.Index + 1,
+		"Count":        len(report.Spans),
+		"SlidingCount": report.SlidingSpanCount,
+		"MaxDrift":     fmt.Sprintf("%.3f", report.MaxDrift),
+	}))
+
+	return report, nil
+}
+
+// Save 足滑りの計測結果をjsonで出力する
+func (report *FootSlidingReport) Save(path string) error {
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+// maxGlobalDrift 区間開始時からの、ボーンのグローバル位置の最大ずれ
+func maxGlobalDrift(allDeltas []*delta.VmdDeltas, boneName string, start, end int) float64 {
+	startDelta := allDeltas[start].Bones.GetByName(boneName)
+	if startDelta == nil {
+		return 0
+	}
+	startPosition := startDelta.FilledGlobalPosition()
+
+	drift := 0.0
+	for i := start + 1; i <= end && i < len(allDeltas); i++ {
+		if boneDelta := allDeltas[i].Bones.GetByName(boneName); boneDelta != nil {
+			drift = max(drift, boneDelta.FilledGlobalPosition().Distance(startPosition))
+		}
+	}
+
+	return drift
+}
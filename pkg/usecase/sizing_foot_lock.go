@@ -0,0 +1,263 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// foot_lock_ease_frames 接地区間の前後で、固定位置に徐々に寄せるフレーム数
+const foot_lock_ease_frames = 3
+
+// foot_lock_reach_ratio 足の長さに対して、足首を届かせて良い距離の割合(ひざが伸び切らないように少し縮める)
+const foot_lock_reach_ratio = 0.98
+
+type SizingFootLockUsecase struct {
+}
+
+func NewSizingFootLockUsecase() *SizingFootLockUsecase {
+	return &SizingFootLockUsecase{}
+}
+
+// Exec は元モーションで足が接地している区間の間、サイジング先のつま先・かかと・足首接地点を固定します。
+// 足IKは平行移動だけで足の向きは変えないため、区間内でかかとからつま先へ体重移動するような動きでは、
+// 3点のずれは平均して抑えるだけで、各点のずれは残る(残ったずれの最大値はログに出力する)
+func (su *SizingFootLockUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingFootLock || sizingSet.CompletedSizingFootLock {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("足接地固定開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, shared_original_bone_names, "足接地固定01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, all_lower_leg_bone_names, "足接地固定01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	spans := detectFootContactSpans(detectFootContactFlags(originalAllDeltas))
+
+	legIkOffsets, maxResidual := su.calculateLockOffsets(sizingSet, allFrames, spans, sizingAllDeltas)
+	mlog.I(mi18n.T("足接地固定残差", map[string]interface{}{
+		"No": sizingSet.Index + 1, "Count": len(spans), "MaxResidual": fmt.Sprintf("%.3f", maxResidual)}))
+	centerOffsets := su.calculateCenterOffsets(sizingSet, allFrames, sizingAllDeltas, legIkOffsets)
+
+	if err := su.updateOutputMotion(sizingSet, allFrames, sizingAllDeltas, legIkOffsets, centerOffsets); err != nil {
+		return false, err
+	}
+
+	incrementCompletedCount()
+
+	sizingSet.CompletedSizingFootLock = true
+
+	return true, nil
+}
+
+// calculateLockOffsets は接地区間毎に、つま先・かかと・足首接地点を固定するための足IKのグローバル移動量を求めます。
+// 固定位置は区間内の平均位置とし、区間の前後は固定位置に徐々に寄せる
+// maxResidual は、足IKを動かした後も各点に残る固定位置からのずれの最大値(足IKが届く前提の推定値)
+func (su *SizingFootLockUsecase) calculateLockOffsets(
+	sizingSet *domain.SizingSet, allFrames []int, spans []*footContactSpan, sizingAllDeltas []*delta.VmdDeltas,
+) (legIkOffsets [][]*mmath.MVec3, maxResidual float64) {
+	legIkOffsets = make([][]*mmath.MVec3, len(directions))
+	for d := range directions {
+		legIkOffsets[d] = make([]*mmath.MVec3, len(allFrames))
+	}
+
+	lockFlags := make([][]bool, len(directions))
+	for d := range directions {
+		lockFlags[d] = make([]bool, len(allFrames))
+	}
+
+	for _, span := range spans {
+		end := min(span.end, len(allFrames)-1)
+		if end <= span.start {
+			continue
+		}
+
+		boneNames := []string{
+			sizingSet.SizingToeTailDBone(span.direction).Name(),
+			sizingSet.SizingHeelDBone(span.direction).Name(),
+			sizingSet.SizingAnkleDGroundBone(span.direction).Name(),
+		}
+
+		// 区間内の各点の平均位置を固定位置とする
+		lockPositions := make([]*mmath.MVec3, len(boneNames))
+		for j, boneName := range boneNames {
+			lockPositions[j] = mmath.NewMVec3()
+			for index := span.start; index <= end; index++ {
+				lockPositions[j] = lockPositions[j].Added(
+					sizingAllDeltas[index].Bones.GetByName(boneName).FilledGlobalPosition())
+			}
+			lockPositions[j] = lockPositions[j].MuledScalar(1 / float64(end-span.start+1))
+		}
+
+		// 3点のずれの平均だけ足IKを動かす(足の向きは変えない)
+		for index := span.start; index <= end; index++ {
+			offset := mmath.NewMVec3()
+			for j, boneName := range boneNames {
+				offset = offset.Added(lockPositions[j].Subed(
+					sizingAllDeltas[index].Bones.GetByName(boneName).FilledGlobalPosition()))
+			}
+			legIkOffsets[span.directionIndex][index] = offset.MuledScalar(1 / float64(len(boneNames)))
+			lockFlags[span.directionIndex][index] = true
+
+			// 平行移動では吸収できない、足の向きの変化によるずれ
+			for j, boneName := range boneNames {
+				lockedPosition := sizingAllDeltas[index].Bones.GetByName(boneName).FilledGlobalPosition().Added(
+					legIkOffsets[span.directionIndex][index])
+				maxResidual = max(maxResidual, lockedPosition.Distance(lockPositions[j]))
+			}
+		}
+	}
+
+	// 区間の前後は、固定位置に徐々に寄せる
+	for d := range directions {
+		legIkOffsets[d] = easeContactValues(legIkOffsets[d], lockFlags[d], foot_lock_ease_frames, scaleOffset)
+	}
+
+	return legIkOffsets, maxResidual
+}
+
+// calculateCenterOffsets は足IKを動かした結果、足首に届かなくなるフレームで、センターのグローバル移動量を求めます。
+// ひざが伸び切らないよう、届かない分だけ足首の方向にセンターを寄せる
+func (su *SizingFootLockUsecase) calculateCenterOffsets(
+	sizingSet *domain.SizingSet, allFrames []int, sizingAllDeltas []*delta.VmdDeltas, legIkOffsets [][]*mmath.MVec3,
+) []*mmath.MVec3 {
+	legLengths := make([]float64, len(directions))
+	for d, direction := range directions {
+		legLengths[d] = (sizingSet.SizingLegBone(direction).Position.Distance(sizingSet.SizingKneeBone(direction).Position) +
+			sizingSet.SizingKneeBone(direction).Position.Distance(sizingSet.SizingAnkleBone(direction).Position)) *
+			foot_lock_reach_ratio
+	}
+
+	centerOffsets := make([]*mmath.MVec3, len(allFrames))
+	for index := range allFrames {
+		maxExcess := 0.0
+		for d, direction := range directions {
+			if legIkOffsets[d][index] == nil {
+				continue
+			}
+
+			legPosition := sizingAllDeltas[index].Bones.GetByName(
+				sizingSet.SizingLegBone(direction).Name()).FilledGlobalPosition()
+			ankleTargetPosition := sizingAllDeltas[index].Bones.GetByName(
+				sizingSet.SizingAnkleBone(direction).Name()).FilledGlobalPosition().Added(legIkOffsets[d][index])
+
+			if excess := legPosition.Distance(ankleTargetPosition) - legLengths[d]; excess > maxExcess {
+				maxExcess = excess
+				centerOffsets[index] = ankleTargetPosition.Subed(legPosition).Normalized().MuledScalar(excess)
+			}
+		}
+
+		if index > 0 && index%1000 == 0 {
+			processLog("足接地固定02", sizingSet.Index, index, len(allFrames))
+		}
+	}
+
+	return centerOffsets
+}
+
+// updateOutputMotion は足IK・センターのグローバル移動量を、ローカル位置に変換して出力モーションに反映します。
+func (su *SizingFootLockUsecase) updateOutputMotion(
+	sizingSet *domain.SizingSet, allFrames []int, sizingAllDeltas []*delta.VmdDeltas,
+	legIkOffsets [][]*mmath.MVec3, centerOffsets []*mmath.MVec3,
+) error {
+	// 補正量の加算元として、補正前のモーションを残しておく
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return err
+	}
+
+	for index := range allFrames {
+		for d, direction := range directions {
+			insertGlobalOffset(sizingProcessMotion, sizingSet.OutputMotion, sizingAllDeltas[index],
+				sizingSet.SizingLegIkBone(direction), allFrames[index], legIkOffsets[d][index])
+		}
+		insertGlobalOffset(sizingProcessMotion, sizingSet.OutputMotion, sizingAllDeltas[index],
+			sizingSet.SizingCenterBone(), allFrames[index], centerOffsets[index])
+
+		if index > 0 && index%1000 == 0 {
+			processLog("足接地固定03", sizingSet.Index, index, len(allFrames))
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("足接地固定03", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	return nil
+}
+
+// insertGlobalOffset はボーンのグローバル移動量を、親ボーンの向きに合わせたローカル移動量に変換して、キーフレームに加算します。
+// 加算元は補正前のモーション(processMotion)から取得する。
+// 出力モーションから取得すると、直前に登録したキーフレームの補正量が補間で次のフレームに漏れる
+func insertGlobalOffset(
+	processMotion, outputMotion *vmd.VmdMotion, vmdDeltas *delta.VmdDeltas, bone *pmx.Bone, iFrame int,
+	offset *mmath.MVec3,
+) {
+	if offset == nil {
+		return
+	}
+
+	localOffset := offset
+	if parentDelta := vmdDeltas.Bones.Get(bone.ParentIndex); parentDelta != nil {
+		globalPosition := vmdDeltas.Bones.GetByName(bone.Name()).FilledGlobalPosition()
+		parentInvMat := parentDelta.FilledGlobalMatrix().Inverted()
+		localOffset = parentInvMat.MulVec3(globalPosition.Added(offset)).Subed(parentInvMat.MulVec3(globalPosition))
+	}
+
+	frame := float32(iFrame)
+	processBf := processMotion.BoneFrames.Get(bone.Name()).Get(frame)
+	bf := outputMotion.BoneFrames.Get(bone.Name()).Get(frame)
+	bf.Position = processBf.FilledPosition().Added(localOffset)
+	outputMotion.InsertBoneFrame(bone.Name(), bf)
+}
+
+func (su *SizingFootLockUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalLegIkBone, BoneName: pmx.LEG_IK},
+		},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingCenterBone, BoneName: pmx.CENTER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingLegIkBone, BoneName: pmx.LEG_IK},
+			{CheckFunk: sizingSet.SizingLegBone, BoneName: pmx.LEG},
+			{CheckFunk: sizingSet.SizingKneeBone, BoneName: pmx.KNEE},
+			{CheckFunk: sizingSet.SizingAnkleBone, BoneName: pmx.ANKLE},
+			{CheckFunk: sizingSet.SizingToeTailDBone, BoneName: pmx.TOE_T_D},
+			{CheckFunk: sizingSet.SizingHeelDBone, BoneName: pmx.HEEL_D},
+			{CheckFunk: sizingSet.SizingAnkleDGroundBone, BoneName: pmx.ANKLE_D_GROUND},
+		},
+	)
+}
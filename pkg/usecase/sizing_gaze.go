@@ -0,0 +1,202 @@
+package usecase
+
+import (
+	"context"
+	"math"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// gaze_neck_ratio 頭の向きを合わせる回転のうち、首で受け持つ割合
+const gaze_neck_ratio = 0.5
+
+// gaze_target_angle 元モーションで、頭の正面と注視点の方向の角度がこれ未満の場合、注視点を見ているとみなす(ラジアン)
+const gaze_target_angle = 15.0 * math.Pi / 180.0
+
+// gaze_fix_threshold 頭の正面・上方向のずれがこれ未満のフレームは、補正不要とみなす(単位ベクトル間の距離)
+const gaze_fix_threshold = 1e-4
+
+// gaze_bone_names 視線補正でデフォームするボーン名
+var gaze_bone_names = uniqueBoneNames(trunk_upper_bone_names, []string{pmx.HEAD.String()})
+
+// gaze_front 頭の正面方向(モデルは -Z 方向を向いている)
+var gaze_front = &mmath.MVec3{X: 0, Y: 0, Z: -1}
+
+type SizingGazeUsecase struct {
+}
+
+func NewSizingGazeUsecase() *SizingGazeUsecase {
+	return &SizingGazeUsecase{}
+}
+
+// Exec は上半身などの補正で変わった頭の向きを、首と頭の回転で元モーションと同じグローバルの向きに戻します。
+// 注視点が指定されている場合、元モーションで注視点を見ているフレームは、サイジング先でも注視点を見るようにする
+func (su *SizingGazeUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingGaze || sizingSet.CompletedSizingGaze {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("視線補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, shared_original_bone_names, "視線補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, gaze_bone_names, "視線補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	neckRotations := make([]*mmath.MQuaternion, len(allFrames))
+	headRotations := make([]*mmath.MQuaternion, len(allFrames))
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			neckRotations[index], headRotations[index] = su.calculateAdjustedHead(
+				sizingSet, originalAllDeltas[index], sizingAllDeltas[index])
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("視線補正02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return false, err
+	}
+
+	su.updateOutputMotion(sizingSet, allFrames, neckRotations, headRotations)
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("視線補正04", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	incrementCompletedCount()
+
+	sizingSet.CompletedSizingGaze = true
+
+	return true, nil
+}
+
+// calculateAdjustedHead は頭のグローバル回転を元モーションに合わせるための、首と頭のローカル回転を求めます。
+// 補正が不要なフレームは nil を返します。
+func (su *SizingGazeUsecase) calculateAdjustedHead(
+	sizingSet *domain.SizingSet, originalDeltas, sizingDeltas *delta.VmdDeltas,
+) (neckRotation, headRotation *mmath.MQuaternion) {
+	neckBone := sizingSet.SizingNeckBone()
+	headBone := sizingSet.SizingHeadBone()
+
+	originalHeadDelta := originalDeltas.Bones.GetByName(pmx.HEAD.String())
+	sizingHeadDelta := sizingDeltas.Bones.GetByName(headBone.Name())
+
+	// 頭の理想のグローバル回転(元モーションと同じ向き)
+	originalHeadQuat := originalHeadDelta.FilledGlobalMatrix().Quaternion()
+	idealHeadQuat := originalHeadQuat
+
+	if sizingSet.GazeTarget != nil {
+		originalHeadPosition := originalHeadDelta.FilledGlobalPosition()
+		originalTargetDirection := sizingSet.GazeTarget.Subed(originalHeadPosition).Normalized()
+		originalFront := originalHeadQuat.MulVec3(gaze_front).Normalized()
+
+		// 元モーションで注視点を見ている場合、サイジング先の頭の位置から注視点を見る
+		if math.Acos(max(-1, min(1, originalFront.Dot(originalTargetDirection)))) < gaze_target_angle {
+			sizingTargetDirection := sizingSet.GazeTarget.Subed(sizingHeadDelta.FilledGlobalPosition()).Normalized()
+			idealHeadQuat = mmath.NewMQuaternionRotate(originalTargetDirection, sizingTargetDirection).Muled(originalHeadQuat)
+		}
+	}
+
+	// 今の頭から理想の頭までのグローバル回転を、首と頭で分ける
+	sizingHeadQuat := sizingHeadDelta.FilledGlobalMatrix().Quaternion()
+	fixQuat := idealHeadQuat.Muled(sizingHeadQuat.Inverted())
+	if fixQuat.MulVec3(gaze_front).Distance(gaze_front) < gaze_fix_threshold &&
+		fixQuat.MulVec3(mmath.MVec3UnitY).Distance(mmath.MVec3UnitY) < gaze_fix_threshold {
+		// 頭の向きがほぼ合っている場合、キーを打たない
+		return nil, nil
+	}
+
+	neckFixQuat := mmath.NewMQuaternion().Slerp(fixQuat, gaze_neck_ratio)
+	headFixQuat := fixQuat.Muled(neckFixQuat.Inverted())
+
+	neckParentQuat := sizingDeltas.Bones.Get(neckBone.ParentIndex).FilledGlobalMatrix().Quaternion()
+	neckRotation = applyGlobalRotation(neckParentQuat, neckFixQuat,
+		sizingDeltas.Bones.GetByName(neckBone.Name()).FilledFrameRotation())
+
+	// 首を回した分、頭の親のグローバル回転も回っている
+	headParentQuat := neckFixQuat.Muled(sizingDeltas.Bones.Get(headBone.ParentIndex).FilledGlobalMatrix().Quaternion())
+	headRotation = applyGlobalRotation(headParentQuat, headFixQuat, sizingHeadDelta.FilledFrameRotation())
+
+	return neckRotation, headRotation
+}
+
+// updateOutputMotion は首と頭の回転を出力モーションに反映します。
+func (su *SizingGazeUsecase) updateOutputMotion(
+	sizingSet *domain.SizingSet, allFrames []int, neckRotations, headRotations []*mmath.MQuaternion,
+) {
+	for i, iFrame := range allFrames {
+		if i > 0 && i%1000 == 0 {
+			processLog("視線補正03", sizingSet.Index, i, len(allFrames))
+		}
+
+		if neckRotations[i] == nil || headRotations[i] == nil {
+			continue
+		}
+
+		frame := float32(iFrame)
+		for _, v := range []struct {
+			boneName  string
+			rotations []*mmath.MQuaternion
+		}{
+			{sizingSet.SizingNeckBone().Name(), neckRotations},
+			{sizingSet.SizingHeadBone().Name(), headRotations},
+		} {
+			bf := sizingSet.OutputMotion.BoneFrames.Get(v.boneName).Get(frame)
+			bf.Rotation = v.rotations[i]
+			sizingSet.OutputMotion.InsertBoneFrame(v.boneName, bf)
+		}
+	}
+}
+
+// applyGlobalRotation はボーンをグローバルで回転させた時の、ボーンのローカル回転を求めます。
+// parentQuat は親ボーンのグローバル回転、globalRotation は追加するグローバル回転
+func applyGlobalRotation(parentQuat, globalRotation, frameRotation *mmath.MQuaternion) *mmath.MQuaternion {
+	return parentQuat.Inverted().Muled(globalRotation).Muled(parentQuat).Muled(frameRotation)
+}
+
+func (su *SizingGazeUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.OriginalHeadBone, BoneName: pmx.HEAD},
+		},
+		[]domain.CheckDirectionBoneType{},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingNeckBone, BoneName: pmx.NECK},
+			{CheckFunk: sizingSet.SizingHeadBone, BoneName: pmx.HEAD},
+		},
+		[]domain.CheckDirectionBoneType{},
+	)
+}
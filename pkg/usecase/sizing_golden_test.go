@@ -0,0 +1,84 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+)
+
+// 足首・つま先の位置が変わった場合は、足補正の退行として検出する
+var golden_leg_bone_names = []string{
+	pmx.CENTER.String(), pmx.LOWER.String(), pmx.LEG_CENTER.String(),
+	pmx.LEG.Left(), pmx.KNEE.Left(), pmx.ANKLE.Left(), pmx.TOE_T.Left(), pmx.HEEL.Left(),
+	pmx.LEG.Right(), pmx.KNEE.Right(), pmx.ANKLE.Right(), pmx.TOE_T.Right(), pmx.HEEL.Right(),
+}
+
+var golden_upper_bone_names = []string{
+	pmx.UPPER.String(), pmx.UPPER2.String(), pmx.NECK_ROOT.String(), pmx.NECK.String(), pmx.HEAD.String(),
+}
+
+var golden_arm_bone_names = []string{
+	pmx.SHOULDER.Left(), pmx.ARM.Left(), pmx.ELBOW.Left(), pmx.WRIST.Left(),
+	pmx.SHOULDER.Right(), pmx.ARM.Right(), pmx.ELBOW.Right(), pmx.WRIST.Right(),
+}
+
+// 足補正は、以前は下半身補正を含んでいたので、下半身補正と合わせた結果で比較する
+func TestSizingLegGolden(t *testing.T) {
+	runGoldenUsecase(t, "leg", golden_leg_bone_names,
+		func(sizingSet *domain.SizingSet) {
+			sizingSet.IsSizingLower = true
+			sizingSet.IsSizingLeg = true
+		},
+		func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error) {
+			scales := GenerateSizingScales([]*domain.SizingSet{sizingSet})
+			if _, err := NewSizingLowerUsecase().Exec(ctx, sizingSet, scales[0], 1, func() {}); err != nil {
+				return false, err
+			}
+			return NewSizingLegUsecase().Exec(ctx, sizingSet, scales[0], 1, func() {})
+		})
+}
+
+// 下半身補正は足補正から分けたもので変更前のゴールデンが無いため、分けた時点のコードで出力する
+func TestSizingLowerGolden(t *testing.T) {
+	runGoldenUsecase(t, "lower", golden_leg_bone_names,
+		func(sizingSet *domain.SizingSet) {
+			sizingSet.IsSizingLower = true
+		},
+		func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error) {
+			scales := GenerateSizingScales([]*domain.SizingSet{sizingSet})
+			return NewSizingLowerUsecase().Exec(ctx, sizingSet, scales[0], 1, func() {})
+		})
+}
+
+func TestSizingUpperGolden(t *testing.T) {
+	runGoldenUsecase(t, "upper", golden_upper_bone_names,
+		func(sizingSet *domain.SizingSet) {
+			sizingSet.IsSizingUpper = true
+		},
+		func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error) {
+			return NewSizingUpperUsecase().Exec(ctx, sizingSet, 1, func() {})
+		})
+}
+
+func TestSizingShoulderGolden(t *testing.T) {
+	runGoldenUsecase(t, "shoulder", golden_arm_bone_names,
+		func(sizingSet *domain.SizingSet) {
+			sizingSet.IsSizingShoulder = true
+		},
+		func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error) {
+			return NewSizingShoulderUsecase().Exec(ctx, sizingSet, 1, func() {})
+		})
+}
+
+func TestSizingArmStanceGolden(t *testing.T) {
+	runGoldenUsecase(t, "arm_stance", golden_arm_bone_names,
+		func(sizingSet *domain.SizingSet) {
+			sizingSet.IsSizingArmStance = true
+		},
+		func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error) {
+			return NewSizingArmStanceUsecase().Exec(ctx, sizingSet, 1, func() {})
+		})
+}
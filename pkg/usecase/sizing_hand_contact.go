@@ -0,0 +1,281 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// hand_contact_threshold 元モーションで、別セットの手同士の距離がこれ未満の場合、触れているとみなす
+const hand_contact_threshold = 0.8
+
+// hand_contact_ease_frames 接触区間の前後で、補正量を徐々に切り替えるフレーム数
+const hand_contact_ease_frames = 3
+
+// hand_contact_bone_names 接触判定に使う手のボーン(手首・手首先・指先)
+// 指先はモデルに無い場合もあるので、無いボーンは判定に使わない
+var hand_contact_bone_names = []pmx.StandardBoneName{
+	pmx.WRIST, pmx.WRIST_TAIL,
+	pmx.THUMB_TAIL, pmx.INDEX_TAIL, pmx.MIDDLE_TAIL, pmx.RING_TAIL, pmx.PINKY_TAIL,
+}
+
+// hand_contact_finger_bone_names 接触判定のためにデフォームする指先ボーン名
+var hand_contact_finger_bone_names = []string{
+	pmx.THUMB_TAIL.Left(), pmx.INDEX_TAIL.Left(), pmx.MIDDLE_TAIL.Left(), pmx.RING_TAIL.Left(), pmx.PINKY_TAIL.Left(),
+	pmx.THUMB_TAIL.Right(), pmx.INDEX_TAIL.Right(), pmx.MIDDLE_TAIL.Right(), pmx.RING_TAIL.Right(), pmx.PINKY_TAIL.Right(),
+}
+
+// handContactSet 接触維持の対象セットと、そのデフォーム結果
+type handContactSet struct {
+	sizingSet         *domain.SizingSet
+	originalAllDeltas []*delta.VmdDeltas
+	sizingAllDeltas   []*delta.VmdDeltas
+	wristOffsets      [][]*mmath.MVec3 // 左右別・フレーム別の手首のグローバル移動量
+	offsetCounts      [][]int          // 左右別・フレーム別の接触数
+}
+
+type SizingHandContactUsecase struct {
+}
+
+func NewSizingHandContactUsecase() *SizingHandContactUsecase {
+	return &SizingHandContactUsecase{}
+}
+
+// Exec は複数セット間で、元モーションで手が触れているフレームを探し、サイジング後も触れたままになるように両方の腕をIKで補正します。
+// セット毎の補正が終わった後に、全セットまとめて実行する
+// 戻り値は、sizingSets と同じ並びの、補正したかどうかと、ボーン不足で対象外にしたセットのエラー
+func (su *SizingHandContactUsecase) Exec(
+	ctx context.Context, sizingSets []*domain.SizingSet, incrementCompletedCount func(),
+) (isExecs []bool, missingBonesErrs []error, err error) {
+	isExecs = make([]bool, len(sizingSets))
+	missingBonesErrs = make([]error, len(sizingSets))
+
+	contactSets := make([]*handContactSet, 0)
+	for i, sizingSet := range sizingSets {
+		if !sizingSet.IsSizingHandContact || sizingSet.CompletedSizingHandContact ||
+			sizingSet.OriginalConfigModel == nil || sizingSet.SizingConfigModel == nil || sizingSet.OutputMotion == nil {
+			continue
+		}
+		if err := su.checkBones(sizingSet); err != nil {
+			// ボーンが足りないセットは除いて、残りのセット同士で補正する
+			missingBonesErrs[i] = err
+			continue
+		}
+		contactSets = append(contactSets, &handContactSet{sizingSet: sizingSet})
+	}
+
+	if len(contactSets) < 2 {
+		// 相手がいない場合は何もしない
+		for _, contactSet := range contactSets {
+			contactSet.sizingSet.CompletedSizingHandContact = true
+		}
+		return isExecs, missingBonesErrs, nil
+	}
+
+	mlog.I(mi18n.T("手接触維持開始", map[string]interface{}{"Count": len(contactSets)}))
+
+	for _, contactSet := range contactSets {
+		if err := su.computeDeltas(ctx, contactSet, len(sizingSets), incrementCompletedCount); err != nil {
+			return isExecs, missingBonesErrs, err
+		}
+	}
+
+	// 全ての組み合わせで、手が触れているフレームの補正量を求める
+	for i, contactSetA := range contactSets {
+		for _, contactSetB := range contactSets[i+1:] {
+			if err := checkTerminate(ctx); err != nil {
+				return isExecs, missingBonesErrs, err
+			}
+			su.calculateContactOffsets(contactSetA, contactSetB)
+		}
+	}
+
+	for _, contactSet := range contactSets {
+		if err := checkTerminate(ctx); err != nil {
+			return isExecs, missingBonesErrs, err
+		}
+
+		isExec, err := su.updateOutputMotion(ctx, contactSet)
+		if err != nil {
+			return isExecs, missingBonesErrs, err
+		}
+
+		for i, sizingSet := range sizingSets {
+			if sizingSet == contactSet.sizingSet {
+				isExecs[i] = isExec
+			}
+		}
+
+		incrementCompletedCount()
+		contactSet.sizingSet.CompletedSizingHandContact = true
+	}
+
+	return isExecs, missingBonesErrs, nil
+}
+
+// computeDeltas は元モーション・出力モーションの腕系のデフォーム結果を取得します。
+func (su *SizingHandContactUsecase) computeDeltas(
+	ctx context.Context, contactSet *handContactSet, sizingSetCount int, incrementCompletedCount func(),
+) (err error) {
+	sizingSet := contactSet.sizingSet
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	contactSet.originalAllDeltas, err = computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, uniqueBoneNames(shared_original_bone_names, hand_contact_finger_bone_names),
+		"手接触維持01", incrementCompletedCount)
+	if err != nil {
+		return err
+	}
+
+	contactSet.sizingAllDeltas, err = computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true,
+		uniqueBoneNames(all_arm_bone_names[0], all_arm_bone_names[1], hand_contact_finger_bone_names),
+		"手接触維持01", incrementCompletedCount)
+	if err != nil {
+		return err
+	}
+
+	contactSet.wristOffsets = make([][]*mmath.MVec3, len(directions))
+	contactSet.offsetCounts = make([][]int, len(directions))
+	for d := range directions {
+		contactSet.wristOffsets[d] = make([]*mmath.MVec3, len(allFrames))
+		contactSet.offsetCounts[d] = make([]int, len(allFrames))
+	}
+
+	return nil
+}
+
+// calculateContactOffsets は2セット間で手が触れているフレームで、元モーションと同じ手の位置関係になる手首の移動量を求めます。
+// 両方のセットで半分ずつ動かす
+func (su *SizingHandContactUsecase) calculateContactOffsets(contactSetA, contactSetB *handContactSet) {
+	frameCount := min(len(contactSetA.originalAllDeltas), len(contactSetB.originalAllDeltas))
+
+	for index := range frameCount {
+		// 範囲指定がある場合、範囲外は前回の出力結果のままなので補正しない
+		if !contactSetA.sizingSet.IsInFrameRanges(index) || !contactSetB.sizingSet.IsInFrameRanges(index) {
+			continue
+		}
+
+		for da, directionA := range directions {
+			for db, directionB := range directions {
+				// 一番近い手のボーン同士で判定する
+				minDistance := hand_contact_threshold
+				var offset *mmath.MVec3
+				for _, boneNameA := range hand_contact_bone_names {
+					for _, boneNameB := range hand_contact_bone_names {
+						originalDeltaA := contactSetA.originalAllDeltas[index].Bones.GetByName(
+							boneNameA.StringFromDirection(directionA))
+						originalDeltaB := contactSetB.originalAllDeltas[index].Bones.GetByName(
+							boneNameB.StringFromDirection(directionB))
+						sizingDeltaA := contactSetA.sizingAllDeltas[index].Bones.GetByName(
+							boneNameA.StringFromDirection(directionA))
+						sizingDeltaB := contactSetB.sizingAllDeltas[index].Bones.GetByName(
+							boneNameB.StringFromDirection(directionB))
+						if originalDeltaA == nil || originalDeltaB == nil || sizingDeltaA == nil || sizingDeltaB == nil {
+							// 指先が無いモデルの場合
+							continue
+						}
+
+						originalA := originalDeltaA.FilledGlobalPosition()
+						originalB := originalDeltaB.FilledGlobalPosition()
+
+						distance := originalA.Distance(originalB)
+						if distance >= minDistance {
+							continue
+						}
+						minDistance = distance
+
+						sizingA := sizingDeltaA.FilledGlobalPosition()
+						sizingB := sizingDeltaB.FilledGlobalPosition()
+
+						// サイジング後の位置関係と、元の位置関係の差
+						offset = sizingB.Subed(sizingA).Subed(originalB.Subed(originalA)).MuledScalar(0.5)
+					}
+				}
+
+				if offset == nil {
+					continue
+				}
+
+				contactSetA.addOffset(da, index, offset)
+				contactSetB.addOffset(db, index, offset.MuledScalar(-1))
+			}
+		}
+	}
+}
+
+// addOffset は手首の移動量を加算します。
+func (contactSet *handContactSet) addOffset(d, index int, offset *mmath.MVec3) {
+	if contactSet.wristOffsets[d][index] == nil {
+		contactSet.wristOffsets[d][index] = offset
+	} else {
+		contactSet.wristOffsets[d][index] = contactSet.wristOffsets[d][index].Added(offset)
+	}
+	contactSet.offsetCounts[d][index]++
+}
+
+// updateOutputMotion は手首の移動量から、IKで腕系の回転を求めて出力モーションに反映します。
+func (su *SizingHandContactUsecase) updateOutputMotion(ctx context.Context, contactSet *handContactSet) (bool, error) {
+	sizingSet := contactSet.sizingSet
+
+	// IK計算用に、補正前のモーションを残しておく
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	isExec := false
+	for d, direction := range directions {
+		contactFlags := make([]bool, len(contactSet.wristOffsets[d]))
+		for index, offset := range contactSet.wristOffsets[d] {
+			if offset != nil {
+				contactSet.wristOffsets[d][index] = offset.MuledScalar(1 / float64(contactSet.offsetCounts[d][index]))
+				contactFlags[index] = true
+			}
+		}
+		offsets := easeContactValues(contactSet.wristOffsets[d], contactFlags, hand_contact_ease_frames, scaleOffset)
+
+		isExecDirection, err := insertWristOffsets(ctx, sizingSet, sizingProcessMotion,
+			contactSet.sizingAllDeltas, d, direction, offsets)
+		if err != nil {
+			return false, err
+		}
+		isExec = isExecDirection || isExec
+	}
+
+	if isExec {
+		mlog.I(mi18n.T("手接触維持結果", map[string]interface{}{"No": sizingSet.Index + 1}))
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("手接触維持02", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	return isExec, nil
+}
+
+func (su *SizingHandContactUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalWristBone, BoneName: pmx.WRIST},
+			{CheckFunk: sizingSet.OriginalWristTailBone, BoneName: pmx.WRIST_TAIL},
+		},
+		[]domain.CheckTrunkBoneType{},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.SizingElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.SizingWristBone, BoneName: pmx.WRIST},
+		},
+	)
+}
@@ -0,0 +1,276 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain/base_model"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/repository"
+)
+
+// update true の場合、比較せずにゴールデンを出力し直す
+//
+//	go test ./pkg/usecase/ -run Golden -update
+//
+// ゴールデンは補正を変更する前のコードの結果を記録しておくもので、変更後のコードで出力し直すと退行を検出できない
+// 足・上半身・肩・腕スタンスのゴールデンは、テストを追加したコミット(補正の変更前)をチェックアウトして出力し、
+// testdata/golden にコミットする
+var update = flag.Bool("update", false, "update golden files")
+
+// golden_position_tolerance ゴールデンと比較するグローバル位置の許容誤差
+const golden_position_tolerance = 0.05
+
+// fixture_frame_count フィクスチャモーションのフレーム数
+const fixture_frame_count = 30
+
+var (
+	fixtureOnce sync.Once
+	fixtureDir  string
+	fixtureErr  error
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if fixtureDir != "" {
+		os.RemoveAll(fixtureDir)
+	}
+	os.Exit(code)
+}
+
+// fixturePaths フィクスチャのモデル・モーションを一時ディレクトリに生成して、パスを返す
+// 元モデルは素体モデル、サイジング先モデルは素体モデルを縦長にフィッティングしたモデル
+func fixturePaths(t *testing.T) (originalModelPath, sizingModelPath, motionPath string) {
+	t.Helper()
+
+	fixtureOnce.Do(func() {
+		fixtureDir, fixtureErr = os.MkdirTemp("", "vmd_sizing_fixture")
+		if fixtureErr != nil {
+			return
+		}
+
+		if fixtureErr = createFixtureSizingModel(filepath.Join(fixtureDir, "sizing.pmx")); fixtureErr != nil {
+			return
+		}
+		fixtureErr = createFixtureMotion(filepath.Join(fixtureDir, "motion.vmd"))
+	})
+
+	if fixtureErr != nil {
+		t.Fatalf("failed to create fixtures: %v", fixtureErr)
+	}
+
+	originalModelPath, err := base_model.ModelPath()
+	if err != nil {
+		t.Fatalf("failed to extract base model: %v", err)
+	}
+
+	return originalModelPath, filepath.Join(fixtureDir, "sizing.pmx"), filepath.Join(fixtureDir, "motion.vmd")
+}
+
+// createFixtureSizingModel 素体モデルを横1.1倍・縦1.2倍にフィッティングしたサイジング先モデルを出力する
+func createFixtureSizingModel(path string) error {
+	baseModelPath, err := base_model.ModelPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := repository.NewPmxRepository(false).Load(baseModelPath)
+	if err != nil {
+		return err
+	}
+	model := data.(*pmx.PmxModel)
+
+	layout := &domain.JsonBoneLayout{Name: "fixture", Bones: make([]*domain.JsonLayoutBone, 0)}
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		layout.Bones = append(layout.Bones, &domain.JsonLayoutBone{
+			Name:     bone.Name(),
+			Position: &mmath.MVec3{X: bone.Position.X * 1.1, Y: bone.Position.Y * 1.2, Z: bone.Position.Z * 1.1},
+		})
+		return true
+	})
+	domain.FitBaseModel(model, layout)
+
+	return repository.NewPmxRepository(false).Save(path, model, false)
+}
+
+// createFixtureMotion 歩く・しゃがむ・腕を振る程度の短いモーションを出力する
+func createFixtureMotion(path string) error {
+	motion := vmd.NewVmdMotion(path)
+
+	insertFrame := func(boneName string, frame int, position *mmath.MVec3, axis *mmath.MVec3, degree float64) {
+		bf := vmd.NewBoneFrame(float32(frame))
+		if position != nil {
+			bf.Position = position
+		}
+		if axis != nil {
+			bf.Rotation = mmath.NewMQuaternionFromAxisAngles(axis, degree*math.Pi/180)
+		}
+		motion.InsertBoneFrame(boneName, bf)
+	}
+
+	xAxis := &mmath.MVec3{X: 1}
+	zAxis := &mmath.MVec3{Z: 1}
+
+	for _, frame := range []int{0, 10, 20, fixture_frame_count} {
+		phase := math.Sin(float64(frame) / fixture_frame_count * 2 * math.Pi)
+
+		insertFrame(pmx.CENTER.String(), frame, &mmath.MVec3{X: phase * 2, Y: -math.Abs(phase) * 1.5, Z: float64(frame) * 0.2}, nil, 0)
+		insertFrame(pmx.UPPER.String(), frame, nil, xAxis, 10*phase)
+		insertFrame(pmx.LOWER.String(), frame, nil, xAxis, -5*phase)
+
+		insertFrame(pmx.LEG_IK.Left(), frame, &mmath.MVec3{Z: float64(frame)*0.2 + phase*2, Y: max(0, phase) * 1.5}, nil, 0)
+		insertFrame(pmx.LEG_IK.Right(), frame, &mmath.MVec3{Z: float64(frame)*0.2 - phase*2, Y: max(0, -phase) * 1.5}, nil, 0)
+
+		insertFrame(pmx.SHOULDER.Left(), frame, nil, zAxis, 5*phase)
+		insertFrame(pmx.SHOULDER.Right(), frame, nil, zAxis, -5*phase)
+		insertFrame(pmx.ARM.Left(), frame, nil, zAxis, 35+20*phase)
+		insertFrame(pmx.ARM.Right(), frame, nil, zAxis, -35+20*phase)
+		insertFrame(pmx.ELBOW.Left(), frame, nil, &mmath.MVec3{Y: 1}, -30*math.Abs(phase))
+		insertFrame(pmx.ELBOW.Right(), frame, nil, &mmath.MVec3{Y: 1}, 30*math.Abs(phase))
+	}
+
+	return repository.NewVmdRepository(false).Save(path, motion, false)
+}
+
+// newFixtureSizingSet フィクスチャを読み込んだサイジングセットを生成する
+func newFixtureSizingSet(t *testing.T) *domain.SizingSet {
+	t.Helper()
+
+	originalModelPath, sizingModelPath, motionPath := fixturePaths(t)
+
+	sizingSet := domain.NewSizingSet(0)
+	if err := sizingSet.LoadOriginalModel(originalModelPath); err != nil {
+		t.Fatalf("failed to load original model: %v", err)
+	}
+	if err := sizingSet.LoadSizingModel(sizingModelPath); err != nil {
+		t.Fatalf("failed to load sizing model: %v", err)
+	}
+	if err := sizingSet.LoadMotion(motionPath); err != nil {
+		t.Fatalf("failed to load motion: %v", err)
+	}
+
+	return sizingSet
+}
+
+// goldenPositions ボーン毎・フレーム毎のグローバル位置
+type goldenPositions map[string][]*mmath.MVec3
+
+// deformedPositions サイジング先モデルで出力モーションをデフォームした、ボーンのグローバル位置を求める
+func deformedPositions(t *testing.T, sizingSet *domain.SizingSet, boneNames []string) goldenPositions {
+	t.Helper()
+
+	frames := mmath.IntRanges(fixture_frame_count + 1)
+	allDeltas, err := computeVmdDeltas(context.Background(), frames, len(frames), sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, boneNames, "", nil)
+	if err != nil {
+		t.Fatalf("failed to deform: %v", err)
+	}
+
+	positions := make(goldenPositions, len(boneNames))
+	for _, boneName := range boneNames {
+		positions[boneName] = make([]*mmath.MVec3, len(frames))
+		for i, vmdDeltas := range allDeltas {
+			if boneDelta := vmdDeltas.Bones.GetByName(boneName); boneDelta != nil {
+				positions[boneName][i] = boneDelta.FilledGlobalPosition().Copy()
+			}
+		}
+	}
+
+	return positions
+}
+
+// assertGolden ゴールデンと比較する(-update の場合はゴールデンを出力する)
+// ゴールデンが無い場合は、比較できないので失敗とする
+func assertGolden(t *testing.T, name string, positions goldenPositions) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "golden", name+".json")
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		output, err := json.MarshalIndent(positions, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("golden not found: %s (run with -update to create)", path)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(goldenPositions)
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatalf("invalid golden: %s: %v", path, err)
+	}
+
+	for boneName, expectedPositions := range expected {
+		actualPositions, ok := positions[boneName]
+		if !ok {
+			t.Errorf("%s: bone not deformed", boneName)
+			continue
+		}
+		for frame, expectedPosition := range expectedPositions {
+			if frame >= len(actualPositions) {
+				t.Errorf("%s: frame %d not deformed", boneName, frame)
+				break
+			}
+			if diff := positionDiff(expectedPosition, actualPositions[frame]); diff > golden_position_tolerance {
+				t.Errorf("%s [%d]: expected %v, got %v (diff %.4f)",
+					boneName, frame, expectedPosition, actualPositions[frame], diff)
+			}
+		}
+	}
+}
+
+// positionDiff 2つの位置の距離(片方のみnilの場合は無限大)
+func positionDiff(a, b *mmath.MVec3) float64 {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return a.Distance(b)
+}
+
+// runGoldenUsecase 補正を実行し、対象ボーンのデフォーム結果をゴールデンと比較する
+func runGoldenUsecase(
+	t *testing.T, name string, boneNames []string,
+	setup func(sizingSet *domain.SizingSet),
+	exec func(ctx context.Context, sizingSet *domain.SizingSet) (bool, error),
+) {
+	t.Helper()
+
+	sizingSet := newFixtureSizingSet(t)
+	setup(sizingSet)
+
+	isExec, err := exec(context.Background(), sizingSet)
+	if err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+	if !isExec {
+		t.Fatalf("%s was not executed", name)
+	}
+
+	assertGolden(t, name, deformedPositions(t, sizingSet, boneNames))
+}
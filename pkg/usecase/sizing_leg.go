@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
@@ -25,7 +26,7 @@ func NewSizingLegUsecase() *SizingLegUsecase {
 
 // SizingLeg は、足補正処理を行います。
 func (su *SizingLegUsecase) Exec(
-	sizingSet *domain.SizingSet, moveScale *mmath.MVec3, sizingSetCount int, incrementCompletedCount func(),
+	ctx context.Context, sizingSet *domain.SizingSet, moveScale *mmath.MVec3, sizingSetCount int, incrementCompletedCount func(),
 ) (bool, error) {
 	// 対象外の場合は何もせず終了
 	if !sizingSet.IsSizingLeg || sizingSet.CompletedSizingLeg {
@@ -42,8 +43,7 @@ func (su *SizingLegUsecase) Exec(
 
 	// 処理対象ボーンチェック
 	if err := su.checkBones(sizingSet); err != nil {
-		// エラーは上には返さない
-		return false, nil
+		return false, err
 	}
 
 	allFrames := mmath.IntRanges(int(originalMotion.MaxFrame()))
@@ -52,28 +52,28 @@ func (su *SizingLegUsecase) Exec(
 	// [焼き込み] -----------------------
 
 	// 元モデルのデフォーム結果を並列処理で取得
-	originalAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.OriginalConfigModel,
-		originalMotion, sizingSet, true, all_lower_leg_bone_names, "足補正01", incrementCompletedCount)
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		originalMotion, sizingSet, true, shared_original_bone_names, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	// 元モデルのモーフデフォーム結果を並列処理で取得
-	originalMorphAllDeltas, err := computeMorphVmdDeltas(allFrames, blockSize, sizingSet.OriginalConfigModel,
-		originalMotion, sizingSet, all_lower_leg_bone_names, "足補正01", incrementCompletedCount)
+	originalMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		originalMotion, sizingSet, shared_original_bone_names, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	// 先モデルのモーフデフォーム結果を並列処理で取得
-	sizingMorphAllDeltas, err := computeMorphVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
-		originalMotion, sizingSet, all_lower_leg_bone_names, "足補正01", incrementCompletedCount)
+	sizingMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		originalMotion, sizingSet, shared_original_bone_names, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	// サイジング先モデルに対して FK 焼き込み処理
-	if err := su.updateLegFK(sizingSet, sizingProcessMotion, originalAllDeltas, incrementCompletedCount); err != nil {
+	if err := su.updateLegFK(ctx, sizingSet, sizingProcessMotion, originalAllDeltas, incrementCompletedCount); err != nil {
 		return false, err
 	}
 
@@ -86,28 +86,14 @@ func (su *SizingLegUsecase) Exec(
 
 	// [下半身] -----------------------
 
+	// 下半身の回転は下半身補正で合わせるので、足補正では動かさない
 	// 先モデルの足中心までのデフォーム結果を並列処理で取得
-	sizingAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		sizingProcessMotion, sizingSet, false, trunk_lower_bone_names, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
-	// 下半身補正を実施
-	lowerRotations, err := su.calculateAdjustedLower(sizingSet, allFrames, blockSize, moveScale,
-		originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas,
-		sizingProcessMotion, incrementCompletedCount, "足02")
-	if err != nil {
-		return false, err
-	}
-
-	// 下半身回転をサイジング先モーションに反映
-	su.updateLower(sizingSet, allFrames, sizingProcessMotion, lowerRotations, incrementCompletedCount)
-
-	if mlog.IsDebug() {
-		outputVerboseMotion("足03", sizingSet.OutputMotionPath, sizingProcessMotion)
-	}
-
 	// [足IK] -----------------------
 
 	// 足IK親 キーフレームのリセット
@@ -115,7 +101,7 @@ func (su *SizingLegUsecase) Exec(
 	sizingProcessMotion.BoneFrames.Update(vmd.NewBoneNameFrames(pmx.LEG_IK_PARENT.Right()))
 
 	// 先モデルの足のIK OFF状態でのデフォーム結果を並列処理で取得
-	sizingAllDeltas, err = computeVmdDeltasWithDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingAllDeltas, err = computeVmdDeltasWithDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		sizingProcessMotion, sizingAllDeltas, sizingSet, false, lowerBoneNames, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
@@ -123,7 +109,7 @@ func (su *SizingLegUsecase) Exec(
 
 	// 足IK 補正処理
 	legIkPositions, legIkRotations, legRotations, ankleRotations, err :=
-		su.calculateAdjustedLegIk(sizingSet, allFrames, blockSize, moveScale,
+		su.calculateAdjustedLegIk(ctx, sizingSet, allFrames, blockSize, moveScale,
 			originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas,
 			sizingProcessMotion, incrementCompletedCount, "足04")
 	if err != nil {
@@ -145,7 +131,7 @@ func (su *SizingLegUsecase) Exec(
 	// [センター] -----------------------
 
 	// 先モデルの足FK補正デフォーム結果を並列処理で取得
-	sizingAllDeltas, err = computeVmdDeltasWithDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingAllDeltas, err = computeVmdDeltasWithDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		sizingProcessMotion, sizingAllDeltas, sizingSet, false, lowerBoneNames, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
@@ -153,7 +139,7 @@ func (su *SizingLegUsecase) Exec(
 
 	// センター・グルーブ補正を実施
 	rootPositions, centerPositions, groovePositions, isActiveGroove, err :=
-		su.calculateAdjustedCenter(sizingSet, allFrames, blockSize, moveScale,
+		su.calculateAdjustedCenter(ctx, sizingSet, allFrames, blockSize, moveScale,
 			originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas, legIkPositions,
 			sizingProcessMotion, incrementCompletedCount, "足06")
 	if err != nil {
@@ -176,7 +162,7 @@ func (su *SizingLegUsecase) Exec(
 	// [足IK2回目] -----------------------
 
 	// 先モデルの足FK補正デフォーム結果を並列処理で取得
-	sizingLegIkOffAllDeltas, err := computeVmdDeltasWithDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingLegIkOffAllDeltas, err := computeVmdDeltasWithDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		sizingProcessMotion, sizingAllDeltas, sizingSet, false, lowerBoneNames, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
@@ -186,7 +172,7 @@ func (su *SizingLegUsecase) Exec(
 	su.insertIKFrames(sizingSet, sizingProcessMotion, true)
 
 	// 先モデルの足FK補正デフォーム結果を並列処理で取得
-	sizingLegIkOnAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingLegIkOnAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		sizingProcessMotion, sizingSet, true, lowerBoneNames, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
@@ -194,7 +180,7 @@ func (su *SizingLegUsecase) Exec(
 
 	// 足IK 補正処理
 	legIkPositions, legIkRotations, legRotations, kneeRotations, ankleRotations, toeExRotations, err :=
-		su.calculateAdjustedLegIk2(sizingSet, allFrames, blockSize, moveScale,
+		su.calculateAdjustedLegIk2(ctx, sizingSet, allFrames, blockSize, moveScale,
 			originalAllDeltas, sizingLegIkOffAllDeltas, sizingLegIkOnAllDeltas,
 			originalMorphAllDeltas, sizingMorphAllDeltas,
 			sizingProcessMotion, incrementCompletedCount, "足08")
@@ -241,7 +227,7 @@ func (su *SizingLegUsecase) Exec(
 
 	// 足補正処理の結果をサイジング先モーションに反映
 	if err = su.updateOutputMotion(
-		sizingSet, allFrames, blockSize, isActiveGroove, sizingProcessMotion, legScale, "足11",
+		ctx, sizingSet, allFrames, blockSize, isActiveGroove, sizingProcessMotion, legScale, "足11",
 		incrementCompletedCount,
 	); err != nil {
 		return false, err
@@ -265,12 +251,12 @@ func (su *SizingLegUsecase) Exec(
 
 // updateLegFK は、デフォーム結果から FK 回転をサイジング先モーションに焼き込みます。
 func (su *SizingLegUsecase) updateLegFK(
-	sizingSet *domain.SizingSet, sizingProcessMotion *vmd.VmdMotion, allDeltas []*delta.VmdDeltas,
+	ctx context.Context, sizingSet *domain.SizingSet, sizingProcessMotion *vmd.VmdMotion, allDeltas []*delta.VmdDeltas,
 	incrementCompletedCount func(),
 ) error {
 	for i, vmdDeltas := range allDeltas {
-		if sizingSet.IsTerminate {
-			return merr.NewTerminateError("manual terminate")
+		if err := checkTerminate(ctx); err != nil {
+			return err
 		}
 		// 足・ひざ・足首の回転補正
 		for _, boneName := range []string{
@@ -322,210 +308,6 @@ func (su *SizingLegUsecase) newIkEnableFrameWithBone(boneName string, enabled bo
 	return frame
 }
 
-func (su *SizingLegUsecase) createLowerIkBone(sizingSet *domain.SizingSet, direction pmx.BoneDirection) *pmx.Bone {
-	lowerBone := sizingSet.SizingLowerBone()
-	var ikTargetBone *pmx.Bone
-	switch direction {
-	case pmx.BONE_DIRECTION_TRUNK:
-		ikTargetBone = sizingSet.SizingLegCenterBone()
-	default:
-		ikTargetBone, _ = sizingSet.SizingConfigModel.Bones.GetLeg(direction)
-	}
-
-	// 下半身IK
-	ikBone := pmx.NewBoneByName(fmt.Sprintf("%s%sIk", pmx.MLIB_PREFIX, lowerBone.Name()))
-	ikBone.Position = ikTargetBone.Position.Copy()
-	ikBone.Ik = pmx.NewIk()
-	ikBone.Ik.BoneIndex = ikTargetBone.Index()
-	ikBone.Ik.LoopCount = 10
-	ikBone.Ik.UnitRotation = &mmath.MVec3{X: 1, Y: 0.0, Z: 0.0}
-	ikBone.Ik.Links = make([]*pmx.IkLink, 0)
-	for _, parentBoneIndex := range ikTargetBone.ParentBoneIndexes {
-		link := pmx.NewIkLink()
-		link.BoneIndex = parentBoneIndex
-		if parentBoneIndex != lowerBone.Index() {
-			// 下半身以外は動かさない
-			link.AngleLimit = true
-		}
-		ikBone.Ik.Links = append(ikBone.Ik.Links, link)
-
-		if parentBoneIndex == lowerBone.Index() {
-			// 下半身までいったら終了
-			break
-		}
-	}
-
-	return ikBone
-}
-
-// calculateAdjustedCenter は、センターおよびグルーブの位置補正を並列処理で計算します。
-func (su *SizingLegUsecase) calculateAdjustedLower(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
-	originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas,
-	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), debugMotionKey string,
-) (sizingLowerResultRotations []*mmath.MQuaternion, err error) {
-	sizingLowerResultRotations = make([]*mmath.MQuaternion, len(allFrames))
-
-	lowerIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_TRUNK)
-	// leftLegIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_LEFT)
-	// rightLegIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_RIGHT)
-
-	debugBoneNames := []pmx.StandardBoneName{
-		pmx.LOWER, pmx.LEG_CENTER, pmx.LEG, pmx.HIP,
-	}
-	debugPositions, debugRotations := newDebugData(allFrames, debugBoneNames)
-
-	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
-		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
-			}
-			frame := float32(iFrame)
-
-			// 下半身から足中心の傾き
-			originalMorphLowerDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
-			originalMorphLegCenterDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
-			originalMorphLeftLegDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
-			originalMorphRightLegDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
-			sizingMorphLowerDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
-			sizingMorphLegCenterDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
-			sizingMorphLeftLegDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
-			sizingMorphRightLegDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
-
-			// 下半身と足中心の相対位置
-			originalMorphLegCenterRelativePosition := originalMorphLegCenterDelta.FilledGlobalPosition().Subed(
-				originalMorphLowerDelta.FilledGlobalPosition())
-			sizingMorphLegCenterRelativePosition := sizingMorphLegCenterDelta.FilledGlobalPosition().Subed(
-				sizingMorphLowerDelta.FilledGlobalPosition())
-
-			// 真下から足中心までの傾き
-			originalLegSlope := mmath.NewMQuaternionRotate(mmath.MVec3UnitYNeg, originalMorphLegCenterRelativePosition.Normalized())
-			sizingLegSlope := mmath.NewMQuaternionRotate(mmath.MVec3UnitYNeg, sizingMorphLegCenterRelativePosition.Normalized())
-			sizingLegSlopeMat := sizingLegSlope.ToMat4()
-
-			// 下半身の長さ
-			originalLowerHeight := originalMorphLowerDelta.FilledGlobalPosition().Distance(originalMorphLegCenterDelta.FilledGlobalPosition())
-			sizingLowerHeight := sizingMorphLowerDelta.FilledGlobalPosition().Distance(sizingMorphLegCenterDelta.FilledGlobalPosition())
-
-			// 足幅
-			originalLegWidth := originalMorphLeftLegDelta.FilledGlobalPosition().Distance(originalMorphRightLegDelta.FilledGlobalPosition())
-			sizingLegWidth := sizingMorphLeftLegDelta.FilledGlobalPosition().Distance(sizingMorphRightLegDelta.FilledGlobalPosition())
-
-			legCenterFromLowerScale := &mmath.MVec3{
-				X: sizingLegWidth / originalLegWidth,
-				Y: sizingLowerHeight / originalLowerHeight,
-				Z: 1.0}
-
-			// -------------------------
-
-			originalLowerRootDelta := originalAllDeltas[index].Bones.GetByName(pmx.LOWER_ROOT.String())
-			originalLowerDelta := originalAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
-			originalLegCenterDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
-			originalLeftLegDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
-			originalRightLegDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
-
-			// 下半身の軸回転を取得
-			lowerTwistQuat, _ := originalLowerDelta.FilledFrameRotation().SeparateTwistByAxis(mmath.MVec3UnitYNeg)
-			lowerTwistMat := lowerTwistQuat.ToMat4()
-
-			// 下半身根元に下半身の軸回転を加えたところから見た足ボーンのローカル位置
-			originalLegCenterLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
-				lowerTwistMat).Inverted().MulVec3(originalLegCenterDelta.FilledGlobalPosition())
-			originalLeftLegLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
-				lowerTwistMat).Inverted().MulVec3(originalLeftLegDelta.FilledGlobalPosition())
-			originalRightLegLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
-				lowerTwistMat).Inverted().MulVec3(originalRightLegDelta.FilledGlobalPosition())
-
-			// 真っ直ぐにしたときのローカル位置
-			originalLegCenterVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalLegCenterLocalPosition).Truncate(1e-3)
-			originalLeftLegVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalLeftLegLocalPosition).Truncate(1e-3)
-			originalRightLegVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalRightLegLocalPosition).Truncate(1e-3)
-
-			// スケール差を考慮した先の足ボーンのローカル位置
-			sizingLegCenterVerticalLocalPosition := originalLegCenterVerticalLocalPosition.Muled(legCenterFromLowerScale)
-			sizingLeftLegVerticalLocalPosition := originalLeftLegVerticalLocalPosition.Muled(legCenterFromLowerScale)
-			sizingRightLegVerticalLocalPosition := originalRightLegVerticalLocalPosition.Muled(legCenterFromLowerScale)
-
-			sizingLowerRootDelta := sizingAllDeltas[index].Bones.GetByName(pmx.LOWER_ROOT.String())
-			sizingLegCenterIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
-				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingLegCenterVerticalLocalPosition)
-			sizingLeftLegIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
-				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingLeftLegVerticalLocalPosition)
-			sizingRightLegIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
-				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingRightLegVerticalLocalPosition)
-
-			if mlog.IsDebug() {
-				recordDebugData(index, debugBoneNames, originalAllDeltas[index],
-					debugTargetOriginal, debugTypeInitial, debugPositions, debugRotations)
-				recordDebugData(index, debugBoneNames, sizingAllDeltas[index],
-					debugTargetSizing, debugTypeInitial, debugPositions, debugRotations)
-
-				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG_CENTER.String()][index] = sizingLegCenterIdealGlobalPosition.Copy()
-				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG.Left()][index] = sizingLeftLegIdealGlobalPosition.Copy()
-				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG.Right()][index] = sizingRightLegIdealGlobalPosition.Copy()
-			}
-
-			// IK解決
-			sizingLowerDeltas, _ := deform.DeformIks(sizingSet.SizingConfigModel, sizingProcessMotion,
-				sizingAllDeltas[index], frame,
-				[]*pmx.Bone{lowerIkBone},
-				[]*pmx.Bone{sizingSet.SizingLegCenterBone()},
-				[]*mmath.MVec3{sizingLegCenterIdealGlobalPosition},
-				trunk_lower_bone_names, 0.1*moveScale.X, false, false)
-
-			sizingLowerResultDelta := sizingLowerDeltas.Bones.GetByName(pmx.LOWER.String())
-			sizingLowerResultRotations[index] = sizingLowerResultDelta.FilledFrameRotation().Copy()
-
-			if mlog.IsDebug() {
-				recordDebugData(index, debugBoneNames, sizingLowerDeltas,
-					debugTargetSizing, debugTypeResult, debugPositions, debugRotations)
-			}
-
-			{
-				// デフォーム情報を更新するため、クリア
-				sizingLowerDelta := sizingAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
-				sizingAllDeltas[index].Bones.Delete(sizingLowerDelta.Bone.Index())
-			}
-
-			incrementCompletedCount()
-
-			return nil
-		},
-		func(iterIndex, allCount int) {
-			processLog("足補正03", sizingSet.Index, iterIndex, allCount)
-		})
-	if err != nil {
-		return nil, err
-	}
-
-	if mlog.IsDebug() {
-		outputDebugData(allFrames, debugBoneNames, debugMotionKey, sizingSet.OutputMotionPath, sizingSet.SizingConfigModel, debugPositions, debugRotations)
-	}
-
-	return sizingLowerResultRotations, nil
-}
-
-// updateLower は、補正した下半身回転をサイジング先モーションに反映します。
-func (su *SizingLegUsecase) updateLower(
-	sizingSet *domain.SizingSet, allFrames []int, sizingProcessMotion *vmd.VmdMotion,
-	lowerRotations []*mmath.MQuaternion, incrementCompletedCount func(),
-) {
-	for i, iFrame := range allFrames {
-		frame := float32(iFrame)
-		{
-			bf := sizingProcessMotion.BoneFrames.Get(sizingSet.SizingLowerBone().Name()).Get(frame)
-			bf.Rotation = lowerRotations[i]
-			sizingProcessMotion.InsertBoneFrame(sizingSet.SizingLowerBone().Name(), bf)
-		}
-
-		if i > 0 && i%1000 == 0 {
-			processLog("足補正04", sizingSet.Index, i, len(allFrames))
-		}
-
-		incrementCompletedCount()
-	}
-}
-
 func (su *SizingLegUsecase) createKneeIkBone(sizingSet *domain.SizingSet, direction pmx.BoneDirection, tailBone *pmx.Bone) (
 	ikBone *pmx.Bone,
 ) {
@@ -569,7 +351,7 @@ func (su *SizingLegUsecase) createKneeIkBone(sizingSet *domain.SizingSet, direct
 
 // calculateAdjustedLegIk は、足IK 補正の計算を並列処理で行い、各フレームごとの位置・回転補正値を算出します。
 func (su *SizingLegUsecase) calculateAdjustedLegIk(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
 	originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas,
 	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), verboseMotionKey string,
 ) (legIkPositions [][]*mmath.MVec3,
@@ -611,8 +393,8 @@ func (su *SizingLegUsecase) calculateAdjustedLegIk(
 
 	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			for d, direction := range directions {
@@ -854,7 +636,7 @@ func (su *SizingLegUsecase) updateLegIkAndFk(
 
 // calculateAdjustedCenter は、センターおよびグルーブの位置補正を並列処理で計算します。
 func (su *SizingLegUsecase) calculateAdjustedCenter(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
 	originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas, legIkPositions [][]*mmath.MVec3,
 	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), debugMotionKey string,
 ) (
@@ -880,8 +662,8 @@ func (su *SizingLegUsecase) calculateAdjustedCenter(
 
 	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 			frame := float32(iFrame)
 
@@ -1119,7 +901,7 @@ func (su *SizingLegUsecase) createAnkleIkBone(sizingSet *domain.SizingSet, direc
 
 // calculateAdjustedLegIk は、足IK 補正の計算を並列処理で行い、各フレームごとの位置・回転補正値を算出します。
 func (su *SizingLegUsecase) calculateAdjustedLegIk2(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
 	originalAllDeltas, sizingLegIkOffAllDeltas, sizingLegIkOnAllDeltas,
 	originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas,
 	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), verboseMotionKey string,
@@ -1181,8 +963,8 @@ func (su *SizingLegUsecase) calculateAdjustedLegIk2(
 
 	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
 		func(index, iFrame int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			originalLeftLegDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
@@ -1639,7 +1421,7 @@ type boneCheck struct {
 }
 
 func (su *SizingLegUsecase) updateOutputMotion(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, isActiveGroove bool,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, isActiveGroove bool,
 	sizingProcessMotion *vmd.VmdMotion, legScale float64, verboseMotionKey string, incrementCompletedCount func(),
 ) error {
 	// 足補正処理の結果をサイジング先モーションに反映
@@ -1661,7 +1443,7 @@ func (su *SizingLegUsecase) updateOutputMotion(
 	outputMotion.BoneFrames.Update(vmd.NewBoneNameFrames(pmx.TOE_IK.Left()))
 	outputMotion.BoneFrames.Update(vmd.NewBoneNameFrames(pmx.TOE_IK.Right()))
 
-	processAllDeltas, err := computeVmdDeltas(allFrames, blockSize,
+	processAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize,
 		sizingModel, sizingProcessMotion, sizingSet, true, all_lower_leg_bone_names, "足補正01", incrementCompletedCount)
 	if err != nil {
 		return err
@@ -1716,13 +1498,13 @@ func (su *SizingLegUsecase) updateOutputMotion(
 			prevLog := 0
 			prevFrame := 0
 			for fIndex, iFrame := range targetFrames {
-				if sizingSet.IsTerminate {
-					return merr.NewTerminateError("manual terminate")
+				if err := checkTerminate(ctx); err != nil {
+					return err
 				}
 				frame := float32(iFrame)
 
 				// 現時点の結果
-				resultDeltas, err := computeVmdDeltas([]int{iFrame}, 1,
+				resultDeltas, err := computeVmdDeltas(ctx, []int{iFrame}, 1,
 					sizingModel, outputMotion, sizingSet, true, trunk_lower_bone_names, "", nil)
 				if err != nil {
 					return err
@@ -1810,13 +1592,13 @@ func (su *SizingLegUsecase) updateOutputMotion(
 				prevLog := 0
 				prevFrame := 0
 				for fIndex, iFrame := range targetFrames {
-					if sizingSet.IsTerminate {
-						return merr.NewTerminateError("manual terminate")
+					if err := checkTerminate(ctx); err != nil {
+						return err
 					}
 					frame := float32(iFrame)
 
 					// 現時点の結果
-					resultDeltas, err := computeVmdDeltas([]int{iFrame}, 1,
+					resultDeltas, err := computeVmdDeltas(ctx, []int{iFrame}, 1,
 						sizingModel, outputMotion, sizingSet, true, leg_direction_bone_names[d], "", nil)
 					if err != nil {
 						return err
@@ -1889,44 +1671,20 @@ func (su *SizingLegUsecase) updateLegIkOffset(
 	allFrames []int, legScale float64, verboseMotionKey string,
 ) {
 	// 元モーションのIKが動いていない区間を取得
-	fixIkFlags := make([][]bool, len(directions))
-	fixIkFlags[0] = make([]bool, len(allFrames))
-	fixIkFlags[1] = make([]bool, len(allFrames))
+	fixIkFlags := detectFootContactFlags(originalAllDeltas)
 
 	debugBoneNames := []pmx.StandardBoneName{pmx.ANKLE}
 	debugPositions, debugRotations := newDebugData(allFrames, debugBoneNames)
 
 	for i, originalDeltas := range originalAllDeltas {
-		for d, direction := range directions {
-			if i == 0 {
-				fixIkFlags[d][i] = false
-
-				if mlog.IsDebug() {
-					recordDebugDataDirection(i, debugBoneNames, direction, originalDeltas,
-						debugTargetOriginal, debugTypeInitial, debugPositions, debugRotations)
-				}
-
-				continue
-			}
-
-			// 足IK親などで動かされている場合もあるので、足IKのグローバル位置で判定
-			// 足首だと、足IKの結果で少し沈んだ時とかに誤判定してしまう
-			legBoneName := pmx.LEG_IK.StringFromDirection(direction)
-			nowLegIkPosition := originalDeltas.Bones.GetByName(legBoneName).FilledGlobalPosition()
-			prevLegIkPosition := originalAllDeltas[i-1].Bones.GetByName(legBoneName).FilledGlobalPosition()
-
-			if nowLegIkPosition.Distance(prevLegIkPosition) < 0.005 {
-				fixIkFlags[d][i] = true
-
-				if mlog.IsDebug() {
-					recordDebugDataDirection(i, debugBoneNames, direction, originalDeltas,
-						debugTargetOriginal, debugTypeInitial, debugPositions, debugRotations)
-				}
-			} else {
-				if mlog.IsDebug() {
-					recordDebugDataDirection(i, debugBoneNames, direction, originalDeltas,
-						debugTargetSizing, debugTypeInitial, debugPositions, debugRotations)
+		if mlog.IsDebug() {
+			for d, direction := range directions {
+				target := debugTargetSizing
+				if i == 0 || fixIkFlags[d][i] {
+					target = debugTargetOriginal
 				}
+				recordDebugDataDirection(i, debugBoneNames, direction, originalDeltas,
+					target, debugTypeInitial, debugPositions, debugRotations)
 			}
 		}
 
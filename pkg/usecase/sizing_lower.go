@@ -0,0 +1,333 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+	"github.com/miu200521358/mlib_go/pkg/usecase/deform"
+)
+
+type SizingLowerUsecase struct {
+}
+
+func NewSizingLowerUsecase() *SizingLowerUsecase {
+	return &SizingLowerUsecase{}
+}
+
+// Exec は、下半身から足中心への向きが元モデルと同じになるように、下半身の回転だけを補正します。
+// 足IKは動かさないので、足の位置とは別に、骨盤の傾きを合わせるかどうかを選べる
+func (su *SizingLowerUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, moveScale *mmath.MVec3, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingLower || sizingSet.CompletedSizingLower {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("下半身補正開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	originalMotion := sizingSet.OriginalMotion
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	allFrames := mmath.IntRanges(int(originalMotion.MaxFrame()))
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	// 元モデルのデフォーム結果を並列処理で取得
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		originalMotion, sizingSet, true, shared_original_bone_names, "下半身補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	// 元モデルのモーフデフォーム結果を並列処理で取得
+	originalMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		originalMotion, sizingSet, shared_original_bone_names, "下半身補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	// 先モデルのモーフデフォーム結果を並列処理で取得
+	sizingMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		originalMotion, sizingSet, shared_original_bone_names, "下半身補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	// 先モデルの足中心までのデフォーム結果を並列処理で取得
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingProcessMotion, sizingSet, false, trunk_lower_bone_names, "下半身補正01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	// 下半身補正を実施
+	lowerRotations, err := su.calculateAdjustedLower(ctx, sizingSet, allFrames, blockSize, moveScale,
+		originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas,
+		sizingProcessMotion, incrementCompletedCount, "下半身01")
+	if err != nil {
+		return false, err
+	}
+
+	// 下半身回転をサイジング先モーションに反映(足IKはそのまま)
+	keyFrames := getFrames(originalMotion, trunk_lower_bone_names)
+	su.updateLower(sizingSet, allFrames, keyFrames, sizingSet.OutputMotion, lowerRotations, incrementCompletedCount)
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("下半身02", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	sizingSet.CompletedSizingLower = true
+
+	return true, nil
+}
+
+func (su *SizingLowerUsecase) createLowerIkBone(sizingSet *domain.SizingSet, direction pmx.BoneDirection) *pmx.Bone {
+	lowerBone := sizingSet.SizingLowerBone()
+	var ikTargetBone *pmx.Bone
+	switch direction {
+	case pmx.BONE_DIRECTION_TRUNK:
+		ikTargetBone = sizingSet.SizingLegCenterBone()
+	default:
+		ikTargetBone, _ = sizingSet.SizingConfigModel.Bones.GetLeg(direction)
+	}
+
+	// 下半身IK
+	ikBone := pmx.NewBoneByName(fmt.Sprintf("%s%sIk", pmx.MLIB_PREFIX, lowerBone.Name()))
+	ikBone.Position = ikTargetBone.Position.Copy()
+	ikBone.Ik = pmx.NewIk()
+	ikBone.Ik.BoneIndex = ikTargetBone.Index()
+	ikBone.Ik.LoopCount = 10
+	ikBone.Ik.UnitRotation = &mmath.MVec3{X: 1, Y: 0.0, Z: 0.0}
+	ikBone.Ik.Links = make([]*pmx.IkLink, 0)
+	for _, parentBoneIndex := range ikTargetBone.ParentBoneIndexes {
+		link := pmx.NewIkLink()
+		link.BoneIndex = parentBoneIndex
+		if parentBoneIndex != lowerBone.Index() {
+			// 下半身以外は動かさない
+			link.AngleLimit = true
+		}
+		ikBone.Ik.Links = append(ikBone.Ik.Links, link)
+
+		if parentBoneIndex == lowerBone.Index() {
+			// 下半身までいったら終了
+			break
+		}
+	}
+
+	return ikBone
+}
+
+// calculateAdjustedLower は、下半身から足中心への向きが元モデルと同じになる下半身の回転を、並列処理で計算します。
+func (su *SizingLowerUsecase) calculateAdjustedLower(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, moveScale *mmath.MVec3,
+	originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas,
+	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), debugMotionKey string,
+) (sizingLowerResultRotations []*mmath.MQuaternion, err error) {
+	sizingLowerResultRotations = make([]*mmath.MQuaternion, len(allFrames))
+
+	lowerIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_TRUNK)
+	// leftLegIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_LEFT)
+	// rightLegIkBone := su.createLowerIkBone(sizingSet, pmx.BONE_DIRECTION_RIGHT)
+
+	debugBoneNames := []pmx.StandardBoneName{
+		pmx.LOWER, pmx.LEG_CENTER, pmx.LEG, pmx.HIP,
+	}
+	debugPositions, debugRotations := newDebugData(allFrames, debugBoneNames)
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+			frame := float32(iFrame)
+
+			// 下半身から足中心の傾き
+			originalMorphLowerDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
+			originalMorphLegCenterDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
+			originalMorphLeftLegDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
+			originalMorphRightLegDelta := originalMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
+			sizingMorphLowerDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
+			sizingMorphLegCenterDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
+			sizingMorphLeftLegDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
+			sizingMorphRightLegDelta := sizingMorphAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
+
+			// 下半身と足中心の相対位置
+			originalMorphLegCenterRelativePosition := originalMorphLegCenterDelta.FilledGlobalPosition().Subed(
+				originalMorphLowerDelta.FilledGlobalPosition())
+			sizingMorphLegCenterRelativePosition := sizingMorphLegCenterDelta.FilledGlobalPosition().Subed(
+				sizingMorphLowerDelta.FilledGlobalPosition())
+
+			// 真下から足中心までの傾き
+			originalLegSlope := mmath.NewMQuaternionRotate(mmath.MVec3UnitYNeg, originalMorphLegCenterRelativePosition.Normalized())
+			sizingLegSlope := mmath.NewMQuaternionRotate(mmath.MVec3UnitYNeg, sizingMorphLegCenterRelativePosition.Normalized())
+			sizingLegSlopeMat := sizingLegSlope.ToMat4()
+
+			// 下半身の長さ
+			originalLowerHeight := originalMorphLowerDelta.FilledGlobalPosition().Distance(originalMorphLegCenterDelta.FilledGlobalPosition())
+			sizingLowerHeight := sizingMorphLowerDelta.FilledGlobalPosition().Distance(sizingMorphLegCenterDelta.FilledGlobalPosition())
+
+			// 足幅
+			originalLegWidth := originalMorphLeftLegDelta.FilledGlobalPosition().Distance(originalMorphRightLegDelta.FilledGlobalPosition())
+			sizingLegWidth := sizingMorphLeftLegDelta.FilledGlobalPosition().Distance(sizingMorphRightLegDelta.FilledGlobalPosition())
+
+			legCenterFromLowerScale := &mmath.MVec3{
+				X: sizingLegWidth / originalLegWidth,
+				Y: sizingLowerHeight / originalLowerHeight,
+				Z: 1.0}
+
+			// -------------------------
+
+			originalLowerRootDelta := originalAllDeltas[index].Bones.GetByName(pmx.LOWER_ROOT.String())
+			originalLowerDelta := originalAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
+			originalLegCenterDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG_CENTER.String())
+			originalLeftLegDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG.Left())
+			originalRightLegDelta := originalAllDeltas[index].Bones.GetByName(pmx.LEG.Right())
+
+			// 下半身の軸回転を取得
+			lowerTwistQuat, _ := originalLowerDelta.FilledFrameRotation().SeparateTwistByAxis(mmath.MVec3UnitYNeg)
+			lowerTwistMat := lowerTwistQuat.ToMat4()
+
+			// 下半身根元に下半身の軸回転を加えたところから見た足ボーンのローカル位置
+			originalLegCenterLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
+				lowerTwistMat).Inverted().MulVec3(originalLegCenterDelta.FilledGlobalPosition())
+			originalLeftLegLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
+				lowerTwistMat).Inverted().MulVec3(originalLeftLegDelta.FilledGlobalPosition())
+			originalRightLegLocalPosition := originalLowerRootDelta.FilledGlobalMatrix().Copy().Muled(
+				lowerTwistMat).Inverted().MulVec3(originalRightLegDelta.FilledGlobalPosition())
+
+			// 真っ直ぐにしたときのローカル位置
+			originalLegCenterVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalLegCenterLocalPosition).Truncate(1e-3)
+			originalLeftLegVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalLeftLegLocalPosition).Truncate(1e-3)
+			originalRightLegVerticalLocalPosition := originalLegSlope.Inverted().MulVec3(originalRightLegLocalPosition).Truncate(1e-3)
+
+			// スケール差を考慮した先の足ボーンのローカル位置
+			sizingLegCenterVerticalLocalPosition := originalLegCenterVerticalLocalPosition.Muled(legCenterFromLowerScale)
+			sizingLeftLegVerticalLocalPosition := originalLeftLegVerticalLocalPosition.Muled(legCenterFromLowerScale)
+			sizingRightLegVerticalLocalPosition := originalRightLegVerticalLocalPosition.Muled(legCenterFromLowerScale)
+
+			sizingLowerRootDelta := sizingAllDeltas[index].Bones.GetByName(pmx.LOWER_ROOT.String())
+			sizingLegCenterIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
+				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingLegCenterVerticalLocalPosition)
+			sizingLeftLegIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
+				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingLeftLegVerticalLocalPosition)
+			sizingRightLegIdealGlobalPosition := sizingLowerRootDelta.FilledGlobalMatrix().Muled(
+				lowerTwistMat).Muled(sizingLegSlopeMat).MulVec3(sizingRightLegVerticalLocalPosition)
+
+			if mlog.IsDebug() {
+				recordDebugData(index, debugBoneNames, originalAllDeltas[index],
+					debugTargetOriginal, debugTypeInitial, debugPositions, debugRotations)
+				recordDebugData(index, debugBoneNames, sizingAllDeltas[index],
+					debugTargetSizing, debugTypeInitial, debugPositions, debugRotations)
+
+				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG_CENTER.String()][index] = sizingLegCenterIdealGlobalPosition.Copy()
+				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG.Left()][index] = sizingLeftLegIdealGlobalPosition.Copy()
+				debugPositions[debugTargetSizing][debugTypeIdeal][pmx.LEG.Right()][index] = sizingRightLegIdealGlobalPosition.Copy()
+			}
+
+			// IK解決
+			sizingLowerDeltas, _ := deform.DeformIks(sizingSet.SizingConfigModel, sizingProcessMotion,
+				sizingAllDeltas[index], frame,
+				[]*pmx.Bone{lowerIkBone},
+				[]*pmx.Bone{sizingSet.SizingLegCenterBone()},
+				[]*mmath.MVec3{sizingLegCenterIdealGlobalPosition},
+				trunk_lower_bone_names, 0.1*moveScale.X, false, false)
+
+			sizingLowerResultDelta := sizingLowerDeltas.Bones.GetByName(pmx.LOWER.String())
+			sizingLowerResultRotations[index] = sizingLowerResultDelta.FilledFrameRotation().Copy()
+
+			if mlog.IsDebug() {
+				recordDebugData(index, debugBoneNames, sizingLowerDeltas,
+					debugTargetSizing, debugTypeResult, debugPositions, debugRotations)
+			}
+
+			{
+				// デフォーム情報を更新するため、クリア
+				sizingLowerDelta := sizingAllDeltas[index].Bones.GetByName(pmx.LOWER.String())
+				sizingAllDeltas[index].Bones.Delete(sizingLowerDelta.Bone.Index())
+			}
+
+			incrementCompletedCount()
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("下半身補正02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if mlog.IsDebug() {
+		outputDebugData(allFrames, debugBoneNames, debugMotionKey, sizingSet.OutputMotionPath, sizingSet.SizingConfigModel, debugPositions, debugRotations)
+	}
+
+	return sizingLowerResultRotations, nil
+}
+
+// updateLower は、補正した下半身回転をモーションに反映します。
+// キーは元モーションで体幹・下半身系ボーンにキーがあるフレームにだけ打ち、間は補間に任せる
+func (su *SizingLowerUsecase) updateLower(
+	sizingSet *domain.SizingSet, allFrames, keyFrames []int, motion *vmd.VmdMotion,
+	lowerRotations []*mmath.MQuaternion, incrementCompletedCount func(),
+) {
+	keyFrameSet := make(map[int]struct{}, len(keyFrames))
+	for _, iFrame := range keyFrames {
+		keyFrameSet[iFrame] = struct{}{}
+	}
+	if len(keyFrameSet) == 0 {
+		// キーがない場合も、先頭フレームには補正結果を残す
+		keyFrameSet[allFrames[0]] = struct{}{}
+	}
+
+	for i, iFrame := range allFrames {
+		frame := float32(iFrame)
+		if _, ok := keyFrameSet[iFrame]; ok {
+			bf := motion.BoneFrames.Get(sizingSet.SizingLowerBone().Name()).Get(frame)
+			bf.Rotation = lowerRotations[i]
+			motion.InsertBoneFrame(sizingSet.SizingLowerBone().Name(), bf)
+		}
+
+		if i > 0 && i%1000 == 0 {
+			processLog("下半身補正03", sizingSet.Index, i, len(allFrames))
+		}
+
+		incrementCompletedCount()
+	}
+}
+
+func (su *SizingLowerUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.OriginalLowerBone, BoneName: pmx.LOWER},
+			{CheckFunk: sizingSet.OriginalLegCenterBone, BoneName: pmx.LEG_CENTER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalLegBone, BoneName: pmx.LEG},
+		},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingLowerBone, BoneName: pmx.LOWER},
+			{CheckFunk: sizingSet.SizingLegCenterBone, BoneName: pmx.LEG_CENTER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingLegBone, BoneName: pmx.LEG},
+		},
+	)
+}
@@ -0,0 +1,514 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/merr"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+)
+
+// SizingPipeline 複数セットのサイジングを実行順序通りに並列実行する
+type SizingPipeline struct {
+	sizingSets []*domain.SizingSet
+	reports    []*SizingReport // セット毎の結果(未実行のセットはnil)
+
+	// IsAnalyzeFootSliding true の場合、足補正・足固定・床補正のいずれかを実行したセットの足滑りを計測して結果に含める
+	IsAnalyzeFootSliding bool
+
+	// IsSkipMissingBones true の場合、ボーン不足の補正はエラーにせず、結果に記録して次の補正を続ける
+	// false の場合はボーン不足のエラーを返す(GUIはエラーダイアログで表示する)
+	IsSkipMissingBones bool
+
+	// Camera 指定されている場合、全セットのサイジング後にカメラモーションを1人目のセットに合わせて補正する
+	Camera *domain.SizingCamera
+
+	// OnProgress 処理が1ステップ進む毎に呼ばれる(各セットのgoroutineから呼ばれる)
+	OnProgress func()
+	// OnMotionUpdated 補正によって出力モーションが更新された時に呼ばれる(各セットのgoroutineから呼ばれる)
+	OnMotionUpdated func(sizingSet *domain.SizingSet)
+}
+
+func NewSizingPipeline(sizingSets []*domain.SizingSet) *SizingPipeline {
+	return &SizingPipeline{
+		sizingSets: sizingSets,
+	}
+}
+
+// ProcessCount 全セットの処理ステップ数を返す
+func (sp *SizingPipeline) ProcessCount() (processCount int) {
+	for _, sizingSet := range sp.sizingSets {
+		processCount += sizingSet.GetProcessCount()
+	}
+	processCount += sp.Camera.GetProcessCount()
+	return processCount
+}
+
+// Exec 全セットのサイジングを実行する
+// 1セットでも補正を実行した場合、isExec は true になる
+// ctx がキャンセルされた場合は TerminateError を、期限切れの場合は context のエラーを返す
+func (sp *SizingPipeline) Exec(ctx context.Context) (isExec bool, err error) {
+	// デフォーム結果はモーション全体分を保持しているので、実行が終わったら破棄する
+	defer sp.clearDeltaCaches()
+
+	scales := GenerateSizingScales(sp.sizingSets)
+	sp.reports = make([]*SizingReport, len(sp.sizingSets))
+
+	execResults := make([]bool, len(sp.sizingSets))
+	errorChan := make(chan error, len(sp.sizingSets))
+
+	var wg sync.WaitGroup
+	for i, sizingSet := range sp.sizingSets {
+		if sizingSet.OriginalConfigModel == nil || sizingSet.SizingConfigModel == nil ||
+			sizingSet.OutputMotion == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, sizingSet *domain.SizingSet) {
+			defer wg.Done()
+
+			report := NewSizingReport(sizingSet, scales[sizingSet.Index])
+			sp.reports[i] = report
+
+			startTime := time.Now()
+			execResult, err := sp.execSetWithFrameRanges(ctx, sizingSet, scales, report)
+			if err == nil && sp.IsAnalyzeFootSliding &&
+				(sizingSet.IsSizingLeg || sizingSet.IsSizingFootLock || sizingSet.IsSizingFloor) {
+				report.FootSliding, err = AnalyzeFootSliding(ctx, sizingSet)
+			}
+			report.finish(sizingSet, time.Since(startTime))
+			execResults[i] = execResult
+			if err != nil {
+				errorChan <- err
+			}
+		}(i, sizingSet)
+	}
+
+	wg.Wait()
+	close(errorChan)
+
+	for _, execResult := range execResults {
+		isExec = execResult || isExec
+	}
+
+	// チャネルからエラーを受け取る
+	var terminateErr error
+	for err := range errorChan {
+		if merr.IsTerminateError(err) {
+			terminateErr = err
+			continue
+		}
+		return isExec, err
+	}
+
+	if terminateErr != nil {
+		return false, terminateErr
+	}
+
+	// 手の接触維持は、全セットのサイジングが終わってから実行する
+	isExecHandContact, err := sp.execHandContact(ctx)
+	if err != nil {
+		return isExec, err
+	}
+
+	// カメラは手の接触維持まで終わったサイジング結果に合わせる
+	isExecCamera, err := NewSizingCameraUsecase().Exec(
+		ctx, sp.Camera, sp.sizingSets, scales, sp.incrementCompletedCount)
+	if err != nil {
+		return isExec || isExecHandContact, err
+	}
+
+	return isExec || isExecHandContact || isExecCamera, nil
+}
+
+// execHandContact 複数セット間で、元モーションで触れている手が離れないように補正する
+func (sp *SizingPipeline) execHandContact(ctx context.Context) (isExec bool, err error) {
+	startTime := time.Now()
+	isExecs, missingBonesErrs, err := NewSizingHandContactUsecase().Exec(ctx, sp.sizingSets, sp.incrementCompletedCount)
+	elapsed := time.Since(startTime)
+
+	for i, sizingSet := range sp.sizingSets {
+		if !sizingSet.IsSizingHandContact || sp.reports[i] == nil {
+			continue
+		}
+
+		correctionErr := err
+		if missingBonesErrs[i] != nil {
+			correctionErr = missingBonesErrs[i]
+			if err == nil && !sp.IsSkipMissingBones {
+				err = missingBonesErrs[i]
+			}
+		}
+
+		correction := newCorrectionReport("hand_contact", isExecs[i], correctionErr, elapsed)
+		correction.KeyCount = countBoneKeyFrames(sizingSet.SizingModel, sizingSet.OutputMotion)
+		sp.reports[i].appendCorrection(correction)
+		sp.reports[i].OutputKeyCount = correction.KeyCount
+
+		if isExecs[i] {
+			isExec = true
+
+			// 間引き後に手の接触維持でキーフレームを追加しているので、間引き直す
+			// 範囲指定がある場合、間引きは範囲内のキーフレームだけを対象にする
+			if sizingSet.IsSizingReduction && correctionErr == nil {
+				sizingSet.CompletedSizingReduction = false
+
+				reductionStartTime := time.Now()
+				isExecReduction, reductionErr := NewSizingReductionUsecase().Exec(
+					ctx, sizingSet, len(sp.sizingSets), sp.incrementCompletedCount)
+
+				reduction := newCorrectionReport("reduction", isExecReduction, reductionErr, time.Since(reductionStartTime))
+				reduction.KeyCount = countBoneKeyFrames(sizingSet.SizingModel, sizingSet.OutputMotion)
+				sp.reports[i].appendCorrection(reduction)
+				sp.reports[i].OutputKeyCount = reduction.KeyCount
+
+				if reductionErr != nil {
+					err = reductionErr
+				}
+			}
+
+			sp.notifyMotionUpdated(sizingSet)
+		}
+	}
+
+	return isExec, err
+}
+
+// CheckBones 実行対象の補正に必要なボーンが揃っているかチェックする
+func (sp *SizingPipeline) CheckBones(sizingSet *domain.SizingSet) error {
+	if sizingSet.IsSizingArmStance || sizingSet.IsSizingFingerStance {
+		if err := NewSizingArmStanceUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingLeg {
+		if err := NewSizingLegUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingUpper {
+		if err := NewSizingUpperUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingShoulder {
+		if err := NewSizingShoulderUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingWrist {
+		if err := NewSizingWristUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingArmTwist {
+		if err := NewSizingArmTwistUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingFootLock {
+		if err := NewSizingFootLockUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingFloor {
+		if err := NewSizingFloorUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	// 手の接触維持は相手のセットがいない場合は何もしないので、1セットのみの場合はチェックしない
+	if sizingSet.IsSizingHandContact && len(sp.sizingSets) > 1 {
+		if err := NewSizingHandContactUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingSelfContact {
+		if err := NewSizingSelfContactUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingArmCollision {
+		if err := NewSizingArmCollisionUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingLower {
+		if err := NewSizingLowerUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	if sizingSet.IsSizingGaze {
+		if err := NewSizingGazeUsecase().checkBones(sizingSet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reports 直前の Exec で実行したセット毎の結果を返す
+func (sp *SizingPipeline) Reports() []*SizingReport {
+	reports := make([]*SizingReport, 0, len(sp.reports))
+	for _, report := range sp.reports {
+		if report != nil {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// sizingStep 補正1種類分の実行定義
+type sizingStep struct {
+	name        string               // 補正名(結果出力用)
+	isTarget    bool                 // 補正対象か
+	isCompleted bool                 // 補正済みか
+	exec        func() (bool, error) // 補正処理
+}
+
+// execSetWithFrameRanges 1セット分の補正を実行する
+// フレーム範囲指定がある場合は、範囲毎に切り出して補正し、出力モーションに合成する
+func (sp *SizingPipeline) execSetWithFrameRanges(
+	ctx context.Context, sizingSet *domain.SizingSet, scales []*mmath.MVec3, report *SizingReport,
+) (isExec bool, err error) {
+	frameRanges := sizingSet.NormalizedFrameRanges()
+	if len(frameRanges) == 0 {
+		return sp.execSet(ctx, sizingSet, scales, report, true)
+	}
+
+	rangeSets := make([]*domain.SizingSet, 0, len(frameRanges))
+	for _, frameRange := range frameRanges {
+		rangeSet, err := sizingSet.NewFrameRangeSet(frameRange)
+		if err != nil {
+			return isExec, err
+		}
+
+		execResult, err := sp.execSet(ctx, rangeSet, scales, report, false)
+		if err != nil {
+			return isExec, err
+		}
+
+		if execResult {
+			sizingSet.MergeFrameRangeSet(rangeSet)
+			isExec = true
+		}
+		rangeSets = append(rangeSets, rangeSet)
+	}
+
+	// 補正済みフラグは全範囲共通なので、全ての範囲で補正済みの補正のみ補正済みとする
+	sizingSet.MergeFrameRangeCompleted(rangeSets)
+
+	if isExec {
+		sp.notifyMotionUpdated(sizingSet)
+	}
+
+	return isExec, nil
+}
+
+// execSet 1セット分の補正を順番に実行する
+// ボーン不足の補正はスキップして、残りの補正を続ける
+// isNotify が false の場合は、出力モーションの更新を通知しない(範囲毎に切り出したセット用)
+func (sp *SizingPipeline) execSet(
+	ctx context.Context, sizingSet *domain.SizingSet, scales []*mmath.MVec3, report *SizingReport, isNotify bool,
+) (isExec bool, err error) {
+	sizingSetCount := len(sp.sizingSets)
+
+	for _, step := range []sizingStep{
+		{
+			// 腕指スタンス補正
+			name:     "arm_stance",
+			isTarget: sizingSet.IsSizingArmStance || sizingSet.IsSizingFingerStance,
+			isCompleted: (!sizingSet.IsSizingArmStance || sizingSet.CompletedSizingArmStance) &&
+				(!sizingSet.IsSizingFingerStance || sizingSet.CompletedSizingFingerStance),
+			exec: func() (bool, error) {
+				return NewSizingArmStanceUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 下半身補正(足補正の前に実行する)
+			name:        "lower",
+			isTarget:    sizingSet.IsSizingLower,
+			isCompleted: sizingSet.CompletedSizingLower,
+			exec: func() (bool, error) {
+				return NewSizingLowerUsecase().Exec(ctx, sizingSet, scales[sizingSet.Index], sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 足補正
+			name:        "leg",
+			isTarget:    sizingSet.IsSizingLeg,
+			isCompleted: sizingSet.CompletedSizingLeg,
+			exec: func() (bool, error) {
+				return NewSizingLegUsecase().Exec(ctx, sizingSet, scales[sizingSet.Index], sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 足接地固定(足補正の後に実行する)
+			name:        "foot_lock",
+			isTarget:    sizingSet.IsSizingFootLock,
+			isCompleted: sizingSet.CompletedSizingFootLock,
+			exec: func() (bool, error) {
+				return NewSizingFootLockUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 床補正(足補正の後に実行する)
+			name:        "floor",
+			isTarget:    sizingSet.IsSizingFloor,
+			isCompleted: sizingSet.CompletedSizingFloor,
+			exec: func() (bool, error) {
+				return NewSizingFloorUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 上半身補正
+			name:        "upper",
+			isTarget:    sizingSet.IsSizingUpper,
+			isCompleted: sizingSet.CompletedSizingUpper,
+			exec: func() (bool, error) {
+				return NewSizingUpperUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 視線補正(上半身補正の後に実行する)
+			name:        "gaze",
+			isTarget:    sizingSet.IsSizingGaze,
+			isCompleted: sizingSet.CompletedSizingGaze,
+			exec: func() (bool, error) {
+				return NewSizingGazeUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 肩補正
+			name:        "shoulder",
+			isTarget:    sizingSet.IsSizingShoulder,
+			isCompleted: sizingSet.CompletedSizingShoulder,
+			exec: func() (bool, error) {
+				return NewSizingShoulderUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 手首位置合わせ
+			name:        "wrist",
+			isTarget:    sizingSet.IsSizingWrist,
+			isCompleted: sizingSet.CompletedSizingWrist,
+			exec: func() (bool, error) {
+				return NewSizingWristUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 自己接触維持(手首位置合わせの後に実行する)
+			name:        "self_contact",
+			isTarget:    sizingSet.IsSizingSelfContact,
+			isCompleted: sizingSet.CompletedSizingSelfContact,
+			exec: func() (bool, error) {
+				return NewSizingSelfContactUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 腕貫通回避(腕をIKで動かす手首位置合わせ・自己接触維持の後に実行する)
+			name:        "arm_collision",
+			isTarget:    sizingSet.IsSizingArmCollision,
+			isCompleted: sizingSet.CompletedSizingArmCollision,
+			exec: func() (bool, error) {
+				return NewSizingArmCollisionUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 捩り分散
+			name:        "arm_twist",
+			isTarget:    sizingSet.IsSizingArmTwist,
+			isCompleted: sizingSet.CompletedSizingArmTwist,
+			exec: func() (bool, error) {
+				return NewSizingArmTwistUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+		{
+			// 不要キー間引き(全補正の後に実行する)
+			name:        "reduction",
+			isTarget:    sizingSet.IsSizingReduction,
+			isCompleted: sizingSet.CompletedSizingReduction,
+			exec: func() (bool, error) {
+				return NewSizingReductionUsecase().Exec(ctx, sizingSet, sizingSetCount, sp.incrementCompletedCount)
+			},
+		},
+	} {
+		if !step.isTarget || step.isCompleted {
+			correction := &SizingCorrectionReport{
+				Name:     step.name,
+				Status:   SizingReportSkipped,
+				Reason:   SizingReportReasonDisabled,
+				KeyCount: countBoneKeyFrames(sizingSet.SizingModel, sizingSet.OutputMotion),
+			}
+			if step.isTarget {
+				correction.Status = SizingReportUnchanged
+				correction.Reason = SizingReportReasonCompleted
+			}
+			report.appendCorrection(correction)
+			continue
+		}
+
+		stepStartTime := time.Now()
+		execResult, err := step.exec()
+		if err == nil {
+			err = checkTerminate(ctx)
+		}
+
+		correction := newCorrectionReport(step.name, execResult, err, time.Since(stepStartTime))
+		correction.FrameRange = sizingSet.FrameRange()
+		correction.KeyCount = countBoneKeyFrames(sizingSet.SizingModel, sizingSet.OutputMotion)
+		report.appendCorrection(correction)
+
+		if err != nil {
+			if sp.IsSkipMissingBones && IsMissingBonesError(err) {
+				continue
+			}
+			return false, err
+		}
+
+		isExec = execResult || isExec
+
+		if isExec && isNotify {
+			sp.notifyMotionUpdated(sizingSet)
+		}
+	}
+
+	return isExec, nil
+}
+
+// notifyMotionUpdated 補正によって出力モーションが更新されたことを通知する
+func (sp *SizingPipeline) notifyMotionUpdated(sizingSet *domain.SizingSet) {
+	sizingSet.OutputMotion.SetRandHash()
+	sizingSet.OutputMotion.SetName(sizingSet.SizingModel.Name())
+	if sp.OnMotionUpdated != nil {
+		sp.OnMotionUpdated(sizingSet)
+	}
+}
+
+// clearDeltaCaches 全セットのデフォーム結果キャッシュを破棄する
+func (sp *SizingPipeline) clearDeltaCaches() {
+	for _, sizingSet := range sp.sizingSets {
+		sizingSet.ClearDeltaCache()
+	}
+}
+
+func (sp *SizingPipeline) incrementCompletedCount() {
+	if sp.OnProgress != nil {
+		sp.OnProgress()
+	}
+}
@@ -0,0 +1,522 @@
+package usecase
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// 間引き後に許容するグローバル位置のズレ
+const reduction_position_tolerance = 0.05
+
+// 補間曲線の制御点X候補
+var reduction_curve_xs = []float64{0.0, 0.25, 0.5, 0.75, 1.0}
+
+// 補間曲線の逆引きテーブル分割数
+const reduction_curve_table_size = 64
+
+type SizingReductionUsecase struct {
+	curveTables [][][]float64
+}
+
+func NewSizingReductionUsecase() *SizingReductionUsecase {
+	return &SizingReductionUsecase{
+		curveTables: newReductionCurveTables(),
+	}
+}
+
+// reductionChannel 補間曲線を当てはめる1成分分の値
+type reductionChannel struct {
+	ts        []float64 // 区間内の経過割合
+	ys        []float64 // 区間内の変化割合
+	scale     float64   // 変化割合を値のズレに換算する係数
+	tolerance float64   // 許容するズレ
+}
+
+// Exec は、サイジングで追加された不要なキーフレームを削除し、補間曲線を再設定します。
+func (su *SizingReductionUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingReduction || sizingSet.CompletedSizingReduction {
+		return false, nil
+	}
+
+	mlog.I(mi18n.T("不要キー間引き開始", map[string]any{"No": sizingSet.Index + 1}))
+
+	sizingModel := sizingSet.SizingConfigModel
+	outputMotion := sizingSet.OutputMotion
+
+	// 間引き前のモーションを保持しておく
+	denseMotion, err := outputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	boneNames := su.getReductionBoneNames(sizingModel, outputMotion)
+	if len(boneNames) == 0 {
+		sizingSet.CompletedSizingReduction = true
+		return false, nil
+	}
+
+	allFrames := mmath.IntRanges(int(outputMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	denseAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingModel, denseMotion,
+		sizingSet, true, boneNames, "", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	boneReaches := su.calculateBoneReaches(sizingModel)
+
+	keptFrames := make(map[string][]int, len(boneNames))
+	for i, boneName := range boneNames {
+		if err := checkTerminate(ctx); err != nil {
+			return false, err
+		}
+
+		bone, _ := sizingModel.Bones.GetByName(boneName)
+		rotationTolerance := reduction_position_tolerance / math.Max(boneReaches[bone.Index()], 1.0)
+
+		keptFrames[boneName] = su.reduceBoneFrames(
+			sizingSet, denseMotion, outputMotion, boneName, rotationTolerance)
+
+		mlog.I(mi18n.T("不要キー間引き01", map[string]any{
+			"No":        sizingSet.Index + 1,
+			"Name":      boneName,
+			"IterIndex": i + 1,
+			"AllCount":  len(boneNames),
+		}))
+	}
+
+	incrementCompletedCount()
+
+	if err := su.restoreDriftFrames(ctx, sizingSet, allFrames, blockSize, boneNames, denseMotion,
+		denseAllDeltas, keptFrames, incrementCompletedCount); err != nil {
+		return false, err
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("間引き", sizingSet.OutputMotionPath, outputMotion)
+	}
+
+	sizingSet.CompletedSizingReduction = true
+
+	return true, nil
+}
+
+// getReductionBoneNames は、キーフレームが登録されているボーン名の一覧を取得します。
+func (su *SizingReductionUsecase) getReductionBoneNames(
+	model *pmx.PmxModel, motion *vmd.VmdMotion,
+) []string {
+	boneNames := make([]string, 0)
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		if motion.BoneFrames.Contains(bone.Name()) {
+			boneNames = append(boneNames, bone.Name())
+		}
+		return true
+	})
+	return boneNames
+}
+
+// calculateBoneReaches は、各ボーンから子孫ボーンまでの最大距離を求めます。
+// 回転のズレが子孫ボーンの位置に与える影響を見積もるために使用します。
+func (su *SizingReductionUsecase) calculateBoneReaches(model *pmx.PmxModel) map[int]float64 {
+	boneReaches := make(map[int]float64)
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		for _, parentIndex := range bone.ParentBoneIndexes {
+			parentBone, err := model.Bones.Get(parentIndex)
+			if err != nil {
+				continue
+			}
+			distance := parentBone.Position.Distance(bone.Position)
+			if distance > boneReaches[parentIndex] {
+				boneReaches[parentIndex] = distance
+			}
+		}
+		return true
+	})
+	return boneReaches
+}
+
+// getKeyFrames は、ボーンに登録されているキーフレーム番号を昇順で取得します。
+func (su *SizingReductionUsecase) getKeyFrames(motion *vmd.VmdMotion, boneName string) []int {
+	frames := make([]int, 0)
+	if !motion.BoneFrames.Contains(boneName) {
+		return frames
+	}
+
+	motion.BoneFrames.Get(boneName).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+		frames = append(frames, int(frame))
+		return true
+	})
+	sort.Ints(frames)
+
+	return frames
+}
+
+// reduceBoneFrames は、1ボーン分のキーフレームを間引き、残したキーフレーム番号を返します。
+// 元モーションに登録されているキーフレームは残します。
+// 範囲指定がある場合、範囲外のキーフレームと、範囲外にまたがる区間の補間曲線は変更しません。
+func (su *SizingReductionUsecase) reduceBoneFrames(
+	sizingSet *domain.SizingSet, denseMotion, outputMotion *vmd.VmdMotion, boneName string,
+	rotationTolerance float64,
+) []int {
+	keyFrames := su.getKeyFrames(denseMotion, boneName)
+	if len(keyFrames) < 3 {
+		return keyFrames
+	}
+
+	anchorFrames := make(map[int]struct{})
+	for _, frame := range su.getKeyFrames(sizingSet.OriginalMotion, boneName) {
+		anchorFrames[frame] = struct{}{}
+	}
+	anchorFrames[keyFrames[0]] = struct{}{}
+	anchorFrames[keyFrames[len(keyFrames)-1]] = struct{}{}
+	for _, frame := range keyFrames {
+		if !sizingSet.IsInFrameRanges(frame) {
+			anchorFrames[frame] = struct{}{}
+		}
+	}
+
+	keptFrames := []int{keyFrames[0]}
+	for i := 0; i < len(keyFrames)-1; {
+		// 次に残す必要のあるキーフレーム
+		limit := i + 1
+		for ; limit < len(keyFrames)-1; limit++ {
+			if _, ok := anchorFrames[keyFrames[limit]]; ok {
+				break
+			}
+		}
+
+		if !sizingSet.IsInFrameRanges(keyFrames[i]) || !sizingSet.IsInFrameRanges(keyFrames[limit]) {
+			// 範囲外にまたがる区間は間引かない(範囲内の最後のキーフレームまでは間引ける)
+			if limit-1 > i && sizingSet.IsInFrameRanges(keyFrames[i]) {
+				limit--
+			} else {
+				keptFrames = append(keptFrames, keyFrames[i+1])
+				i++
+				continue
+			}
+		}
+
+		j, curves := su.searchReducibleFrame(denseMotion, boneName, keyFrames, i, limit, rotationTolerance)
+		if curves != nil {
+			for _, frame := range keyFrames[i+1 : j] {
+				outputMotion.BoneFrames.Get(boneName).Delete(float32(frame))
+			}
+
+			bf := outputMotion.BoneFrames.Get(boneName).Get(float32(keyFrames[j]))
+			bf.Curves = curves
+			outputMotion.BoneFrames.Get(boneName).Update(bf)
+		}
+
+		keptFrames = append(keptFrames, keyFrames[j])
+		i = j
+	}
+
+	return keptFrames
+}
+
+// searchReducibleFrame は、start から補間曲線1つで表現できる最も遠いキーフレームを探します。
+// 表現できない場合は、隣のキーフレームと nil を返します。
+func (su *SizingReductionUsecase) searchReducibleFrame(
+	motion *vmd.VmdMotion, boneName string, keyFrames []int, start, limit int, rotationTolerance float64,
+) (int, *vmd.BoneCurves) {
+	if curves := su.fitBoneCurves(motion, boneName, keyFrames[start], keyFrames[limit],
+		rotationTolerance); curves != nil {
+		return limit, curves
+	}
+
+	found := start + 1
+	var foundCurves *vmd.BoneCurves
+	lo, hi := start+1, limit-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if curves := su.fitBoneCurves(motion, boneName, keyFrames[start], keyFrames[mid],
+			rotationTolerance); curves != nil {
+			found, foundCurves = mid, curves
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	// 見つからなかった場合、隣のキーフレームは既存の補間曲線のまま残す
+	return found, foundCurves
+}
+
+// fitBoneCurves は、startFrame から endFrame までの動きを補間曲線で表現できるか判定し、
+// 表現できる場合はその補間曲線を返します。
+func (su *SizingReductionUsecase) fitBoneCurves(
+	motion *vmd.VmdMotion, boneName string, startFrame, endFrame int, rotationTolerance float64,
+) *vmd.BoneCurves {
+	startBf := motion.BoneFrames.Get(boneName).Get(float32(startFrame))
+	endBf := motion.BoneFrames.Get(boneName).Get(float32(endFrame))
+
+	startQuat := startBf.FilledRotation()
+	endQuat := endBf.FilledRotation()
+	startPos := startBf.FilledPosition()
+	endPos := endBf.FilledPosition()
+
+	rotateAngle := quaternionAngle(startQuat, endQuat)
+
+	rotate := &reductionChannel{scale: rotateAngle, tolerance: rotationTolerance}
+	translates := []*reductionChannel{
+		{scale: endPos.X - startPos.X, tolerance: reduction_position_tolerance},
+		{scale: endPos.Y - startPos.Y, tolerance: reduction_position_tolerance},
+		{scale: endPos.Z - startPos.Z, tolerance: reduction_position_tolerance},
+	}
+
+	span := float64(endFrame - startFrame)
+	for frame := startFrame + 1; frame < endFrame; frame++ {
+		bf := motion.BoneFrames.Get(boneName).Get(float32(frame))
+		t := float64(frame-startFrame) / span
+
+		// 回転は開始から終了への球面補間上にある必要がある
+		quat := bf.FilledRotation()
+		if rotateAngle < 1e-4 {
+			if quaternionAngle(startQuat, quat) > rotationTolerance {
+				return nil
+			}
+		} else {
+			y := quaternionAngle(startQuat, quat) / rotateAngle
+			if quaternionAngle(startQuat.Slerp(endQuat, y), quat) > rotationTolerance {
+				return nil
+			}
+			rotate.ts = append(rotate.ts, t)
+			rotate.ys = append(rotate.ys, y)
+		}
+
+		pos := bf.FilledPosition()
+		for i, value := range []float64{pos.X - startPos.X, pos.Y - startPos.Y, pos.Z - startPos.Z} {
+			if math.Abs(translates[i].scale) < 1e-4 {
+				if math.Abs(value) > reduction_position_tolerance {
+					return nil
+				}
+				continue
+			}
+			translates[i].ts = append(translates[i].ts, t)
+			translates[i].ys = append(translates[i].ys, value/translates[i].scale)
+		}
+	}
+
+	curves := vmd.NewBoneCurves()
+	for _, v := range []struct {
+		channel *reductionChannel
+		curve   **mmath.Curve
+	}{
+		{rotate, &curves.Rotate},
+		{translates[0], &curves.TranslateX},
+		{translates[1], &curves.TranslateY},
+		{translates[2], &curves.TranslateZ},
+	} {
+		curve := su.fitCurve(v.channel)
+		if curve == nil {
+			return nil
+		}
+		*v.curve = curve
+	}
+
+	return curves
+}
+
+// fitCurve は、変化割合に最も合う補間曲線を求めます。許容範囲に収まらない場合は nil を返します。
+func (su *SizingReductionUsecase) fitCurve(channel *reductionChannel) *mmath.Curve {
+	if len(channel.ts) == 0 {
+		return domain.NewCurve(0, 0, 1, 1)
+	}
+
+	for _, y := range channel.ys {
+		// 補間曲線は開始値と終了値の間でしか動けない
+		if y < -1e-3 || y > 1+1e-3 {
+			return nil
+		}
+	}
+
+	var bestCurve *mmath.Curve
+	bestError := math.MaxFloat64
+	for i1, x1 := range reduction_curve_xs {
+		for i2, x2 := range reduction_curve_xs {
+			table := su.curveTables[i1][i2]
+
+			// 制御点Xを固定すると、Yは最小二乗法で求められる
+			var a11, a12, a22, b1, b2 float64
+			bs := make([][3]float64, len(channel.ts))
+			for i, t := range channel.ts {
+				s := lookupCurveParameter(table, t)
+				bs[i] = [3]float64{3 * (1 - s) * (1 - s) * s, 3 * (1 - s) * s * s, s * s * s}
+				r := channel.ys[i] - bs[i][2]
+				a11 += bs[i][0] * bs[i][0]
+				a12 += bs[i][0] * bs[i][1]
+				a22 += bs[i][1] * bs[i][1]
+				b1 += bs[i][0] * r
+				b2 += bs[i][1] * r
+			}
+
+			y1, y2 := x1, x2
+			if det := a11*a22 - a12*a12; math.Abs(det) > 1e-12 {
+				y1 = clamp01((b1*a22 - b2*a12) / det)
+				y2 = clamp01((a11*b2 - a12*b1) / det)
+			}
+
+			maxError := 0.0
+			for i := range channel.ts {
+				y := bs[i][0]*y1 + bs[i][1]*y2 + bs[i][2]
+				maxError = math.Max(maxError, math.Abs(y-channel.ys[i]))
+			}
+
+			if maxError < bestError {
+				bestError = maxError
+				bestCurve = domain.NewCurve(x1, y1, x2, y2)
+			}
+		}
+	}
+
+	if bestError*math.Abs(channel.scale) > channel.tolerance {
+		return nil
+	}
+
+	return bestCurve
+}
+
+// restoreDriftFrames は、間引き前後でグローバル位置がズレたフレームについて、
+// ズレたボーンとその親ボーンの間引きを取り消します。
+func (su *SizingReductionUsecase) restoreDriftFrames(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, boneNames []string,
+	denseMotion *vmd.VmdMotion, denseAllDeltas []*delta.VmdDeltas, keptFrames map[string][]int,
+	incrementCompletedCount func(),
+) error {
+	sizingModel := sizingSet.SizingConfigModel
+	outputMotion := sizingSet.OutputMotion
+
+	reducedAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingModel, outputMotion,
+		sizingSet, true, boneNames, "", incrementCompletedCount)
+	if err != nil {
+		return err
+	}
+
+	driftBoneIndexes := make([][]int, len(allFrames))
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for _, boneName := range boneNames {
+				denseDelta := denseAllDeltas[index].Bones.GetByName(boneName)
+				reducedDelta := reducedAllDeltas[index].Bones.GetByName(boneName)
+				if denseDelta == nil || reducedDelta == nil {
+					continue
+				}
+
+				if denseDelta.FilledGlobalPosition().Distance(
+					reducedDelta.FilledGlobalPosition()) > reduction_position_tolerance {
+					driftBoneIndexes[index] = append(driftBoneIndexes[index], denseDelta.Bone.Index())
+				}
+			}
+
+			return nil
+		}, func(iterIndex, allCount int) {})
+	if err != nil {
+		return err
+	}
+
+	restoredFrames := make(map[string]map[int]struct{})
+	for index, iFrame := range allFrames {
+		for _, boneIndex := range driftBoneIndexes[index] {
+			bone, _ := sizingModel.Bones.Get(boneIndex)
+			targetBoneIndexes := append([]int{boneIndex}, bone.ParentBoneIndexes...)
+			for _, targetBoneIndex := range targetBoneIndexes {
+				targetBone, _ := sizingModel.Bones.Get(targetBoneIndex)
+				frames, ok := keptFrames[targetBone.Name()]
+				if !ok {
+					continue
+				}
+				su.restoreSegment(denseMotion, outputMotion, targetBone.Name(), frames, iFrame, restoredFrames)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreSegment は、frame を含む区間のキーフレームを間引き前の状態に戻します。
+func (su *SizingReductionUsecase) restoreSegment(
+	denseMotion, outputMotion *vmd.VmdMotion, boneName string, keptFrames []int, frame int,
+	restoredFrames map[string]map[int]struct{},
+) {
+	// frame を含む区間 (keptFrames[n-1], keptFrames[n]] を探す
+	n := sort.SearchInts(keptFrames, frame)
+	if n == 0 || n >= len(keptFrames) {
+		return
+	}
+	endFrame := keptFrames[n]
+
+	if _, ok := restoredFrames[boneName]; !ok {
+		restoredFrames[boneName] = make(map[int]struct{})
+	}
+	if _, ok := restoredFrames[boneName][endFrame]; ok {
+		return
+	}
+	restoredFrames[boneName][endFrame] = struct{}{}
+
+	startFrame := keptFrames[n-1]
+	for _, keyFrame := range su.getKeyFrames(denseMotion, boneName) {
+		if keyFrame <= startFrame || keyFrame > endFrame {
+			continue
+		}
+		outputMotion.InsertBoneFrame(boneName, denseMotion.BoneFrames.Get(boneName).Get(float32(keyFrame)))
+	}
+}
+
+// newReductionCurveTables は、制御点Xの組み合わせ毎に、経過割合から曲線パラメータを逆引きするテーブルを生成します。
+func newReductionCurveTables() [][][]float64 {
+	tables := make([][][]float64, len(reduction_curve_xs))
+	for i1, x1 := range reduction_curve_xs {
+		tables[i1] = make([][]float64, len(reduction_curve_xs))
+		for i2, x2 := range reduction_curve_xs {
+			table := make([]float64, reduction_curve_table_size+1)
+			for k := range table {
+				table[k] = domain.CurveParameter(x1, x2, float64(k)/reduction_curve_table_size)
+			}
+			tables[i1][i2] = table
+		}
+	}
+	return tables
+}
+
+// lookupCurveParameter は、経過割合に対応する曲線パラメータをテーブルから求めます。
+func lookupCurveParameter(table []float64, t float64) float64 {
+	position := clamp01(t) * reduction_curve_table_size
+	k := int(position)
+	if k >= reduction_curve_table_size {
+		return table[reduction_curve_table_size]
+	}
+	return mmath.Lerp(table[k], table[k+1], position-float64(k))
+}
+
+// quaternionAngle は、2つの回転の差の角度(ラジアン)を求めます。
+func quaternionAngle(from, to *mmath.MQuaternion) float64 {
+	_, angle := from.Inverted().Muled(to).ToAxisAngle()
+	angle = math.Abs(angle)
+	if angle > math.Pi {
+		angle = 2*math.Pi - angle
+	}
+	return angle
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,229 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/merr"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+)
+
+type SizingReportStatus string
+
+const (
+	SizingReportExecuted   SizingReportStatus = "executed"   // 補正実行
+	SizingReportUnchanged  SizingReportStatus = "unchanged"  // 実行したが変更なし(補正済み含む)
+	SizingReportSkipped    SizingReportStatus = "skipped"    // 対象外・ボーン不足のためスキップ
+	SizingReportFailed     SizingReportStatus = "failed"     // 失敗
+	SizingReportTerminated SizingReportStatus = "terminated" // 中断・タイムアウト
+)
+
+const (
+	SizingReportReasonDisabled     = "disabled"      // 補正対象外
+	SizingReportReasonCompleted    = "completed"     // 補正済み
+	SizingReportReasonMissingBones = "missing_bones" // ボーン不足
+)
+
+const (
+	SizingReportOriginalModel = "original" // 元モデル
+	SizingReportSizingModel   = "sizing"   // サイジング先モデル
+)
+
+// SizingMissingBone 不足しているボーン
+type SizingMissingBone struct {
+	ModelType string `json:"model_type"` // モデル種別(original/sizing)
+	ModelName string `json:"model_name"` // モデル名
+	BoneName  string `json:"bone_name"`  // ボーン名
+}
+
+// SizingCorrectionReport 補正1種類分の結果
+type SizingCorrectionReport struct {
+	Name           string                   `json:"name"`                    // 補正名
+	Status         SizingReportStatus       `json:"status"`                  // 結果
+	Reason         string                   `json:"reason,omitempty"`        // スキップ・失敗理由
+	Message        string                   `json:"message,omitempty"`       // エラーメッセージ
+	MissingBones   []*SizingMissingBone     `json:"missing_bones,omitempty"` // 不足ボーン
+	FrameRange     *domain.SizingFrameRange `json:"frame_range,omitempty"`   // 範囲指定時の対象フレーム範囲
+	ElapsedSeconds float64                  `json:"elapsed_seconds"`         // 処理時間(秒)
+	KeyCount       int                      `json:"key_count"`               // 補正後の出力モーションのボーンキーフレーム数
+}
+
+// SizingReportScale サイジングに使用したスケール
+type SizingReportScale struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// SizingReport サイジングセット1件分の結果
+type SizingReport struct {
+	Index              int                       `json:"index"`                  // セットINDEX
+	OriginalMotionPath string                    `json:"original_motion_path"`   // 元モーションパス
+	OriginalModelPath  string                    `json:"original_model_path"`    // 元モデルパス
+	SizingModelPath    string                    `json:"sizing_model_path"`      // サイジング先モデルパス
+	OutputMotionPath   string                    `json:"output_motion_path"`     // 出力モーションパス
+	Status             SizingReportStatus        `json:"status"`                 // 全体の結果
+	Scale              *SizingReportScale        `json:"scale,omitempty"`        // 使用したスケール
+	ElapsedSeconds     float64                   `json:"elapsed_seconds"`        // 処理時間(秒)
+	OriginalKeyCount   int                       `json:"original_key_count"`     // 元モーションのボーンキーフレーム数
+	OutputKeyCount     int                       `json:"output_key_count"`       // 出力モーションのボーンキーフレーム数
+	Corrections        []*SizingCorrectionReport `json:"corrections"`            // 補正毎の結果
+	FootSliding        *FootSlidingReport        `json:"foot_sliding,omitempty"` // 足滑りの計測結果
+}
+
+func NewSizingReport(sizingSet *domain.SizingSet, scale *mmath.MVec3) *SizingReport {
+	report := &SizingReport{
+		Index:              sizingSet.Index,
+		OriginalMotionPath: sizingSet.OriginalMotionPath,
+		OriginalModelPath:  sizingSet.OriginalModelPath,
+		SizingModelPath:    sizingSet.SizingModelPath,
+		OutputMotionPath:   sizingSet.OutputMotionPath,
+		Status:             SizingReportUnchanged,
+		Corrections:        make([]*SizingCorrectionReport, 0),
+	}
+
+	if scale != nil {
+		report.Scale = &SizingReportScale{X: scale.X, Y: scale.Y, Z: scale.Z}
+	}
+
+	report.OriginalKeyCount = countBoneKeyFrames(sizingSet.OriginalModel, sizingSet.OriginalMotion)
+
+	return report
+}
+
+// Save 結果をjsonで出力する
+func (report *SizingReport) Save(path string) error {
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+// SaveSizingReports 複数セットの結果をまとめてjsonで出力する
+func SaveSizingReports(path string, reports []*SizingReport) error {
+	output, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, output, 0644)
+}
+
+// appendCorrection 補正1種類分の結果を追加し、全体の結果に反映する
+func (report *SizingReport) appendCorrection(correction *SizingCorrectionReport) {
+	report.Corrections = append(report.Corrections, correction)
+
+	// 全体の結果は 失敗 > 中断 > 実行 > 変更なし の優先度で決める
+	switch correction.Status {
+	case SizingReportFailed:
+		report.Status = SizingReportFailed
+	case SizingReportTerminated:
+		if report.Status != SizingReportFailed {
+			report.Status = SizingReportTerminated
+		}
+	case SizingReportExecuted:
+		if report.Status == SizingReportUnchanged {
+			report.Status = SizingReportExecuted
+		}
+	}
+}
+
+// finish 全補正終了時に、処理時間とキーフレーム数を確定する
+func (report *SizingReport) finish(sizingSet *domain.SizingSet, elapsed time.Duration) {
+	report.ElapsedSeconds = elapsed.Seconds()
+	report.OutputKeyCount = countBoneKeyFrames(sizingSet.SizingModel, sizingSet.OutputMotion)
+
+	if report.Status != SizingReportUnchanged {
+		return
+	}
+
+	// ボーン不足で全ての補正がスキップされた場合は、全体もスキップ扱い
+	hasMissingBones := false
+	for _, correction := range report.Corrections {
+		if correction.Status != SizingReportSkipped {
+			return
+		}
+		if correction.Reason == SizingReportReasonMissingBones {
+			hasMissingBones = true
+		}
+	}
+	if hasMissingBones {
+		report.Status = SizingReportSkipped
+	}
+}
+
+// newCorrectionReport 補正の実行結果から、補正1種類分の結果を生成する
+func newCorrectionReport(name string, isExec bool, err error, elapsed time.Duration) *SizingCorrectionReport {
+	correction := &SizingCorrectionReport{
+		Name:           name,
+		ElapsedSeconds: elapsed.Seconds(),
+	}
+
+	var missingErr *MissingBonesError
+	switch {
+	case err == nil && isExec:
+		correction.Status = SizingReportExecuted
+	case err == nil:
+		correction.Status = SizingReportUnchanged
+	case errors.As(err, &missingErr):
+		correction.Status = SizingReportSkipped
+		correction.Reason = SizingReportReasonMissingBones
+		correction.Message = err.Error()
+		correction.MissingBones = missingErr.MissingBones
+	case merr.IsTerminateError(err) || errors.Is(err, context.DeadlineExceeded):
+		correction.Status = SizingReportTerminated
+		correction.Message = err.Error()
+	default:
+		correction.Status = SizingReportFailed
+		correction.Message = err.Error()
+	}
+
+	return correction
+}
+
+// countBoneKeyFrames モデルのボーンに対応するボーンキーフレーム数を数える
+func countBoneKeyFrames(model *pmx.PmxModel, motion *vmd.VmdMotion) (count int) {
+	if model == nil || motion == nil {
+		return 0
+	}
+
+	model.Bones.ForEach(func(index int, bone *pmx.Bone) bool {
+		if !motion.BoneFrames.Contains(bone.Name()) {
+			return true
+		}
+		motion.BoneFrames.Get(bone.Name()).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+			count++
+			return true
+		})
+		return true
+	})
+
+	return count
+}
+
+// MissingBonesError 補正に必要なボーンが不足している場合のエラー
+type MissingBonesError struct {
+	MissingBones []*SizingMissingBone // 不足ボーン
+	err          error                // 最後に検出したボーン不足エラー
+}
+
+func (e *MissingBonesError) Error() string {
+	return e.err.Error()
+}
+
+func (e *MissingBonesError) Unwrap() error {
+	return e.err
+}
+
+// IsMissingBonesError ボーン不足エラーか
+func IsMissingBonesError(err error) bool {
+	var missingErr *MissingBonesError
+	return errors.As(err, &missingErr)
+}
@@ -0,0 +1,357 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+)
+
+// self_contact_ease_frames 接触区間の前後で、補正量を徐々に切り替えるフレーム数
+const self_contact_ease_frames = 3
+
+// self_contact_min_frames 接触がこのフレーム数以上続いた場合のみ、触れているとみなす(すれ違っただけのフレームは除く)
+const self_contact_min_frames = 3
+
+// self_contact_standard_width 部位の判定距離の基準とする、標準的なモデルの肩幅(左右の腕ボーン間の距離)
+const self_contact_standard_width = 3.2
+
+// selfContactPart 手首が触れる体の部位
+// 部位の根元ボーンからの相対位置で手首位置を保持し、サイジング先の同じ部位の同じ相対位置に手首を合わせる
+type selfContactPart struct {
+	startBoneName  string   // 部位の根元ボーン名(このボーンのローカル座標で手首位置を保持する)
+	endBoneName    string   // 部位の先端ボーン名
+	widthBoneNames []string // 部位の幅の基準となる左右のボーン名(無い場合は長さの比率で揃える)
+	threshold      float64  // 元モーションで、部位と手首の距離がこれ未満の場合、触れているとみなす(標準的な肩幅のモデルでの距離)
+	weight         float64  // 移動量の割合(相手の手の場合は、両手で半分ずつ動かす)
+}
+
+// selfContactParts 手首(directions のINDEX別)が触れる可能性のある体の部位
+func selfContactParts(directionIndex int) []*selfContactPart {
+	oppositeDirection := reverse_directions[directionIndex]
+
+	return []*selfContactPart{
+		{
+			// 頭
+			startBoneName: pmx.NECK.String(),
+			endBoneName:   pmx.HEAD.String(),
+			threshold:     1.5,
+			weight:        1.0,
+		},
+		{
+			// 上半身
+			startBoneName:  pmx.UPPER.String(),
+			endBoneName:    pmx.NECK_ROOT.String(),
+			widthBoneNames: []string{pmx.ARM.Left(), pmx.ARM.Right()},
+			threshold:      2.0,
+			weight:         1.0,
+		},
+		{
+			// 下半身
+			startBoneName:  pmx.LOWER.String(),
+			endBoneName:    pmx.LEG_CENTER.String(),
+			widthBoneNames: []string{pmx.LEG.Left(), pmx.LEG.Right()},
+			threshold:      2.0,
+			weight:         1.0,
+		},
+		{
+			// 左太もも
+			startBoneName: pmx.LEG.Left(),
+			endBoneName:   pmx.KNEE.Left(),
+			threshold:     1.0,
+			weight:        1.0,
+		},
+		{
+			// 右太もも
+			startBoneName: pmx.LEG.Right(),
+			endBoneName:   pmx.KNEE.Right(),
+			threshold:     1.0,
+			weight:        1.0,
+		},
+		{
+			// 反対の手
+			startBoneName: pmx.WRIST.StringFromDirection(oppositeDirection),
+			endBoneName:   pmx.WRIST_TAIL.StringFromDirection(oppositeDirection),
+			threshold:     1.0,
+			weight:        0.5,
+		},
+	}
+}
+
+// self_contact_bone_names 自己接触維持でデフォームするボーン名
+var self_contact_bone_names = uniqueBoneNames(
+	trunk_upper_bone_names, all_lower_leg_bone_names, all_arm_bone_names[0], all_arm_bone_names[1],
+	[]string{pmx.HEAD.String()})
+
+type SizingSelfContactUsecase struct {
+}
+
+func NewSizingSelfContactUsecase() *SizingSelfContactUsecase {
+	return &SizingSelfContactUsecase{}
+}
+
+// Exec は元モーションで手首が体(頭・上半身・下半身・太もも・反対の手)に触れているフレームで、
+// サイジング先の同じ部位の同じ相対位置に手首が来るように、腕をIKで補正します。
+func (su *SizingSelfContactUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingSelfContact || sizingSet.CompletedSizingSelfContact {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("自己接触維持開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	allFrames := mmath.IntRanges(int(sizingSet.OriginalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		sizingSet.OriginalMotion, sizingSet, true, shared_original_bone_names, "自己接触維持01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingSet.OutputMotion, sizingSet, true, self_contact_bone_names, "自己接触維持01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	wristOffsets, contactFlags, err := su.calculateContactOffsets(
+		ctx, sizingSet, allFrames, blockSize, originalAllDeltas, sizingAllDeltas)
+	if err != nil {
+		return false, err
+	}
+
+	// IK計算用に、補正前のモーションを残しておく
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	isExec := false
+	for d, direction := range directions {
+		offsets := easeContactValues(wristOffsets[d], contactFlags[d], self_contact_ease_frames, scaleOffset)
+
+		isExecDirection, err := insertWristOffsets(ctx, sizingSet, sizingProcessMotion, sizingAllDeltas, d, direction, offsets)
+		if err != nil {
+			return false, err
+		}
+		isExec = isExecDirection || isExec
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("自己接触維持03", sizingSet.OutputMotionPath, sizingSet.OutputMotion)
+	}
+
+	incrementCompletedCount()
+
+	sizingSet.CompletedSizingSelfContact = true
+
+	return isExec, nil
+}
+
+// calculateContactOffsets は元モーションで手首が体に触れているフレームで、サイジング先の同じ部位の同じ相対位置に合わせるための、
+// 手首のグローバル移動量を左右別に求めます。
+// 複数の部位に近い場合は、判定距離に対して一番近い部位に合わせる
+func (su *SizingSelfContactUsecase) calculateContactOffsets(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int,
+	originalAllDeltas, sizingAllDeltas []*delta.VmdDeltas,
+) (wristOffsets [][]*mmath.MVec3, contactFlags [][]bool, err error) {
+	// 判定距離は元モデルの肩幅に合わせて伸縮する
+	thresholdScale := su.thresholdScale(sizingSet)
+
+	parts := make([][]*selfContactPart, len(directions))
+	partScales := make([][]*mmath.MVec3, len(directions))
+	wristOffsets = make([][]*mmath.MVec3, len(directions))
+	contactFlags = make([][]bool, len(directions))
+	for d := range directions {
+		parts[d] = selfContactParts(d)
+		partScales[d] = make([]*mmath.MVec3, len(parts[d]))
+		for j, part := range parts[d] {
+			partScales[d][j] = su.partScale(sizingSet, part)
+		}
+		wristOffsets[d] = make([]*mmath.MVec3, len(allFrames))
+		contactFlags[d] = make([]bool, len(allFrames))
+	}
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for d, direction := range directions {
+				wristBoneName := pmx.WRIST.StringFromDirection(direction)
+				originalWristPosition := originalAllDeltas[index].Bones.GetByName(wristBoneName).FilledGlobalPosition()
+
+				// 判定距離に対して一番近い部位を探す
+				nearestIndex := -1
+				nearestRatio := 1.0
+				for j, part := range parts[d] {
+					startDelta := originalAllDeltas[index].Bones.GetByName(part.startBoneName)
+					endDelta := originalAllDeltas[index].Bones.GetByName(part.endBoneName)
+					if startDelta == nil || endDelta == nil {
+						continue
+					}
+
+					distance := distanceToSegment(originalWristPosition,
+						startDelta.FilledGlobalPosition(), endDelta.FilledGlobalPosition())
+					if ratio := distance / (part.threshold * thresholdScale); ratio < nearestRatio {
+						nearestIndex = j
+						nearestRatio = ratio
+					}
+				}
+
+				if nearestIndex < 0 {
+					continue
+				}
+
+				part := parts[d][nearestIndex]
+				scale := partScales[d][nearestIndex]
+
+				sizingStartDelta := sizingAllDeltas[index].Bones.GetByName(part.startBoneName)
+				if sizingStartDelta == nil {
+					continue
+				}
+
+				// 元の部位の根元ボーンから見た手首の相対位置を、サイジング先の部位の大きさに合わせる
+				localPosition := originalAllDeltas[index].Bones.GetByName(part.startBoneName).
+					FilledGlobalMatrix().Inverted().MulVec3(originalWristPosition)
+				scaledLocalPosition := &mmath.MVec3{
+					X: localPosition.X * scale.X,
+					Y: localPosition.Y * scale.Y,
+					Z: localPosition.Z * scale.Z,
+				}
+
+				sizingWristTargetPosition := sizingStartDelta.FilledGlobalMatrix().MulVec3(scaledLocalPosition)
+				sizingWristPosition := sizingAllDeltas[index].Bones.GetByName(wristBoneName).FilledGlobalPosition()
+
+				wristOffsets[d][index] = sizingWristTargetPosition.Subed(sizingWristPosition).MuledScalar(part.weight)
+				contactFlags[d][index] = true
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("自己接触維持02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 接触が続かないフレームは、触れていないものとする
+	for d := range directions {
+		start := -1
+		for index := 0; index <= len(allFrames); index++ {
+			if index < len(allFrames) && contactFlags[d][index] {
+				if start < 0 {
+					start = index
+				}
+				continue
+			}
+			if start >= 0 && index-start < self_contact_min_frames {
+				for i := start; i < index; i++ {
+					contactFlags[d][i] = false
+					wristOffsets[d][i] = nil
+				}
+			}
+			start = -1
+		}
+	}
+
+	return wristOffsets, contactFlags, nil
+}
+
+// thresholdScale は部位の判定距離に掛ける、元モデルの肩幅の標準的な肩幅に対する比率を求めます。
+// 腕ボーンが無い場合は1を返す
+func (su *SizingSelfContactUsecase) thresholdScale(sizingSet *domain.SizingSet) float64 {
+	leftArmBone, _ := sizingSet.OriginalConfigModel.Bones.GetByName(pmx.ARM.Left())
+	rightArmBone, _ := sizingSet.OriginalConfigModel.Bones.GetByName(pmx.ARM.Right())
+	if leftArmBone == nil || rightArmBone == nil {
+		return 1.0
+	}
+
+	width := leftArmBone.Position.Distance(rightArmBone.Position)
+	if mmath.NearEquals(width, 0, 1e-6) {
+		return 1.0
+	}
+
+	return width / self_contact_standard_width
+}
+
+// partScale は元モデルに対するサイジング先モデルの部位の大きさの比率を求めます。
+// 幅の基準ボーンがある場合、横(X)と前後(Z)は幅の比率、縦(Y)は長さの比率で揃える
+func (su *SizingSelfContactUsecase) partScale(sizingSet *domain.SizingSet, part *selfContactPart) *mmath.MVec3 {
+	lengthRatio := boneDistanceRatio(sizingSet, part.startBoneName, part.endBoneName)
+	widthRatio := lengthRatio
+	if len(part.widthBoneNames) == 2 {
+		widthRatio = boneDistanceRatio(sizingSet, part.widthBoneNames[0], part.widthBoneNames[1])
+	}
+
+	return &mmath.MVec3{X: widthRatio, Y: lengthRatio, Z: widthRatio}
+}
+
+// boneDistanceRatio は2つのボーン間の距離の、元モデルに対するサイジング先モデルの比率を求めます。
+// ボーンが無い場合は1を返す
+func boneDistanceRatio(sizingSet *domain.SizingSet, boneName1, boneName2 string) float64 {
+	originalBone1, _ := sizingSet.OriginalConfigModel.Bones.GetByName(boneName1)
+	originalBone2, _ := sizingSet.OriginalConfigModel.Bones.GetByName(boneName2)
+	sizingBone1, _ := sizingSet.SizingConfigModel.Bones.GetByName(boneName1)
+	sizingBone2, _ := sizingSet.SizingConfigModel.Bones.GetByName(boneName2)
+	if originalBone1 == nil || originalBone2 == nil || sizingBone1 == nil || sizingBone2 == nil {
+		return 1.0
+	}
+
+	originalDistance := originalBone1.Position.Distance(originalBone2.Position)
+	if mmath.NearEquals(originalDistance, 0, 1e-6) {
+		return 1.0
+	}
+
+	return sizingBone1.Position.Distance(sizingBone2.Position) / originalDistance
+}
+
+// distanceToSegment は点から線分までの最短距離を求めます。
+func distanceToSegment(point, start, end *mmath.MVec3) float64 {
+	segment := end.Subed(start)
+	lengthSq := segment.Dot(segment)
+	if lengthSq == 0 {
+		return point.Distance(start)
+	}
+
+	t := max(0, min(1, point.Subed(start).Dot(segment)/lengthSq))
+	return point.Distance(start.Added(segment.MuledScalar(t)))
+}
+
+func (su *SizingSelfContactUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.OriginalUpperBone, BoneName: pmx.UPPER},
+			{CheckFunk: sizingSet.OriginalLowerBone, BoneName: pmx.LOWER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalWristBone, BoneName: pmx.WRIST},
+		},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingUpperBone, BoneName: pmx.UPPER},
+			{CheckFunk: sizingSet.SizingLowerBone, BoneName: pmx.LOWER},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.SizingElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.SizingWristBone, BoneName: pmx.WRIST},
+		},
+	)
+}
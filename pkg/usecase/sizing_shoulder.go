@@ -1,11 +1,11 @@
 package usecase
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
 
-	"github.com/miu200521358/mlib_go/pkg/config/merr"
 	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
 	"github.com/miu200521358/mlib_go/pkg/config/mlog"
 	"github.com/miu200521358/mlib_go/pkg/domain/delta"
@@ -24,7 +24,7 @@ func NewSizingShoulderUsecase() *SizingShoulderUsecase {
 }
 
 // SizingShoulder は肩補正処理を行います。
-func (su *SizingShoulderUsecase) Exec(sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func()) (bool, error) {
+func (su *SizingShoulderUsecase) Exec(ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func()) (bool, error) {
 	// 対象外の場合は何もせず終了
 	if !sizingSet.IsSizingShoulder || sizingSet.CompletedSizingShoulder {
 		return false, nil
@@ -46,18 +46,18 @@ func (su *SizingShoulderUsecase) Exec(sizingSet *domain.SizingSet, sizingSetCoun
 	allFrames := mmath.IntRanges(int(originalMotion.MaxFrame()) + 1)
 	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
 
-	sizingAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel, sizingProcessMotion, sizingSet, true, append(all_arm_bone_names[0], all_arm_bone_names[1]...), "肩補正01", incrementCompletedCount)
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel, sizingProcessMotion, sizingSet, true, append(all_arm_bone_names[0], all_arm_bone_names[1]...), "肩補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	incrementCompletedCount()
 
-	if err := su.calculateAdjustedShoulder(sizingSet, allFrames, blockSize, sizingAllDeltas, sizingProcessMotion, incrementCompletedCount); err != nil {
+	if err := su.calculateAdjustedShoulder(ctx, sizingSet, allFrames, blockSize, sizingAllDeltas, sizingProcessMotion, incrementCompletedCount); err != nil {
 		return false, err
 	}
 
-	if err := su.updateOutputMotion(sizingSet, allFrames, blockSize, sizingProcessMotion,
+	if err := su.updateOutputMotion(ctx, sizingSet, allFrames, blockSize, sizingProcessMotion,
 		incrementCompletedCount); err != nil {
 		return false, err
 	}
@@ -162,7 +162,7 @@ func (su *SizingShoulderUsecase) createWristIkBone(sizingSet *domain.SizingSet,
 }
 
 func (su *SizingShoulderUsecase) calculateAdjustedShoulder(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int,
 	sizingAllDeltas []*delta.VmdDeltas, sizingProcessMotion *vmd.VmdMotion,
 	incrementCompletedCount func(),
 ) error {
@@ -230,8 +230,8 @@ func (su *SizingShoulderUsecase) calculateAdjustedShoulder(
 
 	err := miter.IterParallelByList(allFrames, blockSize, log_block_size,
 		func(index, data int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			frame := float32(data)
@@ -428,7 +428,7 @@ func (su *SizingShoulderUsecase) updateShoulder(
 }
 
 func (su *SizingShoulderUsecase) updateOutputMotion(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, sizingProcessMotion *vmd.VmdMotion,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, sizingProcessMotion *vmd.VmdMotion,
 	incrementCompletedCount func(),
 ) error {
 	// 肩補正処理の結果をサイジング先モーションに反映
@@ -460,7 +460,7 @@ func (su *SizingShoulderUsecase) updateOutputMotion(
 	err := miter.IterParallelByList(directions, 1, 1,
 		func(dIndex int, direction pmx.BoneDirection) error {
 			for tIndex, targetFrames := range [][]int{activeFrames, allFrames} {
-				processAllDeltas, err := computeVmdDeltas(targetFrames, blockSize,
+				processAllDeltas, err := computeVmdDeltas(ctx, targetFrames, blockSize,
 					sizingModel, sizingProcessMotion, sizingSet, true, all_arm_bone_names[dIndex], "肩補正01", incrementCompletedCount)
 				if err != nil {
 					return err
@@ -469,13 +469,13 @@ func (su *SizingShoulderUsecase) updateOutputMotion(
 				prevLog := 0
 
 				for fIndex, iFrame := range targetFrames {
-					if sizingSet.IsTerminate {
-						return merr.NewTerminateError("manual terminate")
+					if err := checkTerminate(ctx); err != nil {
+						return err
 					}
 					frame := float32(iFrame)
 
 					// 現時点の結果
-					resultAllVmdDeltas, err := computeVmdDeltas([]int{iFrame}, 1,
+					resultAllVmdDeltas, err := computeVmdDeltas(ctx, []int{iFrame}, 1,
 						sizingModel, outputMotion, sizingSet, true, all_arm_bone_names[dIndex], "", nil)
 					if err != nil {
 						return err
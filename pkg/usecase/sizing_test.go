@@ -0,0 +1,135 @@
+package usecase
+
+import (
+	"math"
+	"testing"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+)
+
+func TestGenerateSizingScales(t *testing.T) {
+	newSet := func(index int, mode domain.SizingScaleMode, value float64, policy domain.SizingScalePolicy) *domain.SizingSet {
+		sizingSet := domain.NewSizingSet(index)
+		sizingSet.ScaleMode = mode
+		sizingSet.ScaleValue = value
+		sizingSet.ScalePolicy = policy
+		return sizingSet
+	}
+
+	for _, tc := range []struct {
+		name       string
+		sizingSets []*domain.SizingSet
+		expected   []*mmath.MVec3
+	}{
+		{
+			name:       "モデル未読込は等倍",
+			sizingSets: []*domain.SizingSet{domain.NewSizingSet(0)},
+			expected:   []*mmath.MVec3{{X: 1, Y: 1, Z: 1}},
+		},
+		{
+			name:       "固定値",
+			sizingSets: []*domain.SizingSet{newSet(0, domain.SizingScaleModeFixed, 1.5, "")},
+			expected:   []*mmath.MVec3{{X: 1.5, Y: 1.5, Z: 1.5}},
+		},
+		{
+			name: "固定値は平均に含めない",
+			sizingSets: []*domain.SizingSet{
+				newSet(0, domain.SizingScaleModeFixed, 1.5, ""),
+				newSet(1, domain.SizingScaleModeFixed, 1.3, domain.SizingScalePolicyMean),
+				domain.NewSizingSet(2),
+			},
+			expected: []*mmath.MVec3{{X: 1.5, Y: 1.5, Z: 1.5}, {X: 1.3, Y: 1.3, Z: 1.3}, {X: 1, Y: 1, Z: 1}},
+		},
+		{
+			name: "独立",
+			sizingSets: []*domain.SizingSet{
+				newSet(0, domain.SizingScaleModeFixed, 1.5, domain.SizingScalePolicyIndependent),
+				newSet(1, domain.SizingScaleModeFixed, 0.8, domain.SizingScalePolicyIndependent),
+			},
+			expected: []*mmath.MVec3{{X: 1.5, Y: 1.5, Z: 1.5}, {X: 0.8, Y: 0.8, Z: 0.8}},
+		},
+		{
+			name: "基準セットに合わせる",
+			sizingSets: []*domain.SizingSet{
+				newSet(0, domain.SizingScaleModeFixed, 1.1, domain.SizingScalePolicyIndependent),
+				func() *domain.SizingSet {
+					sizingSet := newSet(1, domain.SizingScaleModeFixed, 0.9, domain.SizingScalePolicyAnchor)
+					sizingSet.ScaleAnchorIndex = 0
+					return sizingSet
+				}(),
+			},
+			expected: []*mmath.MVec3{{X: 1.1, Y: 1.1, Z: 1.1}, {X: 1.1, Y: 0.9, Z: 1.1}},
+		},
+		{
+			name: "軸毎の指定は平均に含めない",
+			sizingSets: []*domain.SizingSet{
+				func() *domain.SizingSet {
+					sizingSet := newSet(0, domain.SizingScaleModeAxis, 0, "")
+					sizingSet.ScaleAxis = &mmath.MVec3{X: 0.9, Y: 0, Z: 1.1}
+					return sizingSet
+				}(),
+				newSet(1, domain.SizingScaleModeFixed, 1.1, ""),
+			},
+			expected: []*mmath.MVec3{{X: 0.9, Y: 1, Z: 1.1}, {X: 1.1, Y: 1.1, Z: 1.1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			scales := GenerateSizingScales(tc.sizingSets)
+			if len(scales) != len(tc.expected) {
+				t.Fatalf("expected %d scales, got %d", len(tc.expected), len(scales))
+			}
+			for i, expected := range tc.expected {
+				if !scaleNearEquals(scales[i], expected) {
+					t.Errorf("[%d] expected %v, got %v", i, expected, scales[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSizingScalesAuto(t *testing.T) {
+	sizingSet := newFixtureSizingSet(t)
+
+	scales := GenerateSizingScales([]*domain.SizingSet{sizingSet})
+
+	// フィクスチャのサイジング先モデルは縦1.2倍なので、足の長さ比率もおおよそ1.2倍になる
+	if math.Abs(scales[0].Y-1.2) > 0.05 {
+		t.Errorf("expected leg length scale about 1.2, got %v", scales[0])
+	}
+	if scales[0].X != scales[0].Z {
+		t.Errorf("expected same XZ scale, got %v", scales[0])
+	}
+}
+
+func scaleNearEquals(a, b *mmath.MVec3) bool {
+	return math.Abs(a.X-b.X) < 1e-6 && math.Abs(a.Y-b.Y) < 1e-6 && math.Abs(a.Z-b.Z) < 1e-6
+}
+
+func TestEaseContactValues(t *testing.T) {
+	values := []float64{0, 0, 0, 4, 0, 0, 0, 2, 0}
+	contactFlags := []bool{false, false, false, true, false, false, false, true, false}
+
+	eased := easeContactValues(values, contactFlags, 3, scaleDiff)
+
+	// 接触区間の値はそのまま
+	if eased[3] != 4 || eased[7] != 2 {
+		t.Errorf("expected contact values unchanged, got %v", eased)
+	}
+	// 近い方の区間の端から埋める
+	if expected := 4 * easeInOut(0.75); math.Abs(eased[4]-expected) > 1e-9 {
+		t.Errorf("[4] expected %v, got %v", expected, eased[4])
+	}
+	if expected := 2 * easeInOut(0.75); math.Abs(eased[6]-expected) > 1e-9 {
+		t.Errorf("[6] expected %v, got %v", expected, eased[6])
+	}
+	// 同じ距離の場合は前の区間から埋める
+	if expected := 4 * easeInOut(0.5); math.Abs(eased[5]-expected) > 1e-9 {
+		t.Errorf("[5] expected %v, got %v", expected, eased[5])
+	}
+	// 区間から easeFrames を超えて離れたフレームは埋めない
+	if eased[0] != 0 {
+		t.Errorf("[0] expected 0, got %v", eased[0])
+	}
+}
@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
@@ -24,7 +25,7 @@ func NewSizingUpperUsecase() *SizingUpperUsecase {
 }
 
 func (su *SizingUpperUsecase) Exec(
-	sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
 ) (bool, error) {
 	// 対象外の場合は何もせず終了
 	if !sizingSet.IsSizingUpper || sizingSet.CompletedSizingUpper {
@@ -51,21 +52,21 @@ func (su *SizingUpperUsecase) Exec(
 	// [焼き込み] -----------------------
 
 	// 元モデルのデフォーム結果を並列処理で取得
-	originalAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.OriginalConfigModel,
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
 		originalMotion, sizingSet, true, trunk_upper_bone_names, "上半身補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	// 元モデルのモーフデフォーム結果を並列処理で取得
-	originalMorphAllDeltas, err := computeMorphVmdDeltas(allFrames, blockSize, sizingSet.OriginalConfigModel,
+	originalMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
 		originalMotion, sizingSet, trunk_upper_bone_names, "上半身補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
 	}
 
 	// 先モデルのモーフデフォーム結果を並列処理で取得
-	sizingMorphAllDeltas, err := computeMorphVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+	sizingMorphAllDeltas, err := computeCachedMorphVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 		originalMotion, sizingSet, trunk_upper_bone_names, "上半身補正01", incrementCompletedCount)
 	if err != nil {
 		return false, err
@@ -79,7 +80,7 @@ func (su *SizingUpperUsecase) Exec(
 		}
 
 		// 先モデルの足中心までのデフォーム結果を並列処理で取得
-		sizingAllDeltas, err := computeVmdDeltas(allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
 			sizingProcessMotion, sizingSet, true, trunk_upper_bone_names, "上半身補正01", incrementCompletedCount)
 		if err != nil {
 			return false, err
@@ -88,7 +89,7 @@ func (su *SizingUpperUsecase) Exec(
 		// サイジング先の上半身回転情報を取得(全フレーム処理してズレ検知用)
 		upperRotations, upper2Rotations, neckRotations, leftArmRotations, rightArmRotations, err :=
 			su.calculateAdjustedUpper(
-				sizingSet, allFrames, blockSize,
+				ctx, sizingSet, allFrames, blockSize,
 				originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas,
 				sizingProcessMotion, incrementCompletedCount, "上02")
 		if err != nil {
@@ -105,7 +106,7 @@ func (su *SizingUpperUsecase) Exec(
 
 	{
 		if err = su.updateOutputMotion(
-			sizingSet, allFrames, blockSize, sizingProcessMotion, "上04",
+			ctx, sizingSet, allFrames, blockSize, sizingProcessMotion, "上04",
 			incrementCompletedCount,
 		); err != nil {
 			return false, err
@@ -250,7 +251,7 @@ func (su *SizingUpperUsecase) createUpperIkBone(sizingSet *domain.SizingSet) *pm
 }
 
 func (su *SizingUpperUsecase) calculateAdjustedUpper(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int,
 	originalAllDeltas, sizingAllDeltas, originalMorphAllDeltas, sizingMorphAllDeltas []*delta.VmdDeltas,
 	sizingProcessMotion *vmd.VmdMotion, incrementCompletedCount func(), verboseMotionName string,
 ) (
@@ -301,8 +302,8 @@ func (su *SizingUpperUsecase) calculateAdjustedUpper(
 
 	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
 		func(index, data int) error {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 
 			// 上半身から首根元の傾き
@@ -551,7 +552,7 @@ func (su *SizingUpperUsecase) updateUpper(
 }
 
 func (su *SizingUpperUsecase) updateOutputMotion(
-	sizingSet *domain.SizingSet, allFrames []int, blockSize int, sizingProcessMotion *vmd.VmdMotion,
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, sizingProcessMotion *vmd.VmdMotion,
 	verboseMotionKey string, incrementCompletedCount func(),
 ) error {
 	// 補正の結果をサイジング先モーションに反映
@@ -587,7 +588,7 @@ func (su *SizingUpperUsecase) updateOutputMotion(
 	neckRootThreshold := 0.2
 
 	for tIndex, targetFrames := range [][]int{activeFrames, intervalFrames, allFrames} {
-		processAllDeltas, err := computeVmdDeltas(targetFrames, blockSize,
+		processAllDeltas, err := computeVmdDeltas(ctx, targetFrames, blockSize,
 			sizingModel, sizingProcessMotion, sizingSet, true, trunk_upper_bone_names, "上半身補正01", incrementCompletedCount)
 		if err != nil {
 			return err
@@ -596,13 +597,13 @@ func (su *SizingUpperUsecase) updateOutputMotion(
 		prevLog := 0
 		prevFrame := 0
 		for fIndex, iFrame := range targetFrames {
-			if sizingSet.IsTerminate {
-				return merr.NewTerminateError("manual terminate")
+			if err := checkTerminate(ctx); err != nil {
+				return err
 			}
 			frame := float32(iFrame)
 
 			// 現時点の結果
-			resultAllVmdDeltas, err := computeVmdDeltas([]int{iFrame}, 1,
+			resultAllVmdDeltas, err := computeVmdDeltas(ctx, []int{iFrame}, 1,
 				sizingModel, outputMotion, sizingSet, true, trunk_upper_bone_names, "", nil)
 			if err != nil {
 				return err
@@ -0,0 +1,448 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miu200521358/vmd_sizing_t4/pkg/domain"
+
+	"github.com/miu200521358/mlib_go/pkg/config/mi18n"
+	"github.com/miu200521358/mlib_go/pkg/config/mlog"
+	"github.com/miu200521358/mlib_go/pkg/domain/delta"
+	"github.com/miu200521358/mlib_go/pkg/domain/mmath"
+	"github.com/miu200521358/mlib_go/pkg/domain/pmx"
+	"github.com/miu200521358/mlib_go/pkg/domain/vmd"
+	"github.com/miu200521358/mlib_go/pkg/infrastructure/miter"
+	"github.com/miu200521358/mlib_go/pkg/usecase/deform"
+)
+
+type SizingWristUsecase struct {
+}
+
+func NewSizingWristUsecase() *SizingWristUsecase {
+	return &SizingWristUsecase{}
+}
+
+// Exec は手首の位置を元モデルの手首位置(体幹基準でスケール)に合わせます。
+func (su *SizingWristUsecase) Exec(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingSetCount int, incrementCompletedCount func(),
+) (bool, error) {
+	// 対象外の場合は何もせず終了
+	if !sizingSet.IsSizingWrist || sizingSet.CompletedSizingWrist {
+		return false, nil
+	}
+
+	// 処理対象ボーンチェック
+	if err := su.checkBones(sizingSet); err != nil {
+		return false, err
+	}
+
+	mlog.I(mi18n.T("手首位置合わせ開始", map[string]interface{}{"No": sizingSet.Index + 1}))
+
+	originalMotion := sizingSet.OriginalMotion
+	sizingProcessMotion, err := sizingSet.OutputMotion.Copy()
+	if err != nil {
+		return false, err
+	}
+
+	allFrames := mmath.IntRanges(int(originalMotion.MaxFrame()) + 1)
+	blockSize, _ := miter.GetBlockSize(len(allFrames) * sizingSetCount)
+
+	armBoneNames := append(all_arm_bone_names[0], all_arm_bone_names[1]...)
+
+	originalAllDeltas, err := computeCachedVmdDeltas(ctx, allFrames, blockSize, sizingSet.OriginalConfigModel,
+		originalMotion, sizingSet, true, armBoneNames, "手首位置合わせ01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	sizingAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingSet.SizingConfigModel,
+		sizingProcessMotion, sizingSet, true, armBoneNames, "手首位置合わせ01", incrementCompletedCount)
+	if err != nil {
+		return false, err
+	}
+
+	if err := su.calculateAdjustedWrist(ctx, sizingSet, allFrames, blockSize,
+		originalAllDeltas, sizingAllDeltas, sizingProcessMotion, incrementCompletedCount); err != nil {
+		return false, err
+	}
+
+	if err := su.updateOutputMotion(ctx, sizingSet, allFrames, blockSize, sizingProcessMotion,
+		incrementCompletedCount); err != nil {
+		return false, err
+	}
+
+	sizingSet.CompletedSizingWrist = true
+
+	return true, nil
+}
+
+// createWristIkBone は腕とひじを動かして手首を合わせるIKボーンを生成します。
+func (su *SizingWristUsecase) createWristIkBone(sizingSet *domain.SizingSet, direction pmx.BoneDirection) *pmx.Bone {
+	// 手首IK
+	armBone, _ := sizingSet.SizingConfigModel.Bones.GetByName(pmx.ARM.StringFromDirection(direction))
+	elbowBone, _ := sizingSet.SizingConfigModel.Bones.GetByName(pmx.ELBOW.StringFromDirection(direction))
+	wristBone, _ := sizingSet.SizingConfigModel.Bones.GetByName(pmx.WRIST.StringFromDirection(direction))
+
+	ikBone := pmx.NewBoneByName(fmt.Sprintf("%s%s位置Ik", pmx.MLIB_PREFIX, wristBone.Name()))
+	ikBone.Position = wristBone.Position.Copy()
+	ikBone.Ik = pmx.NewIk()
+	ikBone.Ik.BoneIndex = wristBone.Index()
+	ikBone.Ik.LoopCount = 100
+	ikBone.Ik.UnitRotation = &mmath.MVec3{X: 0.1, Y: 0.0, Z: 0.0}
+	ikBone.Ik.Links = make([]*pmx.IkLink, 0)
+	for _, boneIndex := range wristBone.ParentBoneIndexes {
+		parentBone, _ := sizingSet.SizingConfigModel.Bones.Get(boneIndex)
+		link := pmx.NewIkLink()
+		link.BoneIndex = parentBone.Index()
+		if parentBone.Name() != armBone.Name() && parentBone.Name() != elbowBone.Name() {
+			// 腕とひじ以外は動かさない
+			link.AngleLimit = true
+		}
+		ikBone.Ik.Links = append(ikBone.Ik.Links, link)
+
+		if parentBone.Name() == armBone.Name() {
+			// 腕までいったら終了
+			break
+		}
+	}
+
+	return ikBone
+}
+
+// calculateWristScales は首根元基準・体幹中心基準それぞれの手首位置のスケールを求めます。
+func (su *SizingWristUsecase) calculateWristScales(sizingSet *domain.SizingSet) (armScales []float64, trunkScale float64) {
+	armScales = make([]float64, len(directions))
+	for i, direction := range directions {
+		originalLength := sizingSet.OriginalNeckRootBone().Position.Distance(sizingSet.OriginalArmBone(direction).Position) +
+			sizingSet.OriginalArmBone(direction).Position.Distance(sizingSet.OriginalElbowBone(direction).Position) +
+			sizingSet.OriginalElbowBone(direction).Position.Distance(sizingSet.OriginalWristBone(direction).Position)
+		sizingLength := sizingSet.SizingNeckRootBone().Position.Distance(sizingSet.SizingArmBone(direction).Position) +
+			sizingSet.SizingArmBone(direction).Position.Distance(sizingSet.SizingElbowBone(direction).Position) +
+			sizingSet.SizingElbowBone(direction).Position.Distance(sizingSet.SizingWristBone(direction).Position)
+		armScales[i] = sizingLength / originalLength
+	}
+
+	trunkScale = sizingSet.SizingTrunkRootBone().Position.Distance(sizingSet.SizingNeckRootBone().Position) /
+		sizingSet.OriginalTrunkRootBone().Position.Distance(sizingSet.OriginalNeckRootBone().Position)
+
+	return armScales, trunkScale
+}
+
+// calculateAdjustedWrist は手首の理想位置を求め、IKで腕とひじの回転を求めます。
+func (su *SizingWristUsecase) calculateAdjustedWrist(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int,
+	originalAllDeltas, sizingAllDeltas []*delta.VmdDeltas, sizingProcessMotion *vmd.VmdMotion,
+	incrementCompletedCount func(),
+) error {
+	wristIkBones := make([]*pmx.Bone, len(directions))
+	for i, direction := range directions {
+		wristIkBones[i] = su.createWristIkBone(sizingSet, direction)
+	}
+
+	armScales, trunkScale := su.calculateWristScales(sizingSet)
+
+	armResultRotations := make([][]*mmath.MQuaternion, len(directions))
+	elbowResultRotations := make([][]*mmath.MQuaternion, len(directions))
+	wristResultRotations := make([][]*mmath.MQuaternion, len(directions))
+	for i := range directions {
+		armResultRotations[i] = make([]*mmath.MQuaternion, len(allFrames))
+		elbowResultRotations[i] = make([]*mmath.MQuaternion, len(allFrames))
+		wristResultRotations[i] = make([]*mmath.MQuaternion, len(allFrames))
+	}
+
+	err := miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, data int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			frame := float32(data)
+
+			originalNeckRootDelta := originalAllDeltas[index].Bones.GetByName(pmx.NECK_ROOT.String())
+			originalTrunkRootDelta := originalAllDeltas[index].Bones.GetByName(pmx.TRUNK_ROOT.String())
+			sizingNeckRootDelta := sizingAllDeltas[index].Bones.GetByName(pmx.NECK_ROOT.String())
+			sizingTrunkRootDelta := sizingAllDeltas[index].Bones.GetByName(pmx.TRUNK_ROOT.String())
+
+			for i, direction := range directions {
+				wristBone := sizingSet.SizingWristBone(direction)
+
+				originalWristPosition := originalAllDeltas[index].Bones.GetByName(
+					wristBone.Name()).FilledGlobalPosition()
+
+				// 元の首根元・体幹中心から見た、元手首のローカル位置
+				originalWristLocalFromNeckRoot := originalNeckRootDelta.FilledGlobalMatrix().Inverted().MulVec3(
+					originalWristPosition)
+				originalWristLocalFromTrunkRoot := originalTrunkRootDelta.FilledGlobalMatrix().Inverted().MulVec3(
+					originalWristPosition)
+
+				// 先の首根元・体幹中心から見た、手首の理想位置
+				sizingWristIdealFromNeckRoot := sizingNeckRootDelta.FilledGlobalMatrix().MulVec3(
+					originalWristLocalFromNeckRoot.MuledScalar(armScales[i]))
+				sizingWristIdealFromTrunkRoot := sizingTrunkRootDelta.FilledGlobalMatrix().MulVec3(
+					originalWristLocalFromTrunkRoot.MuledScalar(trunkScale))
+
+				// 元の手首が体幹中心に近いほど、体幹中心基準の位置を優先する
+				neckRootDistance := originalWristLocalFromNeckRoot.Length()
+				trunkRootDistance := originalWristLocalFromTrunkRoot.Length()
+				trunkWeight := 0.5
+				if neckRootDistance+trunkRootDistance > 0 {
+					trunkWeight = neckRootDistance / (neckRootDistance + trunkRootDistance)
+				}
+
+				sizingWristIdealPosition := sizingWristIdealFromNeckRoot.Added(
+					sizingWristIdealFromTrunkRoot.Subed(sizingWristIdealFromNeckRoot).MuledScalar(trunkWeight))
+
+				armResultRotations[i][index], elbowResultRotations[i][index], wristResultRotations[i][index] =
+					solveWristIk(sizingSet, sizingProcessMotion, sizingAllDeltas[index], frame, i, direction,
+						wristIkBones[i], sizingWristIdealPosition)
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			processLog("手首位置合わせ02", sizingSet.Index, iterIndex, allCount)
+		})
+	if err != nil {
+		return err
+	}
+
+	incrementCompletedCount()
+
+	// 腕系回転をサイジング先モーションに反映
+	su.updateArm(sizingSet, allFrames, sizingProcessMotion,
+		armResultRotations, elbowResultRotations, wristResultRotations)
+
+	incrementCompletedCount()
+
+	return nil
+}
+
+// solveWristIk は手首が目標位置に来るように、IKで腕とひじの回転を求めます。
+// 手首のグローバル回転は維持する
+func solveWristIk(
+	sizingSet *domain.SizingSet, sizingProcessMotion *vmd.VmdMotion, sizingDeltas *delta.VmdDeltas, frame float32,
+	directionIndex int, direction pmx.BoneDirection, wristIkBone *pmx.Bone, wristTargetPosition *mmath.MVec3,
+) (armRotation, elbowRotation, wristRotation *mmath.MQuaternion) {
+	armBone := sizingSet.SizingArmBone(direction)
+	elbowBone := sizingSet.SizingElbowBone(direction)
+	wristBone := sizingSet.SizingWristBone(direction)
+
+	sizingWristDeltas, _ := deform.DeformIks(sizingSet.SizingConfigModel, sizingProcessMotion,
+		sizingDeltas, frame, []*pmx.Bone{wristIkBone}, []*pmx.Bone{wristBone},
+		[]*mmath.MVec3{wristTargetPosition}, all_arm_bone_names[directionIndex], 5, false, false)
+
+	armRotation = sizingWristDeltas.Bones.GetByName(armBone.Name()).FilledFrameRotation().Copy()
+	elbowRotation = sizingWristDeltas.Bones.GetByName(elbowBone.Name()).FilledFrameRotation().Copy()
+
+	originalWristParentQuat := sizingDeltas.Bones.Get(wristBone.ParentIndex).FilledGlobalMatrix().Quaternion()
+	resultWristParentQuat := sizingWristDeltas.Bones.Get(wristBone.ParentIndex).FilledGlobalMatrix().Quaternion()
+	wristQuat := sizingDeltas.Bones.Get(wristBone.Index()).FilledFrameRotation()
+	wristRotation = resultWristParentQuat.Inverted().Muled(originalWristParentQuat).Muled(wristQuat)
+
+	return armRotation, elbowRotation, wristRotation
+}
+
+// insertWristOffsets は手首のグローバル移動量から、IKで腕系の回転を求めて出力モーションに反映します。
+// 移動量がnilのフレームは補正しない
+func insertWristOffsets(
+	ctx context.Context, sizingSet *domain.SizingSet, sizingProcessMotion *vmd.VmdMotion,
+	sizingAllDeltas []*delta.VmdDeltas, directionIndex int, direction pmx.BoneDirection, offsets []*mmath.MVec3,
+) (bool, error) {
+	wristIkBone := NewSizingWristUsecase().createWristIkBone(sizingSet, direction)
+	wristBoneName := sizingSet.SizingWristBone(direction).Name()
+
+	isExec := false
+	for index, offset := range offsets {
+		if offset == nil {
+			continue
+		}
+		if err := checkTerminate(ctx); err != nil {
+			return false, err
+		}
+
+		frame := float32(index)
+		wristTargetPosition := sizingAllDeltas[index].Bones.GetByName(wristBoneName).FilledGlobalPosition().Added(offset)
+
+		armRotation, elbowRotation, wristRotation := solveWristIk(sizingSet, sizingProcessMotion,
+			sizingAllDeltas[index], frame, directionIndex, direction, wristIkBone, wristTargetPosition)
+
+		for _, v := range []struct {
+			boneName string
+			rotation *mmath.MQuaternion
+		}{
+			{pmx.ARM.StringFromDirection(direction), armRotation},
+			{pmx.ELBOW.StringFromDirection(direction), elbowRotation},
+			{pmx.WRIST.StringFromDirection(direction), wristRotation},
+		} {
+			bf := sizingSet.OutputMotion.BoneFrames.Get(v.boneName).Get(frame)
+			bf.Rotation = v.rotation
+			sizingSet.OutputMotion.InsertBoneFrame(v.boneName, bf)
+		}
+		isExec = true
+	}
+
+	return isExec, nil
+}
+
+// updateArm は、補正した腕系の回転をサイジング先モーションに反映します。
+func (su *SizingWristUsecase) updateArm(
+	sizingSet *domain.SizingSet, allFrames []int, sizingProcessMotion *vmd.VmdMotion,
+	armRotations, elbowRotations, wristRotations [][]*mmath.MQuaternion,
+) {
+	for i, iFrame := range allFrames {
+		frame := float32(iFrame)
+		for j, direction := range directions {
+			for _, v := range []struct {
+				boneName  string
+				rotations []*mmath.MQuaternion
+			}{
+				{pmx.ARM.StringFromDirection(direction), armRotations[j]},
+				{pmx.ELBOW.StringFromDirection(direction), elbowRotations[j]},
+				{pmx.WRIST.StringFromDirection(direction), wristRotations[j]},
+			} {
+				bf := sizingProcessMotion.BoneFrames.Get(v.boneName).Get(frame)
+				bf.Rotation = v.rotations[i]
+				sizingProcessMotion.InsertBoneFrame(v.boneName, bf)
+			}
+		}
+
+		if i > 0 && i%1000 == 0 {
+			processLog("手首位置合わせ03", sizingSet.Index, i, len(allFrames))
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("手首03", sizingSet.OutputMotionPath, sizingProcessMotion)
+	}
+}
+
+func (su *SizingWristUsecase) updateOutputMotion(
+	ctx context.Context, sizingSet *domain.SizingSet, allFrames []int, blockSize int, sizingProcessMotion *vmd.VmdMotion,
+	incrementCompletedCount func(),
+) error {
+	// 手首位置合わせ処理の結果をサイジング先モーションに反映
+	sizingModel := sizingSet.SizingConfigModel
+	outputMotion := sizingSet.OutputMotion
+
+	// 既存のキーフレームは上書きする
+	for _, direction := range directions {
+		for _, boneName := range []string{
+			pmx.ARM.StringFromDirection(direction), pmx.ELBOW.StringFromDirection(direction),
+			pmx.WRIST.StringFromDirection(direction),
+		} {
+			if !outputMotion.BoneFrames.Contains(boneName) {
+				continue
+			}
+
+			outputMotion.BoneFrames.Get(boneName).ForEach(func(frame float32, bf *vmd.BoneFrame) bool {
+				processBf := sizingProcessMotion.BoneFrames.Get(boneName).Get(frame)
+				bf.Rotation = processBf.FilledRotation().Copy()
+				outputMotion.BoneFrames.Get(boneName).Update(bf)
+				return true
+			})
+		}
+	}
+
+	// 中間キーフレのズレをチェック
+	threshold := 0.1
+	armBoneNames := append(all_arm_bone_names[0], all_arm_bone_names[1]...)
+
+	processAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingModel, sizingProcessMotion,
+		sizingSet, true, armBoneNames, "", nil)
+	if err != nil {
+		return err
+	}
+
+	resultAllDeltas, err := computeVmdDeltas(ctx, allFrames, blockSize, sizingModel, outputMotion,
+		sizingSet, true, armBoneNames, "", incrementCompletedCount)
+	if err != nil {
+		return err
+	}
+
+	driftFrames := make([][]bool, len(directions))
+	for i := range directions {
+		driftFrames[i] = make([]bool, len(allFrames))
+	}
+
+	err = miter.IterParallelByList(allFrames, blockSize, log_block_size,
+		func(index, iFrame int) error {
+			if err := checkTerminate(ctx); err != nil {
+				return err
+			}
+
+			for i, direction := range directions {
+				for _, boneName := range []string{
+					pmx.ELBOW.StringFromDirection(direction), pmx.WRIST.StringFromDirection(direction),
+				} {
+					processDelta := processAllDeltas[index].Bones.GetByName(boneName)
+					resultDelta := resultAllDeltas[index].Bones.GetByName(boneName)
+					if processDelta.FilledGlobalPosition().Distance(resultDelta.FilledGlobalPosition()) > threshold {
+						driftFrames[i][index] = true
+					}
+				}
+			}
+
+			return nil
+		},
+		func(iterIndex, allCount int) {
+			mlog.I(mi18n.T("手首位置合わせ04", map[string]interface{}{
+				"No":          sizingSet.Index + 1,
+				"IterIndex":   fmt.Sprintf("%04d", iterIndex),
+				"AllCount":    fmt.Sprintf("%04d", allCount),
+				"FramesIndex": 1}))
+		})
+	if err != nil {
+		return err
+	}
+
+	// ズレている場合、元の回転を焼き込む
+	for i, direction := range directions {
+		for index, iFrame := range allFrames {
+			if !driftFrames[i][index] {
+				continue
+			}
+
+			frame := float32(iFrame)
+			for _, boneName := range []string{
+				pmx.ARM.StringFromDirection(direction), pmx.ELBOW.StringFromDirection(direction),
+				pmx.WRIST.StringFromDirection(direction),
+			} {
+				processBf := sizingProcessMotion.BoneFrames.Get(boneName).Get(frame)
+				resultBf := outputMotion.BoneFrames.Get(boneName).Get(frame)
+				resultBf.Rotation = processBf.FilledRotation().Copy()
+				outputMotion.InsertBoneFrame(boneName, resultBf)
+			}
+		}
+	}
+
+	if mlog.IsDebug() {
+		outputVerboseMotion("手首04", sizingSet.OutputMotionPath, outputMotion)
+	}
+
+	return nil
+}
+
+func (su *SizingWristUsecase) checkBones(sizingSet *domain.SizingSet) (err error) {
+	return checkBones(
+		sizingSet,
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.OriginalTrunkRootBone, BoneName: pmx.TRUNK_ROOT},
+			{CheckFunk: sizingSet.OriginalNeckRootBone, BoneName: pmx.NECK_ROOT},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.OriginalArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.OriginalElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.OriginalWristBone, BoneName: pmx.WRIST},
+		},
+		[]domain.CheckTrunkBoneType{
+			{CheckFunk: sizingSet.SizingTrunkRootBone, BoneName: pmx.TRUNK_ROOT},
+			{CheckFunk: sizingSet.SizingNeckRootBone, BoneName: pmx.NECK_ROOT},
+		},
+		[]domain.CheckDirectionBoneType{
+			{CheckFunk: sizingSet.SizingArmBone, BoneName: pmx.ARM},
+			{CheckFunk: sizingSet.SizingElbowBone, BoneName: pmx.ELBOW},
+			{CheckFunk: sizingSet.SizingWristBone, BoneName: pmx.WRIST},
+		},
+	)
+}